@@ -0,0 +1,228 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/go-ldap/ldap/v3"
+	"slices"
+	"time"
+)
+
+const (
+	accountActive          = "active"
+	accountDisabled        = "disabled"
+	accountLocked          = "locked"
+	accountPasswordExpired = "password_expired"
+
+	defaultLockoutWindow   = 15 // minutes
+	defaultLockoutCooldown = 15 // minutes
+)
+
+var accountStatuses = []string{accountActive, accountDisabled, accountLocked, accountPasswordExpired}
+
+// Account holds the state of a user's account, which samlidp.User has no room for
+type Account struct {
+	Username   string    `json:"username"`
+	Status     string    `json:"status,omitempty"`
+	ValidFrom  time.Time `json:"valid_from,omitzero"`
+	ValidUntil time.Time `json:"valid_until,omitzero"`
+
+	// Failed logins are counted from the first one in the lockout window
+	FailedLogins     int       `json:"failed_logins,omitempty"`
+	FirstFailedLogin time.Time `json:"first_failed_login,omitzero"`
+	LockedUntil      time.Time `json:"locked_until,omitzero"`
+
+	MustChangePassword bool      `json:"must_change_password,omitempty"`
+	PasswordChangedAt  time.Time `json:"password_changed_at,omitzero"`
+
+	// The hashes of previous passwords, most recent first, which cannot be chosen again
+	PasswordHistory [][]byte `json:"password_history,omitempty"`
+
+	// The subject DN of the client certificate the user can log in with
+	CertificateSubject string `json:"certificate_subject,omitempty"`
+}
+
+// accountError is returned instead of errInvalidCredentials when the account cannot be used to log in.
+// Its message is shown on the login page, and its status is returned to SAML service providers if enabled.
+// If changePassword is set, the user can resolve it by choosing a new password.
+type accountError struct {
+	message        string
+	status         string
+	changePassword bool
+}
+
+func (e *accountError) Error() string {
+	return e.message
+}
+
+var (
+	errAccountDisabled      = &accountError{"This account has been disabled", saml.StatusRequestDenied, false}
+	errAccountLocked        = &accountError{"This account is locked", saml.StatusAuthnFailed, false}
+	errPasswordExpired      = &accountError{"Your password has expired", saml.StatusAuthnFailed, true}
+	errMustChangePassword   = &accountError{"You must change your password", saml.StatusAuthnFailed, true}
+	errAccountNotYetValid   = &accountError{"This account is not active yet", saml.StatusRequestDenied, false}
+	errAccountExpired       = &accountError{"This account has expired", saml.StatusRequestDenied, false}
+	errUnknownAccountStatus = errors.New("unknown account status")
+)
+
+// newAccount builds the account of a configured user, parsing its dates and certificate subject
+func newAccount(user User) (*Account, error) {
+	account := &Account{
+		Username:           user.Username,
+		Status:             withDefault(user.Status, accountActive),
+		MustChangePassword: user.MustChangePassword,
+		CertificateSubject: user.CertificateSubject,
+	}
+
+	if !slices.Contains(accountStatuses, account.Status) {
+		return nil, fmt.Errorf("%w %q", errUnknownAccountStatus, account.Status)
+	}
+
+	var err error
+	if account.ValidFrom, err = parseDate(user.ValidFrom); err != nil {
+		return nil, fmt.Errorf("invalid valid_from: %w", err)
+	}
+	if account.ValidUntil, err = parseDate(user.ValidUntil); err != nil {
+		return nil, fmt.Errorf("invalid valid_until: %w", err)
+	}
+	if account.PasswordChangedAt, err = parseDate(user.PasswordChangedAt); err != nil {
+		return nil, fmt.Errorf("invalid password_changed_at: %w", err)
+	}
+	if account.CertificateSubject != "" {
+		if _, err = ldap.ParseDN(account.CertificateSubject); err != nil {
+			return nil, fmt.Errorf("invalid certificate_subject: %w", err)
+		}
+	}
+
+	return account, nil
+}
+
+// parseDate accepts either a date, which is taken to be midnight UTC, or an RFC 3339 timestamp
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// locked reports whether the account was locked, either explicitly or by too many failed logins
+func (a *Account) locked(now time.Time) bool {
+	return a.Status == accountLocked || now.Before(a.LockedUntil)
+}
+
+// isDefault reports whether nothing has been recorded about the account beyond it being active
+func (a *Account) isDefault() bool {
+	return a.Status == accountActive && a.ValidFrom.IsZero() && a.ValidUntil.IsZero() &&
+		!a.MustChangePassword && a.PasswordChangedAt.IsZero() && a.CertificateSubject == ""
+}
+
+// check returns the reason the account cannot be used to log in, if there is one.
+// Passwords older than maxAge have expired, unless it is zero or the age of the password is unknown.
+func (a *Account) check(now time.Time, maxAge time.Duration) error {
+	switch {
+	case a.Status == accountDisabled:
+		return errAccountDisabled
+	case a.locked(now):
+		return errAccountLocked
+	case !a.ValidFrom.IsZero() && now.Before(a.ValidFrom):
+		return errAccountNotYetValid
+	case !a.ValidUntil.IsZero() && !now.Before(a.ValidUntil):
+		return errAccountExpired
+	case a.Status == accountPasswordExpired:
+		return errPasswordExpired
+	case maxAge > 0 && !a.PasswordChangedAt.IsZero() && now.Sub(a.PasswordChangedAt) > maxAge:
+		return errPasswordExpired
+	case a.MustChangePassword:
+		return errMustChangePassword
+	}
+
+	return nil
+}
+
+// recordFailedLogin counts a failed login, locking the account once there have been too many within the window
+func (a *Account) recordFailedLogin(now time.Time, options LockoutOptions) {
+	window := time.Duration(options.Window) * time.Minute
+	if a.FailedLogins == 0 || now.Sub(a.FirstFailedLogin) > window {
+		a.FailedLogins = 0
+		a.FirstFailedLogin = now
+	}
+
+	a.FailedLogins++
+
+	if a.FailedLogins >= options.MaxAttempts {
+		a.LockedUntil = now.Add(time.Duration(options.Cooldown) * time.Minute)
+		a.FailedLogins = 0
+		a.FirstFailedLogin = time.Time{}
+	}
+}
+
+// loadAccount saves the account of a configured user. Active accounts without dates need not be stored,
+// so any account that is left over from before is removed instead.
+func (s *Server) loadAccount(account *Account) error {
+	if account.isDefault() {
+		return s.Store.DeleteAccount(account.Username)
+	}
+
+	return s.Store.AddAccount(account)
+}
+
+// account returns the account of the named user, which is active if nothing has been recorded about it
+func (s *Server) account(name string) (*Account, error) {
+	account, err := s.Store.GetAccount(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return &Account{Username: name, Status: accountActive}, nil
+	}
+
+	return account, err
+}
+
+// checkCredentials verifies the password of a user from the Store, enforcing the state of their account and counting
+// failed logins towards a lockout
+func (s *Server) checkCredentials(user *samlidp.User, password string) error {
+	account, err := s.account(user.Name)
+	if err != nil {
+		return err
+	}
+
+	now := saml.TimeNow()
+
+	// The password is not checked while locked, so it cannot be guessed in the meantime
+	if account.locked(now) {
+		return errAccountLocked
+	}
+
+	if !verifyPassword(user.HashedPassword, password) {
+		if s.config.Lockout.MaxAttempts > 0 {
+			err = s.Store.UpdateAccount(user.Name, func(account *Account) {
+				// Other logins may have locked the account while the password was being checked
+				if !account.locked(now) {
+					account.recordFailedLogin(now, s.config.Lockout)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return errInvalidCredentials
+	}
+
+	if account.FailedLogins > 0 {
+		err = s.Store.UpdateAccount(user.Name, func(account *Account) {
+			account.FailedLogins = 0
+			account.FirstFailedLogin = time.Time{}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return account.check(now, s.passwordMaxAge())
+}
@@ -0,0 +1,204 @@
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withAccountStates adds a user in each of the states an account can be in
+func withAccountStates(config *Config) {
+	config.Users = append(config.Users,
+		User{Username: "disabled", Password: "test", Status: accountDisabled},
+		User{Username: "locked", Password: "test", Status: accountLocked},
+		User{Username: "expired-password", Password: "test", Status: accountPasswordExpired},
+		User{Username: "future", Password: "test", ValidFrom: "2999-01-01"},
+		User{Username: "past", Password: "test", ValidUntil: "2000-01-01T00:00:00Z"},
+		User{Username: "current", Password: "test", ValidFrom: "2000-01-01", ValidUntil: "2999-01-01"},
+	)
+}
+
+func TestAccount_Statuses(t *testing.T) {
+	server := newTestServer(t, withAccountStates)
+
+	tests := map[string]error{
+		"test":             nil,
+		"current":          nil,
+		"disabled":         errAccountDisabled,
+		"locked":           errAccountLocked,
+		"expired-password": errPasswordExpired,
+		"future":           errAccountNotYetValid,
+		"past":             errAccountExpired,
+	}
+
+	for username, expected := range tests {
+		_, _, err := server.authenticate(username, "test", "")
+		assert.Equal(t, expected, err, username)
+	}
+
+	// The state of the account is only revealed to those who know the password, unless it is locked
+	_, _, err := server.authenticate("disabled", "wrong", "")
+	assert.ErrorIs(t, err, errInvalidCredentials)
+
+	_, _, err = server.authenticate("locked", "wrong", "")
+	assert.ErrorIs(t, err, errAccountLocked)
+}
+
+func TestAccount_InvalidConfig(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadUsers([]User{{Username: "bad", Password: "test", Status: "suspended"}})
+	require.ErrorIs(t, err, errUnknownAccountStatus)
+
+	err = server.LoadUsers([]User{{Username: "bad", Password: "test", ValidUntil: "tomorrow"}})
+	require.ErrorContains(t, err, "valid_until")
+}
+
+func TestAccount_Lockout(t *testing.T) {
+	now := time.Now()
+	saml.TimeNow = func() time.Time { return now }
+	t.Cleanup(func() { saml.TimeNow = time.Now })
+
+	server := newTestServer(t, func(config *Config) {
+		config.Lockout.MaxAttempts = 3
+	})
+
+	for range 2 {
+		_, _, err := server.authenticate("test", "wrong", "")
+		require.ErrorIs(t, err, errInvalidCredentials)
+	}
+
+	// Logging in successfully starts the count again
+	_, _, err := server.authenticate("test", "test", "")
+	require.NoError(t, err)
+
+	for range 3 {
+		_, _, err = server.authenticate("test", "wrong", "")
+		require.ErrorIs(t, err, errInvalidCredentials)
+	}
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.ErrorIs(t, err, errAccountLocked)
+
+	now = now.Add(time.Duration(defaultLockoutCooldown+1) * time.Minute)
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.NoError(t, err)
+
+	// Failed logins outside the window are forgotten
+	for range 2 {
+		_, _, err = server.authenticate("test", "wrong", "")
+		require.ErrorIs(t, err, errInvalidCredentials)
+	}
+
+	now = now.Add(time.Duration(defaultLockoutWindow+1) * time.Minute)
+
+	_, _, err = server.authenticate("test", "wrong", "")
+	require.ErrorIs(t, err, errInvalidCredentials)
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.NoError(t, err)
+}
+
+func TestAccount_ConcurrentFailedLogins(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.Lockout.MaxAttempts = 1000
+	})
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			_, _, _ = server.authenticate("test", "wrong", "")
+		})
+	}
+	wg.Wait()
+
+	account, err := server.Store.GetAccount("test")
+	require.NoError(t, err)
+	assert.Equal(t, 20, account.FailedLogins)
+}
+
+func TestAccount_DisablingEndsSessions(t *testing.T) {
+	server := newTestServer(t)
+	addTestSession(t, server.Store, "1", "test")
+
+	require.NoError(t, server.Store.AddAccount(&Account{Username: "test", Status: accountDisabled}))
+
+	_, err := server.Store.GetSession("1")
+	require.Error(t, err)
+}
+
+func TestAccount_LoginPageMessage(t *testing.T) {
+	server := newTestServer(t, withAccountStates)
+
+	form := authorizeParams()
+	form.Set("username", "disabled")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), errAccountDisabled.message)
+}
+
+// samlRequest returns a base64 encoded AuthnRequest from the test service provider
+func samlRequest(t *testing.T, server *Server) string {
+	acs, err := url.Parse(testAcs)
+	require.NoError(t, err)
+
+	sp := saml.ServiceProvider{EntityID: testEntityId, AcsURL: *acs, IDPMetadata: server.idp.Metadata()}
+
+	req, err := sp.MakeAuthenticationRequest(server.idp.SSOURL.String(), saml.HTTPPostBinding, saml.HTTPPostBinding)
+	require.NoError(t, err)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	buf, err := doc.WriteToBytes()
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// samlResponse decodes the Response in the form that posts it to the service provider
+func samlResponse(t *testing.T, w *httptest.ResponseRecorder) *saml.Response {
+	match := regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	require.NoError(t, err)
+
+	var response saml.Response
+	require.NoError(t, xml.Unmarshal(buf, &response))
+
+	return &response
+}
+
+func TestAccount_SamlErrorStatus(t *testing.T) {
+	server := newTestServer(t, withAccountStates, func(config *Config) {
+		config.LoginPage.SamlErrorStatus = true
+	})
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"disabled"},
+		"password":    {"test"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	assert.Equal(t, saml.StatusResponder, response.Status.StatusCode.Value)
+	assert.Equal(t, saml.StatusRequestDenied, response.Status.StatusCode.StatusCode.Value)
+	assert.Equal(t, errAccountDisabled.message, response.Status.StatusMessage.Value)
+	assert.Nil(t, response.Assertion)
+	assert.NotNil(t, response.Signature)
+}
@@ -0,0 +1,225 @@
+package idp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/rs/zerolog/log"
+	"maps"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+const defaultAttributeProviderTimeout = 5 // seconds
+
+// attributeRequest is sent to the attribute provider each time an assertion is made. Service is the entity ID of
+// the SAML service provider or the WS-Federation realm that the assertion is for.
+type attributeRequest struct {
+	User    attributeUser    `json:"user"`
+	Session attributeSession `json:"session"`
+	Service string           `json:"service"`
+}
+
+type attributeUser struct {
+	Username   string   `json:"username"`
+	Email      string   `json:"email,omitempty"`
+	FirstName  string   `json:"first_name,omitempty"`
+	LastName   string   `json:"last_name,omitempty"`
+	CommonName string   `json:"common_name,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+}
+
+type attributeSession struct {
+	Id         string              `json:"id"`
+	NameId     string              `json:"name_id"`
+	CreateTime time.Time           `json:"create_time"`
+	ExpireTime time.Time           `json:"expire_time"`
+	Methods    []string            `json:"amr"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// attributeResponse is the provider's answer. Attributes replace those with the same name, or are added to the
+// assertion if there are none, and an empty list of values removes the attribute.
+type attributeResponse struct {
+	Attributes map[string][]string `json:"attributes"`
+}
+
+// attributeProvider looks up extra attributes for each assertion, by posting to an HTTP endpoint or by running a
+// command that reads the request from stdin and writes its answer to stdout
+type attributeProvider struct {
+	options AttributeProviderOptions
+	client  *http.Client
+}
+
+func newAttributeProvider(options AttributeProviderOptions) *attributeProvider {
+	if options.Timeout == 0 {
+		options.Timeout = defaultAttributeProviderTimeout
+	}
+
+	return &attributeProvider{
+		options: options,
+		client:  &http.Client{Timeout: time.Duration(options.Timeout) * time.Second},
+	}
+}
+
+// attributes returns the provider's attributes for the session's assertion to the service. There are none if no
+// provider is configured, or if it failed and its errors are ignored.
+func (p *attributeProvider) attributes(session *saml.Session, service string) (map[string][]string, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(newAttributeRequest(session, service))
+	if err != nil {
+		return nil, err
+	}
+
+	var response *attributeResponse
+	if len(p.options.Command) > 0 {
+		response, err = p.run(body)
+	} else {
+		response, err = p.post(body)
+	}
+
+	if err != nil {
+		if p.options.IgnoreErrors {
+			log.Warn().Err(err).Str("service", service).Msg("ignoring attribute provider failure")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return response.Attributes, nil
+}
+
+func (p *attributeProvider) post(body []byte) (*attributeResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, p.options.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range p.options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("attribute provider: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attribute provider: unexpected status %s", res.Status)
+	}
+
+	var response attributeResponse
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("attribute provider: %w", err)
+	}
+
+	return &response, nil
+}
+
+func (p *attributeProvider) run(body []byte) (*attributeResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.options.Timeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.options.Command[0], p.options.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("attribute provider: %w: %s", err, message)
+		}
+		return nil, fmt.Errorf("attribute provider: %w", err)
+	}
+
+	var response attributeResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("attribute provider: %w", err)
+	}
+
+	return &response, nil
+}
+
+func newAttributeRequest(session *saml.Session, service string) attributeRequest {
+	attributes := map[string][]string{}
+	for _, attribute := range session.CustomAttributes {
+		for _, value := range attribute.Values {
+			attributes[attribute.Name] = append(attributes[attribute.Name], value.Value)
+		}
+	}
+
+	return attributeRequest{
+		User: attributeUser{
+			Username:   session.UserName,
+			Email:      session.UserEmail,
+			FirstName:  session.UserGivenName,
+			LastName:   session.UserSurname,
+			CommonName: session.UserCommonName,
+			Groups:     session.Groups,
+		},
+		Session: attributeSession{
+			Id:         session.ID,
+			NameId:     session.NameID,
+			CreateTime: session.CreateTime,
+			ExpireTime: session.ExpireTime,
+			Methods:    sessionMethods(session),
+			Attributes: attributes,
+		},
+		Service: service,
+	}
+}
+
+// mergeAttributes applies the provider's attributes to an assertion's attribute statement. Existing attributes are
+// matched by name or friendly name, and keep their name format when their values are replaced.
+func mergeAttributes(statement *saml.AttributeStatement, attributes map[string][]string) {
+	for _, name := range slices.Sorted(maps.Keys(attributes)) {
+		values := attributes[name]
+		matches := func(attribute saml.Attribute) bool {
+			return attribute.Name == name || attribute.FriendlyName == name
+		}
+
+		switch index := slices.IndexFunc(statement.Attributes, matches); {
+		case len(values) == 0:
+			statement.Attributes = slices.DeleteFunc(statement.Attributes, matches)
+		case index >= 0:
+			statement.Attributes[index].Values = stringAttribute(name, values...).Values
+		default:
+			statement.Attributes = append(statement.Attributes, stringAttribute(name, values...))
+		}
+	}
+}
+
+// mergeClaims applies the provider's attributes to WS-Federation claims, which are matched by URI or name. Names that
+// are not URIs are added to the claims namespace.
+func mergeClaims(claims []wsFedClaim, attributes map[string][]string) []wsFedClaim {
+	for _, name := range slices.Sorted(maps.Keys(attributes)) {
+		index := slices.IndexFunc(claims, func(claim wsFedClaim) bool {
+			return claim.Uri() == name || claim.Name == name
+		})
+
+		if index >= 0 {
+			claims[index].Values = attributes[name]
+			continue
+		}
+
+		claim := wsFedClaim{Namespace: claimsNamespace, Name: name, DisplayName: name, Values: attributes[name]}
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			claim.Namespace, claim.Name = name[:i], name[i+1:]
+		}
+		claims = append(claims, claim)
+	}
+
+	return claims
+}
@@ -0,0 +1,174 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// testBilling stands in for a billing service, which knows the license each user has for each service
+type testBilling struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []attributeRequest
+}
+
+func newTestBilling(t *testing.T) *testBilling {
+	billing := &testBilling{}
+
+	billing.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer billing-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var request attributeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		billing.mu.Lock()
+		billing.requests = append(billing.requests, request)
+		billing.mu.Unlock()
+
+		response := attributeResponse{Attributes: map[string][]string{"license": {"basic"}}}
+		if request.Service == testEntityId {
+			response.Attributes = map[string][]string{
+				"license":              {"pro"},
+				"eduPersonAffiliation": {"licensed", "foobar"},
+				"givenName":            {},
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(billing.Close)
+
+	return billing
+}
+
+func (b *testBilling) calls() []attributeRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]attributeRequest{}, b.requests...)
+}
+
+func assertionAttributes(t *testing.T, server *Server) map[string]saml.Attribute {
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"test"},
+		"password":    {"test"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	require.NotEmpty(t, response.Assertion.AttributeStatements)
+
+	attributes := map[string]saml.Attribute{}
+	for _, attribute := range response.Assertion.AttributeStatements[0].Attributes {
+		attributes[attribute.FriendlyName] = attribute
+	}
+
+	return attributes
+}
+
+func attributeValues(attribute saml.Attribute) []string {
+	var values []string
+	for _, value := range attribute.Values {
+		values = append(values, value.Value)
+	}
+
+	return values
+}
+
+func TestAttributeProvider_Url(t *testing.T) {
+	billing := newTestBilling(t)
+	server := newTestServer(t, func(config *Config) {
+		config.AttributeProvider = &AttributeProviderOptions{
+			Url:     billing.URL,
+			Headers: map[string]string{"Authorization": "Bearer billing-token"},
+		}
+	})
+
+	attributes := assertionAttributes(t, server)
+	assert.Equal(t, []string{"pro"}, attributeValues(attributes["license"]))
+	assert.NotContains(t, attributes, "givenName")
+
+	// Replaced attributes keep their names, so service providers still recognise them
+	groups := attributes["eduPersonAffiliation"]
+	assert.Equal(t, []string{"licensed", "foobar"}, attributeValues(groups))
+	assert.Equal(t, "urn:oid:1.3.6.1.4.1.5923.1.1.1.1", groups.Name)
+
+	require.Len(t, billing.calls(), 1)
+	request := billing.calls()[0]
+	assert.Equal(t, testEntityId, request.Service)
+	assert.Equal(t, "test", request.User.Username)
+	assert.Equal(t, "test@test.com", request.User.Email)
+	assert.Equal(t, []string{"foobar"}, request.User.Groups)
+	assert.Equal(t, []string{amrPassword}, request.Session.Methods)
+	assert.NotEmpty(t, request.Session.Id)
+
+	// The provider is asked again for each assertion, so answers can change between logins
+	rstr := signInWsFed(t, server, testEntityId+"-saml11")
+	license := rstr.FindElement(`.//Attribute[@AttributeName='license']`)
+	require.NotNil(t, license)
+	assert.Equal(t, claimsNamespace, license.SelectAttrValue("AttributeNamespace", ""))
+	assert.Equal(t, "basic", license.FindElement("./AttributeValue").Text())
+
+	require.Len(t, billing.calls(), 2)
+	assert.Equal(t, testEntityId+"-saml11", billing.calls()[1].Service)
+}
+
+func TestAttributeProvider_Command(t *testing.T) {
+	script := `read -r request
+case "$request" in
+  *'"username":"test"'*) echo '{"attributes": {"license": ["trial"]}}' ;;
+  *) echo "unknown user" >&2; exit 1 ;;
+esac`
+
+	server := newTestServer(t, func(config *Config) {
+		config.AttributeProvider = &AttributeProviderOptions{Command: []string{"sh", "-c", script}}
+	})
+
+	attributes := assertionAttributes(t, server)
+	assert.Equal(t, []string{"trial"}, attributeValues(attributes["license"]))
+	assert.Equal(t, []string{"foobar"}, attributeValues(attributes["eduPersonAffiliation"]))
+
+	_, err := server.attributes.attributes(&saml.Session{UserName: "other"}, testEntityId)
+	assert.ErrorContains(t, err, "unknown user")
+}
+
+func TestAttributeProvider_Failures(t *testing.T) {
+	billing := newTestBilling(t)
+	server := newTestServer(t, func(config *Config) {
+		config.AttributeProvider = &AttributeProviderOptions{Url: billing.URL}
+	})
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"test"},
+		"password":    {"test"},
+	}))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "SAMLResponse")
+
+	// Unless errors are ignored, in which case the assertion is made without the provider's attributes
+	server = newTestServer(t, func(config *Config) {
+		config.AttributeProvider = &AttributeProviderOptions{Command: []string{"false"}, IgnoreErrors: true}
+	})
+
+	attributes := assertionAttributes(t, server)
+	assert.NotContains(t, attributes, "license")
+	assert.Equal(t, []string{"Test"}, attributeValues(attributes["givenName"]))
+}
@@ -0,0 +1,205 @@
+package idp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	webhookModeFallback = "fallback"
+	webhookModeReplace  = "replace"
+
+	defaultWebhookTimeout = 5 // seconds
+)
+
+var webhookModes = []string{webhookModeFallback, webhookModeReplace}
+
+// webhookRequest is posted to the webhook for each login. Service is the entity ID of the SAML service provider,
+// the OIDC client ID or the WS-Federation realm that the user is logging in to, if any.
+type webhookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Service  string `json:"service,omitempty"`
+}
+
+// webhookDecision is the webhook's answer. Denials may carry a message, which is shown on the login page.
+// Username defaults to the submitted one, and NameId to the email address.
+type webhookDecision struct {
+	Allow      bool                `json:"allow"`
+	Message    string              `json:"message,omitempty"`
+	Username   string              `json:"username,omitempty"`
+	NameId     string              `json:"name_id,omitempty"`
+	Email      string              `json:"email,omitempty"`
+	FirstName  string              `json:"first_name,omitempty"`
+	LastName   string              `json:"last_name,omitempty"`
+	CommonName string              `json:"common_name,omitempty"`
+	Groups     []string            `json:"groups,omitempty"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+type cachedDecision struct {
+	decision *webhookDecision
+	expires  time.Time
+}
+
+// authWebhook authenticates users by asking an HTTP endpoint, remembering its decisions for a while if configured
+type authWebhook struct {
+	options AuthWebhookOptions
+	client  *http.Client
+
+	mu     sync.Mutex
+	cache  map[string]cachedDecision
+	pruned time.Time
+}
+
+func newAuthWebhook(options AuthWebhookOptions) *authWebhook {
+	if options.Mode == "" {
+		options.Mode = webhookModeFallback
+	}
+	if options.Timeout == 0 {
+		options.Timeout = defaultWebhookTimeout
+	}
+
+	return &authWebhook{
+		options: options,
+		client:  &http.Client{Timeout: time.Duration(options.Timeout) * time.Second},
+		cache:   map[string]cachedDecision{},
+	}
+}
+
+// authenticate asks the webhook whether the credentials are valid for the service. A denial is errInvalidCredentials,
+// or an accountError if the webhook said why.
+func (h *authWebhook) authenticate(username, password, service string) (*samlidp.User, []saml.Attribute, error) {
+	if username == "" {
+		return nil, nil, errInvalidCredentials
+	}
+
+	decision, err := h.decide(webhookRequest{Username: username, Password: password, Service: service})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !decision.Allow {
+		if decision.Message != "" {
+			return nil, nil, &accountError{decision.Message, saml.StatusAuthnFailed, false}
+		}
+		return nil, nil, errInvalidCredentials
+	}
+
+	user := &samlidp.User{
+		Name:       withDefault(decision.Username, username),
+		Email:      decision.Email,
+		GivenName:  decision.FirstName,
+		Surname:    decision.LastName,
+		CommonName: decision.CommonName,
+		Groups:     decision.Groups,
+	}
+
+	var attributes []saml.Attribute
+	for _, name := range slices.Sorted(maps.Keys(decision.Attributes)) {
+		attributes = append(attributes, stringAttribute(name, decision.Attributes[name]...))
+	}
+
+	if decision.NameId != "" {
+		attributes = append(attributes, stringAttribute(nameIdAttribute, decision.NameId))
+	}
+
+	return user, attributes, nil
+}
+
+// decide returns the webhook's decision, which is taken from the cache if the same request was made recently
+func (h *authWebhook) decide(request webhookRequest) (*webhookDecision, error) {
+	key := h.cacheKey(request)
+
+	h.mu.Lock()
+	cached, ok := h.cache[key]
+	if ok && !time.Now().Before(cached.expires) {
+		delete(h.cache, key)
+		ok = false
+	}
+	h.mu.Unlock()
+
+	if ok {
+		return cached.decision, nil
+	}
+
+	decision, err := h.call(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.options.CacheTtl > 0 {
+		ttl := time.Duration(h.options.CacheTtl) * time.Second
+		now := time.Now()
+
+		h.mu.Lock()
+		h.cache[key] = cachedDecision{decision: decision, expires: now.Add(ttl)}
+
+		// Every password tried is a new key, so expired decisions are swept out once per TTL to keep the cache small
+		if now.Sub(h.pruned) >= ttl {
+			maps.DeleteFunc(h.cache, func(_ string, cached cachedDecision) bool {
+				return !now.Before(cached.expires)
+			})
+			h.pruned = now
+		}
+		h.mu.Unlock()
+	}
+
+	return decision, nil
+}
+
+func (h *authWebhook) call(request webhookRequest) (*webhookDecision, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.options.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range h.options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth webhook: unexpected status %s", res.Status)
+	}
+
+	var decision webhookDecision
+	if err = json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return nil, fmt.Errorf("auth webhook: %w", err)
+	}
+
+	return &decision, nil
+}
+
+// cacheKey hashes the request, so that passwords are not kept in memory as they are
+func (h *authWebhook) cacheKey(request webhookRequest) string {
+	hash := sha256.New()
+	for _, part := range []string{request.Service, request.Username, request.Password} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
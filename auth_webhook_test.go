@@ -0,0 +1,220 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook stands in for a team's webhook, allowing alice with the password "secret" and recording each request
+type testWebhook struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []webhookRequest
+}
+
+func newTestWebhook(t *testing.T, delay time.Duration) *testWebhook {
+	webhook := &testWebhook{}
+
+	webhook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+
+		if r.Header.Get("Authorization") != "Bearer hook-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var request webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		webhook.mu.Lock()
+		webhook.requests = append(webhook.requests, request)
+		webhook.mu.Unlock()
+
+		decision := webhookDecision{Allow: false}
+		switch {
+		case request.Username == "alice" && request.Password == "secret":
+			decision = webhookDecision{
+				Allow:      true,
+				NameId:     "alice-persistent-id",
+				Email:      "alice@example.com",
+				FirstName:  "Alice",
+				LastName:   "Smith",
+				Groups:     []string{"engineering"},
+				Attributes: map[string][]string{"department": {"R&D"}},
+			}
+		case request.Username == "bob":
+			decision.Message = "Bob has to call the help desk"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(decision)
+	}))
+	t.Cleanup(webhook.Close)
+
+	return webhook
+}
+
+func (h *testWebhook) calls() []webhookRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]webhookRequest{}, h.requests...)
+}
+
+func webhookTestServer(t *testing.T, webhook *testWebhook, configure ...func(*AuthWebhookOptions)) *Server {
+	return newTestServer(t, func(config *Config) {
+		config.AuthWebhook = &AuthWebhookOptions{
+			Url:     webhook.URL,
+			Headers: map[string]string{"Authorization": "Bearer hook-token"},
+		}
+
+		for _, fn := range configure {
+			fn(config.AuthWebhook)
+		}
+	})
+}
+
+func TestAuthWebhook_Fallback(t *testing.T) {
+	webhook := newTestWebhook(t, 0)
+	server := webhookTestServer(t, webhook)
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"alice"},
+		"password":    {"secret"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	assert.Equal(t, "alice-persistent-id", response.Assertion.Subject.NameID.Value)
+
+	attributes := map[string][]string{}
+	for _, attribute := range response.Assertion.AttributeStatements[0].Attributes {
+		for _, value := range attribute.Values {
+			attributes[attribute.FriendlyName] = append(attributes[attribute.FriendlyName], value.Value)
+		}
+	}
+	assert.Equal(t, []string{"R&D"}, attributes["department"])
+	assert.Equal(t, []string{"engineering"}, attributes["eduPersonAffiliation"])
+	assert.NotContains(t, attributes, nameIdAttribute)
+
+	require.Len(t, webhook.calls(), 1)
+	assert.Equal(t, webhookRequest{Username: "alice", Password: "secret", Service: testEntityId}, webhook.calls()[0])
+
+	// Configured users are checked first, so the webhook is not asked about them
+	_, _, err := server.authenticate("test", "test", "")
+	require.NoError(t, err)
+	assert.Len(t, webhook.calls(), 1)
+
+	_, _, err = server.authenticate("test", "wrong", testClientId)
+	assert.ErrorIs(t, err, errInvalidCredentials)
+	assert.Len(t, webhook.calls(), 2)
+}
+
+func TestAuthWebhook_Replace(t *testing.T) {
+	webhook := newTestWebhook(t, 0)
+	server := webhookTestServer(t, webhook, func(options *AuthWebhookOptions) {
+		options.Mode = webhookModeReplace
+	})
+
+	_, _, err := server.authenticate("test", "test", "")
+	assert.ErrorIs(t, err, errInvalidCredentials)
+
+	form := authorizeParams()
+	form.Set("username", "bob")
+	form.Set("password", "anything")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Bob has to call the help desk")
+
+	require.Len(t, webhook.calls(), 2)
+	assert.Equal(t, testClientId, webhook.calls()[1].Service)
+}
+
+func TestAuthWebhook_Cache(t *testing.T) {
+	webhook := newTestWebhook(t, 0)
+	server := webhookTestServer(t, webhook, func(options *AuthWebhookOptions) {
+		options.CacheTtl = 60
+	})
+
+	for range 3 {
+		user, _, err := server.authenticate("alice", "secret", testEntityId)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", user.Name)
+	}
+	assert.Len(t, webhook.calls(), 1)
+
+	// Decisions are remembered for the exact credentials and service only
+	_, _, err := server.authenticate("alice", "wrong", testEntityId)
+	assert.ErrorIs(t, err, errInvalidCredentials)
+
+	_, _, err = server.authenticate("alice", "secret", testClientId)
+	require.NoError(t, err)
+	assert.Len(t, webhook.calls(), 3)
+}
+
+func TestAuthWebhook_CacheExpiry(t *testing.T) {
+	webhook := newTestWebhook(t, 0)
+	server := webhookTestServer(t, webhook, func(options *AuthWebhookOptions) {
+		options.CacheTtl = 60
+	})
+
+	// Decisions for guesses that are never made again do not stay around once they expire
+	expired := time.Now().Add(-time.Second)
+	for _, key := range []string{"guess-1", "guess-2"} {
+		server.webhook.cache[key] = cachedDecision{decision: &webhookDecision{}, expires: expired}
+	}
+
+	_, _, err := server.authenticate("alice", "secret", testEntityId)
+	require.NoError(t, err)
+	assert.Len(t, server.webhook.cache, 1)
+
+	// Nor are they used for a request that is made again
+	key := server.webhook.cacheKey(webhookRequest{Username: "alice", Password: "secret", Service: testEntityId})
+	server.webhook.cache[key] = cachedDecision{decision: &webhookDecision{}, expires: expired}
+
+	_, _, err = server.authenticate("alice", "secret", testEntityId)
+	require.NoError(t, err)
+	assert.Len(t, webhook.calls(), 2)
+}
+
+func TestAuthWebhook_Failures(t *testing.T) {
+	slow := newTestWebhook(t, 2*time.Second)
+	server := webhookTestServer(t, slow, func(options *AuthWebhookOptions) {
+		options.Timeout = 1
+	})
+
+	_, _, err := server.authenticate("alice", "secret", "")
+	assert.ErrorContains(t, err, "auth webhook")
+
+	unauthorized := newTestWebhook(t, 0)
+	server = webhookTestServer(t, unauthorized, func(options *AuthWebhookOptions) {
+		options.Headers = nil
+	})
+
+	_, _, err = server.authenticate("alice", "secret", "")
+	assert.ErrorContains(t, err, "401")
+
+	// Errors are not mistaken for a denial, and show the generic message
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"alice"},
+		"password":    {"secret"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid username or password")
+	assert.NotContains(t, w.Body.String(), "SAMLResponse")
+}
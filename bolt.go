@@ -0,0 +1,94 @@
+package idp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/crewjam/saml/samlidp"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	storageBolt = "bolt"
+
+	boltOpenTimeout = 5 * time.Second
+)
+
+var boltBucket = []byte("idp")
+
+// boltStore is a samlidp.Store that persists values as JSON in a single bbolt bucket
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a path is required for %s storage", storageBolt)
+	}
+
+	// bbolt holds an exclusive lock on the file, so a second instance gives up instead of waiting forever
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(key string, value any) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(boltBucket).Get([]byte(key))
+		if buf == nil {
+			return samlidp.ErrNotFound
+		}
+
+		return json.Unmarshal(buf, value)
+	})
+}
+
+func (s *boltStore) Put(key string, value any) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), buf)
+	})
+}
+
+func (s *boltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+			keys = append(keys, string(k[len(prefix):]))
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
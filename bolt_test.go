@@ -0,0 +1,64 @@
+package idp
+
+import (
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	backend, err := openBoltStore(filepath.Join(t.TempDir(), "idp.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	store := &Store{Backend: backend}
+
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "alice"}))
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "bob"}))
+	require.NoError(t, store.AddGroup(&Group{Name: "admins"}))
+
+	users, err := store.GetUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	require.NoError(t, store.DeleteUser("alice"))
+
+	_, err = store.GetUser("alice")
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+
+	keys, err := store.List(usersPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, keys)
+}
+
+func TestBoltStore_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idp.db")
+	storage := func(config *Config) {
+		config.Storage = StorageOptions{Type: storageBolt, Path: path}
+	}
+
+	server := newTestServer(t, storage)
+	require.NoError(t, server.Store.AddUser(&samlidp.User{Name: "created-at-runtime"}))
+	require.NoError(t, server.Store.AddSession(&saml.Session{ID: "active", ExpireTime: time.Now().Add(time.Hour)}))
+	require.NoError(t, server.Store.AddSession(&saml.Session{ID: "expired", ExpireTime: time.Now().Add(-time.Hour)}))
+	require.NoError(t, server.Close())
+
+	server = newTestServer(t, storage)
+	defer server.Close()
+
+	_, err := server.Store.GetUser("created-at-runtime")
+	require.NoError(t, err)
+
+	_, err = server.Store.GetUser("test")
+	require.NoError(t, err)
+
+	_, err = server.Store.GetSession("active")
+	require.NoError(t, err)
+
+	_, err = server.Store.GetSession("expired")
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+}
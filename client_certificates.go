@@ -0,0 +1,152 @@
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/go-ldap/ldap/v3"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	certificateField = "certificate_login"
+
+	clientMappingEmail     = "email"
+	clientMappingSubject   = "subject"
+	clientMappingAttribute = "attribute"
+
+	defaultClientAttribute = "CN"
+
+	// Authentication method of RFC 8176 used by client certificates, which emulate smart cards
+	amrSmartCard = "sc"
+
+	// tlsClientAuthnContext is asserted as the AuthnContextClassRef of sessions started with a client certificate
+	tlsClientAuthnContext = "urn:oasis:names:tc:SAML:2.0:ac:classes:TLSClient"
+
+	// tlsClientAuthnMethod is its equivalent in SAML 1.1 assertions
+	tlsClientAuthnMethod = "urn:ietf:rfc:2246"
+)
+
+var clientMappings = []string{clientMappingEmail, clientMappingSubject, clientMappingAttribute}
+
+// subjectAttributes are the OIDs of the subject attributes that can be named for the "attribute" mapping
+var subjectAttributes = map[string]string{
+	"CN":           "2.5.4.3",
+	"SERIALNUMBER": "2.5.4.5",
+	"OU":           "2.5.4.11",
+	"UID":          "0.9.2342.19200300.100.1.1",
+	"EMAILADDRESS": "1.2.840.113549.1.9.1",
+}
+
+var errInvalidCertificate = errors.New("invalid client certificate")
+
+// newTlsConfig loads the server's certificate and, if client certificates are used, the CAs that issue them.
+// Certificates are only requested, as service providers fetching metadata do not have one.
+func newTlsConfig(options TlsOptions) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(options.CertificatePath, options.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if options.ClientCaPath != "" {
+		bundle, err := os.ReadFile(options.ClientCaPath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", options.ClientCaPath)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// clientCertificate returns the certificate the browser presented, if it was issued by one of the configured CAs
+func clientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errInvalidCertificate
+	}
+
+	return r.TLS.VerifiedChains[0][0], nil
+}
+
+// certificateUser returns the user that the request's client certificate belongs to
+func (s *Server) certificateUser(r *http.Request) (*samlidp.User, error) {
+	if s.config.Tls == nil || s.config.Tls.ClientCaPath == "" {
+		return nil, errInvalidCertificate
+	}
+
+	certificate, err := clientCertificate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.config.Tls.ClientMapping {
+	case clientMappingSubject:
+		return s.findUserBySubject(certificate.Subject.String())
+	case clientMappingAttribute:
+		oid := withDefault(subjectAttributes[strings.ToUpper(s.config.Tls.ClientAttribute)], s.config.Tls.ClientAttribute)
+
+		for _, name := range certificate.Subject.Names {
+			if value, ok := name.Value.(string); ok && name.Type.String() == oid {
+				return s.findUserByName(value)
+			}
+		}
+	default:
+		for _, email := range certificate.EmailAddresses {
+			if user, err := s.findUserByEmail(email); err == nil {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, errInvalidCertificate
+}
+
+// findUserBySubject looks up the user whose certificate_subject is the DN, comparing it as a DN rather than a string
+func (s *Server) findUserBySubject(subject string) (*samlidp.User, error) {
+	dn, err := ldap.ParseDN(subject)
+	if err != nil {
+		return nil, errInvalidCertificate
+	}
+
+	accounts, err := s.Store.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		if account.CertificateSubject == "" {
+			continue
+		}
+
+		if other, err := ldap.ParseDN(account.CertificateSubject); err == nil && dn.EqualFold(other) {
+			return s.Store.GetUser(account.Username)
+		}
+	}
+
+	return nil, errInvalidCertificate
+}
+
+// resolveCertificateLogin logs in the user whose client certificate the browser presented
+func (s *Server) resolveCertificateLogin(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	user, err := s.certificateUser(r)
+	if err != nil {
+		s.failLogin(w, r, form, nil, errInvalidCertificate)
+		return nil
+	}
+
+	return s.startPasswordlessSession(w, r, form, user, amrSmartCard)
+}
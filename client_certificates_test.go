@@ -0,0 +1,264 @@
+package idp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCa issues the certificates used by the tests
+type testCa struct {
+	t           *testing.T
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+func newTestCa(t *testing.T) *testCa {
+	ca := &testCa{t: t}
+	ca.certificate, ca.key = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+
+	return ca
+}
+
+// issue signs the template, or self-signs it if the CA has no certificate yet
+func (ca *testCa) issue(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, parentKey := template, key
+	if ca.certificate != nil {
+		parent, parentKey = ca.certificate, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(ca.t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(ca.t, err)
+
+	return certificate, key
+}
+
+func (ca *testCa) client(subject pkix.Name, emails ...string) *x509.Certificate {
+	certificate, _ := ca.issue(&x509.Certificate{
+		Subject:        subject,
+		EmailAddresses: emails,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return certificate
+}
+
+// writePem saves the certificate, and the key if there is one, returning the paths of the files
+func writePem(t *testing.T, certificate *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	dir := t.TempDir()
+
+	certPath := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0600))
+
+	if key == nil {
+		return certPath, ""
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	return certPath, keyPath
+}
+
+// withClientCertificates serves TLS with a certificate issued by the CA, which also verifies client certificates
+func withClientCertificates(t *testing.T, ca *testCa) func(*Config) {
+	serverCert, serverKey := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	certPath, keyPath := writePem(t, serverCert, serverKey)
+	caPath, _ := writePem(t, ca.certificate, nil)
+
+	return func(config *Config) {
+		config.Tls = &TlsOptions{CertificatePath: certPath, KeyPath: keyPath, ClientCaPath: caPath}
+	}
+}
+
+// withCertificate makes the request look as if it came over TLS with the certificate, verified by the CA
+func withCertificate(req *http.Request, ca *testCa, certificate *x509.Certificate) *http.Request {
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate, ca.certificate}}}
+	return req
+}
+
+func TestClientCertificate_EmailMapping(t *testing.T) {
+	ca := newTestCa(t)
+	server := newTestServer(t, withClientCertificates(t, ca))
+	certificate := ca.client(pkix.Name{CommonName: "Someone"}, "other@test.com", "test@test.com")
+
+	req := httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil)
+	w := serve(server, withCertificate(req, ca, certificate))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login as test with your certificate")
+
+	form := authorizeParams()
+	form.Set(certificateField, "1")
+
+	w = serve(server, withCertificate(postForm(authorizeRoute, form), ca, certificate))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, "test", idToken.Subject)
+	assert.Equal(t, []string{amrSmartCard}, idToken.AuthMethods)
+
+	// Without a certificate, the login falls back to the password form
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Your certificate was not recognised")
+	assert.NotContains(t, w.Body.String(), "with your certificate")
+}
+
+func TestClientCertificate_SubjectMapping(t *testing.T) {
+	ca := newTestCa(t)
+	server := newTestServer(t, withClientCertificates(t, ca), func(config *Config) {
+		config.Tls.ClientMapping = clientMappingSubject
+		config.Users[0].CertificateSubject = "CN=Test User,OU=People,O=Test"
+	})
+
+	// DNs are compared regardless of case
+	certificate := ca.client(pkix.Name{CommonName: "test user", OrganizationalUnit: []string{"People"}, Organization: []string{"Test"}})
+
+	w := serve(server, withCertificate(postForm(ssoRoute, url.Values{
+		"SAMLRequest":    {samlRequest(t, server)},
+		certificateField: {"1"},
+	}), ca, certificate))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	assert.Equal(t, "test@test.com", response.Assertion.Subject.NameID.Value)
+	require.Len(t, response.Assertion.AuthnStatements, 1)
+	assert.Equal(t, tlsClientAuthnContext, response.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value)
+
+	other := ca.client(pkix.Name{CommonName: "Someone Else", Organization: []string{"Test"}})
+	req := httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil)
+	w = serve(server, withCertificate(req, ca, other))
+	assert.NotContains(t, w.Body.String(), "with your certificate")
+}
+
+func TestClientCertificate_AttributeMapping(t *testing.T) {
+	ca := newTestCa(t)
+	server := newTestServer(t, withClientCertificates(t, ca), func(config *Config) {
+		config.Tls.ClientMapping = clientMappingAttribute
+		config.Tls.ClientAttribute = "uid"
+	})
+
+	uid := asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+	certificate := ca.client(pkix.Name{
+		CommonName: "Test User",
+		ExtraNames: []pkix.AttributeTypeAndValue{{Type: uid, Value: "test"}},
+	})
+
+	form := authorizeParams()
+	form.Set(certificateField, "1")
+
+	w := serve(server, withCertificate(postForm(authorizeRoute, form), ca, certificate))
+	assert.Equal(t, http.StatusFound, w.Code, w.Body.String())
+}
+
+func TestClientCertificate_InvalidSubject(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadUsers([]User{{Username: "bad", Email: "bad@test.com", Password: "test", CertificateSubject: "not a DN"}})
+	assert.ErrorContains(t, err, "invalid certificate_subject")
+}
+
+func TestClientCertificate_Handshake(t *testing.T) {
+	ca := newTestCa(t)
+	server := newTestServer(t, withClientCertificates(t, ca))
+
+	listener := httptest.NewUnstartedServer(server.router)
+	listener.TLS = server.tlsConfig
+	listener.StartTLS()
+	defer listener.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	get := func(certificates ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+
+		res, err := client.Get(listener.URL + authorizeRoute + "?" + authorizeParams().Encode())
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	clientKey := func(issuer *testCa) tls.Certificate {
+		certificate, key := issuer.issue(&x509.Certificate{
+			Subject:        pkix.Name{CommonName: "Test User"},
+			EmailAddresses: []string{"test@test.com"},
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key}
+	}
+
+	body, err := get(clientKey(ca))
+	require.NoError(t, err)
+	assert.Contains(t, body, "Login as test with your certificate")
+
+	// Certificates are optional, so the password form can still be used without one
+	body, err = get()
+	require.NoError(t, err)
+	assert.NotContains(t, body, "with your certificate")
+
+	// But certificates from other CAs are refused
+	_, err = get(clientKey(newTestCa(t)))
+	assert.Error(t, err)
+}
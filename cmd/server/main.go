@@ -38,17 +38,34 @@ func main() {
 	})
 
 	log.Info().Msg("Loading users")
-	err = server.LoadUsers(config.Users)
+	users, err := idp.ReadUserFiles(config.UserFiles)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error reading user files")
+	}
+
+	err = server.LoadUsers(append(config.Users, users...))
 	if err != nil {
 		log.Fatal().Err(err).Msg("error loading users")
 	}
 
+	log.Info().Msg("Loading groups")
+	err = server.LoadGroups(config.Groups)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading groups")
+	}
+
 	log.Info().Msg("Loading services")
 	err = server.LoadServices(config.Services)
 	if err != nil {
 		log.Fatal().Err(err).Msg("error loading services")
 	}
 
+	log.Info().Msg("Loading OIDC clients")
+	err = server.LoadClients(config.Clients)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading OIDC clients")
+	}
+
 	log.Info().Msg("Starting server")
 	if err = server.Run(); err != nil {
 		log.Fatal().Err(err).Msg("error running server")
@@ -3,8 +3,35 @@ package idp
 type Config struct {
 	Host      string           `mapstructure:"host"`
 	Services  []Service        `mapstructure:"services"`
+	Clients   []Client         `mapstructure:"clients"`
 	Users     []User           `mapstructure:"users"`
 	LoginPage LoginPageOptions `mapstructure:"login_page"`
+	Scim      ScimOptions      `mapstructure:"scim"`
+
+	// Optional. Groups with their own members, subgroups and attributes, in addition to those named by users
+	Groups []Group `mapstructure:"groups"`
+
+	// Optional. How groups are asserted, either by "name", "dn" or "id". Defaults to "name"
+	GroupFormat string `mapstructure:"group_format"`
+
+	// Optional. The DN that groups without a dn are placed beneath. Defaults to ou=groups and the host's domain
+	// components, such as "ou=groups,dc=localhost"
+	GroupBaseDn string `mapstructure:"group_base_dn"`
+
+	// Optional. If set, users are also authenticated against an LDAP directory
+	Ldap *LdapOptions `mapstructure:"ldap"`
+
+	// Optional. If set, users are also authenticated by posting their credentials to an HTTP endpoint
+	AuthWebhook *AuthWebhookOptions `mapstructure:"auth_webhook"`
+
+	// Optional. Asks an HTTP endpoint or a command for extra attributes each time an assertion is made
+	AttributeProvider *AttributeProviderOptions `mapstructure:"attribute_provider"`
+
+	// Optional. Where users, sessions and everything else are kept. Defaults to memory
+	Storage StorageOptions `mapstructure:"storage"`
+
+	// Optional. Files that users are imported from, in addition to those listed under users
+	UserFiles []UserFile `mapstructure:"user_files"`
 
 	// Optional. If empty, an auto-generated certificate and key will be used
 	CertificatePath string `mapstructure:"certificate"`
@@ -12,24 +39,367 @@ type Config struct {
 
 	// Optional. The number of minutes that the SAML session is valid for. Defaults to 60
 	SessionMaxAge int `mapstructure:"session_max_age"`
+
+	// Optional. If set, changing a user's attributes ends their sessions, so their next login picks up the changes
+	RevokeSessionsOnUpdate bool `mapstructure:"revoke_sessions_on_update"`
+
+	// Optional. Locks accounts after repeated failed logins
+	Lockout LockoutOptions `mapstructure:"lockout"`
+
+	// Optional. The rules that new passwords chosen by users must follow
+	PasswordPolicy PasswordPolicyOptions `mapstructure:"password_policy"`
+
+	// Optional. Asks users with a TOTP secret for a code after their password
+	Totp TotpOptions `mapstructure:"totp"`
+
+	// Optional. If set, users can register passkeys on their account page and log in with them
+	Passkeys *PasskeyOptions `mapstructure:"passkeys"`
+
+	// Optional. If set, the server listens with TLS, and can ask for client certificates for users to log in with
+	Tls *TlsOptions `mapstructure:"tls"`
+
+	// Optional. If set, users can log in with a code sent to their email address, which is kept in the IdP's mailbox
+	EmailLogin *EmailLoginOptions `mapstructure:"email_login"`
+
+	// Optional. The bcrypt cost used when hashing plain text passwords. Defaults to 10
+	BcryptCost int `mapstructure:"bcrypt_cost"`
 }
 
 type Service struct {
 	EntityId                 string `mapstructure:"entity_id"`
 	AssertionConsumerService string `mapstructure:"assertion_consumer_service"`
+
+	// Optional. The token issued to WS-Federation relying parties, either "saml2" or "saml11". Defaults to "saml2"
+	WsFedTokenType string `mapstructure:"wsfed_token_type"`
+
+	// Optional. How groups are asserted to the service, either by "name", "dn" or "id". Defaults to group_format
+	GroupFormat string `mapstructure:"group_format"`
+
+	// Optional. If set, users are pushed to the service's SCIM endpoint whenever they change
+	Scim *ScimTarget `mapstructure:"scim"`
+}
+
+type ScimTarget struct {
+	BaseUrl string `mapstructure:"base_url"`
+	Token   string `mapstructure:"token"`
+
+	// Optional. Maps SCIM attribute paths (e.g. "name.givenName") to user fields: username, email,
+	// first_name, last_name or common_name. Unmapped attributes use the defaults
+	AttributeMapping map[string]string `mapstructure:"attribute_mapping"`
+
+	// Optional. Either "delete" or "deactivate". Defaults to "delete"
+	Deprovision string `mapstructure:"deprovision"`
+}
+
+// Client is an OpenID Connect relying party
+type Client struct {
+	ClientId     string   `mapstructure:"client_id" json:"client_id"`
+	RedirectUris []string `mapstructure:"redirect_uris" json:"redirect_uris"`
+
+	// Optional. Clients without a secret are treated as public clients and must use PKCE
+	ClientSecret string `mapstructure:"client_secret" json:"client_secret,omitempty"`
+
+	// Optional. The URIs that the end session endpoint is allowed to redirect to
+	PostLogoutRedirectUris []string `mapstructure:"post_logout_redirect_uris" json:"post_logout_redirect_uris,omitempty"`
 }
 
 type User struct {
-	Username  string   `mapstructure:"username"`
-	Email     string   `mapstructure:"email"`
-	Password  string   `mapstructure:"password"`
-	FirstName string   `mapstructure:"first_name"`
-	LastName  string   `mapstructure:"last_name"`
-	Groups    []string `mapstructure:"groups"`
+	Username  string   `mapstructure:"username" json:"username"`
+	Email     string   `mapstructure:"email" json:"email"`
+	Password  string   `mapstructure:"password" json:"password"`
+	FirstName string   `mapstructure:"first_name" json:"first_name"`
+	LastName  string   `mapstructure:"last_name" json:"last_name"`
+	Groups    []string `mapstructure:"groups" json:"groups"`
+
+	// Optional. A pre-computed bcrypt, argon2id, PBKDF2 or SHA-crypt hash, used instead of Password
+	PasswordHash string `mapstructure:"password_hash" json:"password_hash"`
+
+	// Optional. One of "active", "disabled", "locked" or "password_expired". Defaults to "active"
+	Status string `mapstructure:"status" json:"status"`
+
+	// Optional. The user can only log in from and until these times, given as a date or an RFC 3339 timestamp
+	ValidFrom  string `mapstructure:"valid_from" json:"valid_from"`
+	ValidUntil string `mapstructure:"valid_until" json:"valid_until"`
+
+	// Optional. If set, the user has to choose a new password after logging in
+	MustChangePassword bool `mapstructure:"must_change_password" json:"must_change_password"`
+
+	// Optional. When the password was last changed, given as a date or an RFC 3339 timestamp.
+	// Used with password_policy.max_age to simulate old passwords
+	PasswordChangedAt string `mapstructure:"password_changed_at" json:"password_changed_at"`
+
+	// Optional. A base32 TOTP secret. If set, the user has to enter a code from their authenticator after their password
+	TotpSecret string `mapstructure:"totp_secret" json:"totp_secret"`
+
+	// Optional. The subject DN of the user's client certificate, for logging in with it when tls.client_mapping is "subject"
+	CertificateSubject string `mapstructure:"certificate_subject" json:"certificate_subject"`
+
+	// Optional. Standard profile fields, which are released under their eduPerson and inetOrgPerson attribute names.
+	// ScopedAffiliation is an eduPersonScopedAffiliation such as "member@example.com"
+	CommonName        string `mapstructure:"common_name" json:"common_name"`
+	DisplayName       string `mapstructure:"display_name" json:"display_name"`
+	ScopedAffiliation string `mapstructure:"scoped_affiliation" json:"scoped_affiliation"`
+	Phone             string `mapstructure:"phone" json:"phone"`
+	Title             string `mapstructure:"title" json:"title"`
+	Department        string `mapstructure:"department" json:"department"`
+	Organization      string `mapstructure:"organization" json:"organization"`
+	EmployeeNumber    string `mapstructure:"employee_number" json:"employee_number"`
+	Manager           string `mapstructure:"manager" json:"manager"`
+	Locale            string `mapstructure:"locale" json:"locale"`
+	Timezone          string `mapstructure:"timezone" json:"timezone"`
+
+	// Optional. Changes what individual services are told about the user, while they keep a single session
+	Overrides []ServiceOverride `mapstructure:"overrides" json:"overrides"`
+
+	// credentialsOnly marks entries that only carry a password, such as those from htpasswd files.
+	// They are applied to the user with the same username rather than replacing it
+	credentialsOnly bool
+}
+
+// ServiceOverride replaces a user's email address, NameID or attributes in what is asserted to one service.
+// Services are listed rather than used as keys, as entity IDs are usually URLs, whose dots would split the keys.
+type ServiceOverride struct {
+	// Required. The entity ID of the service, or the client ID of an OpenID Connect client
+	EntityId string `mapstructure:"entity_id" json:"entity_id"`
+
+	// Optional. Replaces the email address, and the NameID if it is the email address
+	Email string `mapstructure:"email" json:"email,omitempty"`
+
+	// Optional. Replaces the NameID
+	NameId string `mapstructure:"name_id" json:"name_id,omitempty"`
+
+	// Optional. Replaces the values of these attributes, by name or friendly name, adding those the user does not have.
+	// Attributes without values are removed
+	Attributes map[string][]string `mapstructure:"attributes" json:"attributes,omitempty"`
+}
+
+type UserFile struct {
+	Path string `mapstructure:"path"`
+
+	// Optional. One of "csv", "json", "ldif" or "htpasswd". Defaults to the file's extension
+	Format string `mapstructure:"format"`
+
+	// Optional. Maps CSV column headers to user fields: username, email, password, first_name, last_name, groups,
+	// status, valid_from, valid_until, totp_secret, certificate_subject or one of the profile fields, such as
+	// display_name or department. Unmapped headers are matched against common names for each field, and any others
+	// are ignored
+	Columns map[string]string `mapstructure:"columns"`
 }
 
 type LoginPageOptions struct {
 	Title       string `mapstructure:"title"`
 	Description string `mapstructure:"description"`
 	DumpUsers   bool   `mapstructure:"dump_users"`
+
+	// Optional. What users log in with, either "username", "email" or "any". Defaults to "username"
+	Identifier string `mapstructure:"identifier"`
+
+	// Optional. If set, usernames and email addresses are matched regardless of case
+	CaseInsensitive bool `mapstructure:"case_insensitive"`
+
+	// Optional. If set, SAML logins to an account that cannot be used, e.g. because it is disabled, are answered with
+	// an AuthnFailed or RequestDenied response instead of showing the login page again
+	SamlErrorStatus bool `mapstructure:"saml_error_status"`
+}
+
+type PasswordPolicyOptions struct {
+	// Optional. The minimum number of characters. Defaults to 8
+	MinLength int `mapstructure:"min_length"`
+
+	// Optional. The character classes that must appear in the password
+	RequireUppercase bool `mapstructure:"require_uppercase"`
+	RequireLowercase bool `mapstructure:"require_lowercase"`
+	RequireDigit     bool `mapstructure:"require_digit"`
+	RequireSymbol    bool `mapstructure:"require_symbol"`
+
+	// Optional. The number of previous passwords that cannot be reused, besides the current one. Defaults to 0
+	History int `mapstructure:"history"`
+
+	// Optional. The number of days after which passwords expire. Defaults to 0, which never expires them
+	MaxAge int `mapstructure:"max_age"`
+}
+
+type TotpOptions struct {
+	// Optional. The issuer shown in authenticator apps. Defaults to the host name
+	Issuer string `mapstructure:"issuer"`
+
+	// Optional. The number of 30 second periods that codes may be early or late by. Defaults to 1
+	Skew int `mapstructure:"skew"`
+
+	// Optional. If set, users without a TOTP secret have to enroll one by scanning a QR code after their password
+	Enroll bool `mapstructure:"enroll"`
+}
+
+type PasskeyOptions struct {
+	// Optional. The relying party ID that passkeys are registered for. Defaults to the host name
+	RpId string `mapstructure:"rp_id"`
+
+	// Optional. The relying party name shown by authenticators. Defaults to the host name
+	RpName string `mapstructure:"rp_name"`
+
+	// Optional. The origins that passkeys may be used from. Defaults to the origin of the host
+	Origins []string `mapstructure:"origins"`
+
+	// Optional. Either "required", "preferred" or "discouraged". Defaults to "preferred"
+	UserVerification string `mapstructure:"user_verification"`
+
+	// Optional. If set, users with a passkey have to use it after their password, unless they log in with it directly
+	SecondFactor bool `mapstructure:"second_factor"`
+}
+
+type TlsOptions struct {
+	// The PEM files of the certificate and private key that the server listens with
+	CertificatePath string `mapstructure:"certificate"`
+	KeyPath         string `mapstructure:"key"`
+
+	// Optional. A PEM bundle of the CAs that issue client certificates. If set, browsers are asked for a certificate,
+	// which users can log in with instead of their password
+	ClientCaPath string `mapstructure:"client_ca"`
+
+	// Optional. How client certificates are matched to users: "email" by their SAN email addresses, "subject" by the
+	// users' certificate_subject, or "attribute" by the username in a subject attribute. Defaults to "email"
+	ClientMapping string `mapstructure:"client_mapping"`
+
+	// Optional. The subject attribute holding the username for the "attribute" mapping, such as "CN", "UID",
+	// "SERIALNUMBER" or an OID. Defaults to "CN"
+	ClientAttribute string `mapstructure:"client_attribute"`
+}
+
+type EmailLoginOptions struct {
+	// Optional. The sender of login emails. Defaults to noreply at the host name
+	From string `mapstructure:"from"`
+
+	// Optional. The number of digits in login codes. Defaults to 6
+	CodeLength int `mapstructure:"code_length"`
+
+	// Optional. The number of minutes that codes and links can be used for. Defaults to 10
+	Timeout int `mapstructure:"timeout"`
+
+	// Optional. If set, login emails are also relayed to this SMTP server
+	Smtp *SmtpOptions `mapstructure:"smtp"`
+}
+
+type SmtpOptions struct {
+	// The host and port of the SMTP server, such as "localhost:1025"
+	Address string `mapstructure:"address"`
+
+	// Optional. If set, the server is authenticated with using PLAIN, which needs TLS unless the server is local
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+type LockoutOptions struct {
+	// Optional. The number of failed logins after which an account is locked. Defaults to 0, which never locks accounts
+	MaxAttempts int `mapstructure:"max_attempts"`
+
+	// Optional. The number of minutes in which failed logins are counted. Defaults to 15
+	Window int `mapstructure:"window"`
+
+	// Optional. The number of minutes an account stays locked for. Defaults to 15
+	Cooldown int `mapstructure:"cooldown"`
+}
+
+type ScimOptions struct {
+	// Optional. If set, SCIM requests must present it as a bearer token
+	Token string `mapstructure:"token"`
+}
+
+type StorageOptions struct {
+	// Optional. Either "memory", "bolt" or "redis". Defaults to "memory"
+	Type string `mapstructure:"type"`
+
+	// The path of the bolt database file, which is created if it does not exist
+	Path string `mapstructure:"path"`
+
+	// The URL of the Redis server, e.g. "redis://localhost:6379/0"
+	Url string `mapstructure:"url"`
+
+	// Optional. Prepended to every Redis key. Defaults to "test-saml-idp"
+	KeyPrefix string `mapstructure:"key_prefix"`
+}
+
+type LdapOptions struct {
+	Url    string `mapstructure:"url"`
+	BaseDn string `mapstructure:"base_dn"`
+
+	// Optional. The account used to search for users. If empty, searches are made anonymously
+	BindDn       string `mapstructure:"bind_dn"`
+	BindPassword string `mapstructure:"bind_password"`
+
+	// Optional. Upgrades ldap:// connections using StartTLS
+	StartTls bool `mapstructure:"start_tls"`
+
+	// Optional. Disables verification of the directory's certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+
+	// Optional. The filter used to look up users, where {username} is replaced with the submitted username.
+	// Defaults to "(uid={username})"
+	UserFilter string `mapstructure:"user_filter"`
+
+	// Optional. Either "fallback", where directory users are tried after the configured users, or "replace",
+	// where only directory users can sign in. Defaults to "fallback"
+	Mode string `mapstructure:"mode"`
+
+	// Optional. The directory attributes mapped onto user fields
+	Attributes LdapAttributes `mapstructure:"attributes"`
+
+	// Optional. Maps SAML attribute names to directory attributes, which are added to assertions as they are
+	CustomAttributes map[string]string `mapstructure:"custom_attributes"`
+
+	// Optional. If set, groups are found by searching beneath this DN instead of reading the memberOf attribute
+	GroupBaseDn string `mapstructure:"group_base_dn"`
+
+	// Optional. The filter used to find a user's groups, where {dn} and {username} are replaced with the user's
+	// DN and username. Defaults to "(member={dn})"
+	GroupFilter string `mapstructure:"group_filter"`
+
+	// Optional. The attribute holding a group's name. Defaults to "cn"
+	GroupNameAttribute string `mapstructure:"group_name_attribute"`
+}
+
+type AuthWebhookOptions struct {
+	// The endpoint that credentials are posted to as JSON
+	Url string `mapstructure:"url"`
+
+	// Optional. Either "fallback", where the webhook is asked after the configured users and LDAP directory, or
+	// "replace", where only the webhook decides who can sign in. Defaults to "fallback"
+	Mode string `mapstructure:"mode"`
+
+	// Optional. The number of seconds to wait for the webhook. Defaults to 5
+	Timeout int `mapstructure:"timeout"`
+
+	// Optional. The number of seconds that the webhook's decisions are remembered for. Defaults to 0, which is not at all
+	CacheTtl int `mapstructure:"cache_ttl"`
+
+	// Optional. Headers sent with each request, such as an Authorization header the webhook expects
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+type AttributeProviderOptions struct {
+	// The endpoint that attribute requests are posted to as JSON. Either this or Command is required
+	Url string `mapstructure:"url"`
+
+	// The command run for attribute requests, with its arguments. It reads the request from stdin and writes its
+	// answer to stdout. Either this or Url is required
+	Command []string `mapstructure:"command"`
+
+	// Optional. The number of seconds to wait for the provider. Defaults to 5
+	Timeout int `mapstructure:"timeout"`
+
+	// Optional. Headers sent with each request to Url
+	Headers map[string]string `mapstructure:"headers"`
+
+	// Optional. Makes assertions without the provider's attributes when it fails, instead of failing the login.
+	// Defaults to false
+	IgnoreErrors bool `mapstructure:"ignore_errors"`
+}
+
+// LdapAttributes names the directory attributes read for each user field. Empty fields use the defaults
+type LdapAttributes struct {
+	Username   string `mapstructure:"username"`
+	Email      string `mapstructure:"email"`
+	FirstName  string `mapstructure:"first_name"`
+	LastName   string `mapstructure:"last_name"`
+	CommonName string `mapstructure:"common_name"`
+	Groups     string `mapstructure:"groups"`
 }
@@ -0,0 +1,320 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	emailLoginRoute = "/email-login"
+	mailboxRoute    = "/mailbox"
+
+	emailField      = "email_login"
+	emailTokenField = "email_token"
+	emailCodeField  = "email_code"
+
+	defaultEmailCodeLength = 6
+	defaultEmailTimeout    = 10 // minutes
+
+	// emailMaxAttempts is the number of wrong codes after which a login has to be started again
+	emailMaxAttempts = 5
+)
+
+// emailLogin is a login waiting for the code that was emailed to the user. Url and Fields are those of the login
+// form, which the link in the email posts the code back to. Username is empty if no user has the email address.
+type emailLogin struct {
+	Username   string            `json:"username,omitempty"`
+	Email      string            `json:"email"`
+	Code       string            `json:"code"`
+	Attempts   int               `json:"attempts,omitempty"`
+	ExpireTime time.Time         `json:"expire_time"`
+	Url        string            `json:"url"`
+	Fields     map[string]string `json:"fields"`
+}
+
+// Mail is a message sent by the IdP, which is kept in its mailbox whether or not it is relayed
+type Mail struct {
+	Id      string    `json:"id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Code    string    `json:"code,omitempty"`
+	Link    string    `json:"link,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type EmailPageData struct {
+	Title      string
+	Errors     []string
+	Email      string
+	Url        string
+	Fields     map[string]string
+	MailboxUrl string
+}
+
+func (s *Server) registerEmailRoutes(group *gin.RouterGroup) {
+	group.GET(emailLoginRoute+"/:token", s.serveEmailLink)
+	group.GET(mailboxRoute, s.serveMailbox)
+	group.DELETE(mailboxRoute, s.clearMailbox)
+}
+
+// startEmailLogin emails a code to the user with the submitted address. The code page is shown whether or not there
+// is such a user, as a real IdP would not say which addresses it knows.
+func (s *Server) startEmailLogin(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	if s.config.EmailLogin == nil {
+		s.serveLoginPage(w, r, form, "")
+		return nil
+	}
+
+	address := strings.TrimSpace(r.PostForm.Get(emailField))
+
+	code, err := emailCode(s.config.EmailLogin.CodeLength)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	token := uuid.NewString()
+	login := &emailLogin{
+		Email:      address,
+		Code:       code,
+		ExpireTime: saml.TimeNow().Add(time.Duration(s.config.EmailLogin.Timeout) * time.Minute),
+		Url:        form.Url,
+		Fields:     form.Fields,
+	}
+
+	if user, err := s.findUserByEmail(address); err == nil {
+		login.Username = user.Name
+	}
+
+	if err = s.Store.AddEmailLogin(token, login); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	if login.Username != "" {
+		if err = s.sendLoginEmail(token, login); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil
+		}
+	}
+
+	s.serveEmailPage(w, form, token, address, nil)
+	return nil
+}
+
+// resolveEmailLogin logs in the user once they have entered the code they were emailed, or followed its link
+func (s *Server) resolveEmailLogin(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	token := r.PostForm.Get(emailTokenField)
+
+	login, err := s.Store.GetEmailLogin(token)
+	if err != nil || saml.TimeNow().After(login.ExpireTime) {
+		s.serveLoginPage(w, r, form, "Your code was not entered in time, please try again")
+		return nil
+	}
+
+	code := strings.TrimSpace(r.PostForm.Get(emailCodeField))
+	if login.Username == "" || subtle.ConstantTimeCompare([]byte(code), []byte(login.Code)) != 1 {
+		login.Attempts++
+		if login.Attempts >= emailMaxAttempts {
+			_ = s.Store.DeleteEmailLogin(token)
+			s.serveLoginPage(w, r, form, "Too many invalid codes were entered, please try again")
+			return nil
+		}
+
+		if err = s.Store.AddEmailLogin(token, login); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil
+		}
+
+		s.serveEmailPage(w, form, token, login.Email, []string{"The code is invalid"})
+		return nil
+	}
+
+	_ = s.Store.DeleteEmailLogin(token)
+
+	user, err := s.Store.GetUser(login.Username)
+	if err != nil {
+		s.serveLoginPage(w, r, form, "")
+		return nil
+	}
+
+	return s.startPasswordlessSession(w, r, form, user, amrOtp)
+}
+
+// sendLoginEmail sends the user their code, along with a link that logs them in without typing it
+func (s *Server) sendLoginEmail(token string, login *emailLogin) error {
+	link := s.endpointUrl(emailLoginRoute+"/"+token) + "?" + url.Values{"code": {login.Code}}.Encode()
+
+	return s.sendMail(&Mail{
+		To:      login.Email,
+		Subject: "Your login code",
+		Body: fmt.Sprintf("Your login code is %s.\n\nOr log in with this link:\n%s\n\n"+
+			"The code expires in %d minutes. If you did not try to log in, you can ignore this email.\n",
+			login.Code, link, s.config.EmailLogin.Timeout),
+		Code: login.Code,
+		Link: link,
+	})
+}
+
+// sendMail keeps the message in the mailbox and, if an SMTP server is configured, relays it. A failed relay is only
+// logged, as the message can still be read from the mailbox.
+func (s *Server) sendMail(mail *Mail) error {
+	mail.Id = uuid.NewString()
+	mail.From = s.config.EmailLogin.From
+	mail.Time = saml.TimeNow()
+
+	if err := s.Store.AddMail(mail); err != nil {
+		return err
+	}
+
+	log.Info().Str("to", mail.To).Str("subject", mail.Subject).Msg("sent email")
+
+	if options := s.config.EmailLogin.Smtp; options != nil {
+		if err := relayMail(*options, mail); err != nil {
+			log.Error().Err(err).Str("to", mail.To).Str("smtp", options.Address).Msg("error relaying email")
+		}
+	}
+
+	return nil
+}
+
+func relayMail(options SmtpOptions, mail *Mail) error {
+	var auth smtp.Auth
+	if options.Username != "" {
+		host, _, err := net.SplitHostPort(options.Address)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", options.Username, options.Password, host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + mail.From,
+		"To: " + mail.To,
+		"Subject: " + mail.Subject,
+		"Date: " + mail.Time.Format(time.RFC1123Z),
+		"Message-ID: <" + mail.Id + "@" + domain(mail.From) + ">",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.ReplaceAll(mail.Body, "\n", "\r\n"),
+	}, "\r\n")
+
+	return smtp.SendMail(options.Address, auth, mail.From, []string{mail.To}, []byte(message))
+}
+
+func domain(address string) string {
+	_, domain, _ := strings.Cut(address, "@")
+	return domain
+}
+
+// emailCode returns a random code of the given number of digits
+func emailCode(length int) (string, error) {
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+func (s *Server) serveEmailPage(w http.ResponseWriter, form loginForm, token, address string, errs []string) {
+	fields := maps.Clone(form.Fields)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields[emailTokenField] = token
+
+	data := EmailPageData{
+		Title:      "Check Your Email",
+		Errors:     errs,
+		Email:      address,
+		Url:        form.Url,
+		Fields:     fields,
+		MailboxUrl: s.endpointUrl(mailboxRoute),
+	}
+
+	render := s.router.HTMLRender.Instance("email.html", data)
+
+	err := render.Render(w)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// serveEmailLink continues the login the link was emailed for, posting its code to the login form as the user would
+func (s *Server) serveEmailLink(c *gin.Context) {
+	if s.config.EmailLogin == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	login, err := s.Store.GetEmailLogin(c.Param("token"))
+	if err != nil || saml.TimeNow().After(login.ExpireTime) {
+		c.String(http.StatusGone, "This link has expired, please log in again")
+		return
+	}
+
+	fields := maps.Clone(login.Fields)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields[emailTokenField] = c.Param("token")
+	fields[emailCodeField] = c.Query("code")
+
+	c.HTML(http.StatusOK, "email-link.html", gin.H{
+		"Url":    login.Url,
+		"Fields": fields,
+	})
+}
+
+// serveMailbox lists the messages the IdP has sent, newest first, optionally only those to the address in "to"
+func (s *Server) serveMailbox(c *gin.Context) {
+	mailbox, err := s.Store.GetMailbox()
+	if err != nil {
+		mailbox = []*Mail{}
+	}
+
+	if to := c.Query("to"); to != "" {
+		mailbox = slices.DeleteFunc(mailbox, func(mail *Mail) bool { return !strings.EqualFold(mail.To, to) })
+	}
+
+	slices.SortFunc(mailbox, func(a, b *Mail) int { return b.Time.Compare(a.Time) })
+
+	switch c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		c.JSON(http.StatusOK, mailbox)
+	default:
+		c.HTML(http.StatusOK, "mailbox.html", gin.H{
+			"Title":   "Mailbox",
+			"Mailbox": mailbox,
+		})
+	}
+}
+
+func (s *Server) clearMailbox(c *gin.Context) {
+	if err := s.Store.ClearMailbox(); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
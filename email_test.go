@@ -0,0 +1,232 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// withEmailLogin enables logging in with an emailed code, using the default options
+func withEmailLogin(config *Config) {
+	config.EmailLogin = &EmailLoginOptions{}
+}
+
+// emailToken returns the token carried by the page that asks for the emailed code
+func emailToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	match := regexp.MustCompile(`name="` + emailTokenField + `" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	return match[1]
+}
+
+func mailbox(t *testing.T, server *Server, to string) []*Mail {
+	req := httptest.NewRequest(http.MethodGet, mailboxRoute+"?"+url.Values{"to": {to}}.Encode(), nil)
+	req.Header.Set("Accept", "application/json")
+
+	w := serve(server, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var mailbox []*Mail
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &mailbox))
+
+	return mailbox
+}
+
+func TestEmailLogin_Code(t *testing.T) {
+	server := newTestServer(t, withEmailLogin)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Email me a code")
+
+	form := authorizeParams()
+	form.Set(emailField, "test@test.com")
+
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	mail := mailbox(t, server, "test@test.com")
+	require.Len(t, mail, 1)
+	assert.Equal(t, "noreply@localhost", mail[0].From)
+	assert.Len(t, mail[0].Code, defaultEmailCodeLength)
+	assert.Contains(t, mail[0].Body, mail[0].Code)
+
+	form = authorizeParams()
+	form.Set(emailTokenField, emailToken(t, w))
+	form.Set(emailCodeField, mail[0].Code)
+
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, "test", idToken.Subject)
+	assert.Equal(t, []string{amrOtp}, idToken.AuthMethods)
+
+	// Codes can only be used once
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "please try again")
+}
+
+func TestEmailLogin_Link(t *testing.T) {
+	server := newTestServer(t, withEmailLogin)
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		emailField:    {"test@test.com"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	mail := mailbox(t, server, "test@test.com")
+	require.Len(t, mail, 1)
+
+	// The link's page posts the code back to the login form, along with the SAML request
+	w = serve(server, httptest.NewRequest(http.MethodGet, mail[0].Link, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	form := url.Values{}
+	for _, match := range regexp.MustCompile(`name="([^"]+)" value="([^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1) {
+		form.Set(match[1], html.UnescapeString(match[2]))
+	}
+	assert.Equal(t, mail[0].Code, form.Get(emailCodeField))
+	assert.NotEmpty(t, form.Get("SAMLRequest"))
+
+	w = serve(server, postForm(ssoRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	assert.Equal(t, "test@test.com", response.Assertion.Subject.NameID.Value)
+}
+
+func TestEmailLogin_InvalidCodes(t *testing.T) {
+	server := newTestServer(t, withEmailLogin)
+
+	// Unknown addresses get the same page, but no email
+	form := authorizeParams()
+	form.Set(emailField, "nobody@test.com")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "a code has been sent")
+	assert.Empty(t, mailbox(t, server, "nobody@test.com"))
+
+	form.Set(emailField, "test@test.com")
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	form = authorizeParams()
+	form.Set(emailTokenField, emailToken(t, w))
+	form.Set(emailCodeField, "not a code")
+
+	for range emailMaxAttempts - 1 {
+		w = serve(server, postForm(authorizeRoute, form))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "The code is invalid")
+	}
+
+	// Even the right code is refused once there have been too many wrong ones
+	w = serve(server, postForm(authorizeRoute, form))
+	assert.Contains(t, w.Body.String(), "Too many invalid codes")
+
+	form.Set(emailCodeField, mailbox(t, server, "test@test.com")[0].Code)
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "please try again")
+}
+
+func TestEmailLogin_ClearMailbox(t *testing.T) {
+	server := newTestServer(t, withEmailLogin)
+
+	form := authorizeParams()
+	form.Set(emailField, "test@test.com")
+	serve(server, postForm(authorizeRoute, form))
+	require.Len(t, mailbox(t, server, ""), 1)
+
+	w := serve(server, httptest.NewRequest(http.MethodDelete, mailboxRoute, nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, mailbox(t, server, ""))
+}
+
+// smtpServer accepts a single message, which is sent on the returned channel
+func smtpServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	messages := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		_ = text.PrintfLine("220 localhost")
+
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+
+			switch command, _, _ := strings.Cut(line, " "); strings.ToUpper(command) {
+			case "DATA":
+				_ = text.PrintfLine("354 go ahead")
+				data, _ := text.ReadDotBytes()
+				messages <- string(data)
+				_ = text.PrintfLine("250 OK")
+			case "QUIT":
+				_ = text.PrintfLine("221 bye")
+				return
+			default:
+				_ = text.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func TestEmailLogin_Smtp(t *testing.T) {
+	address, messages := smtpServer(t)
+
+	server := newTestServer(t, withEmailLogin, func(config *Config) {
+		config.EmailLogin.From = "idp@test.com"
+		config.EmailLogin.Smtp = &SmtpOptions{Address: address}
+	})
+
+	form := authorizeParams()
+	form.Set(emailField, "test@test.com")
+	serve(server, postForm(authorizeRoute, form))
+
+	message := <-messages
+	assert.Contains(t, message, "From: idp@test.com")
+	assert.Contains(t, message, "To: test@test.com")
+	assert.Contains(t, message, mailbox(t, server, "test@test.com")[0].Code)
+}
@@ -0,0 +1,275 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	groupFormatName = "name"
+	groupFormatDn   = "dn"
+	groupFormatId   = "id"
+)
+
+var groupFormats = []string{groupFormatName, groupFormatDn, groupFormatId}
+
+// groupNamespace is the namespace of the name-based UUIDs that identify groups without an id of their own
+var groupNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/derekmckinnon/test-saml-idp/groups"))
+
+// LoadGroups saves the configured groups, replacing any kept by persistent storage
+func (s *Server) LoadGroups(groups []Group) error {
+	loaded := map[string]bool{}
+
+	for _, group := range groups {
+		if group.Name == "" {
+			return errors.New("group without a name")
+		}
+
+		if loaded[group.Name] {
+			return fmt.Errorf("group %s is listed more than once: %w", group.Name, ErrAlreadyExists)
+		}
+		loaded[group.Name] = true
+
+		if group.Dn != "" {
+			if _, err := ldap.ParseDN(group.Dn); err != nil {
+				return fmt.Errorf("group %s: invalid dn: %w", group.Name, err)
+			}
+		}
+
+		if slices.Contains(group.Subgroups, group.Name) {
+			return fmt.Errorf("group %s cannot be its own subgroup", group.Name)
+		}
+
+		for i, rule := range group.Rules {
+			if err := rule.check(); err != nil {
+				return fmt.Errorf("group %s: rule %d: %w", group.Name, i+1, err)
+			}
+		}
+
+		if err := s.Store.AddGroup(&group); err != nil {
+			return err
+		}
+
+		log.Info().Str("group", group.Name).Msg("initialized group")
+	}
+
+	return nil
+}
+
+// resolveGroups flattens the memberships of a user, who has logged in with the attributes, into every group they
+// belong to. Besides their own groups, users are members of the groups that list them as members or whose rules they
+// match, and of every group that has one of these as a subgroup, however deeply nested. The attributes of all of
+// these groups are returned along with them.
+func (s *Server) resolveGroups(user *samlidp.User, profile *Profile, attributes []saml.Attribute) ([]string, []saml.Attribute, error) {
+	groups, err := s.Store.GetGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := map[string]*Group{}
+	parents := map[string][]string{}
+	pending := slices.Clone(user.Groups)
+	values := ruleValues(user, profile, attributes)
+
+	for _, group := range groups {
+		byName[group.Name] = group
+
+		for _, subgroup := range group.Subgroups {
+			parents[subgroup] = append(parents[subgroup], group.Name)
+		}
+
+		if slices.Contains(group.Members, user.Name) || slices.ContainsFunc(group.Rules, func(rule GroupRule) bool {
+			return rule.matches(values)
+		}) {
+			pending = append(pending, group.Name)
+		}
+	}
+
+	var resolved []string
+	seen := map[string]bool{}
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		resolved = append(resolved, name)
+		pending = append(pending, parents[name]...)
+	}
+
+	granted := map[string][]string{}
+	for _, name := range resolved {
+		group, ok := byName[name]
+		if !ok {
+			continue
+		}
+
+		for attribute, groupValues := range group.Attributes {
+			for _, value := range groupValues {
+				if !slices.Contains(granted[attribute], value) {
+					granted[attribute] = append(granted[attribute], value)
+				}
+			}
+		}
+	}
+
+	var groupAttributes []saml.Attribute
+	for _, name := range slices.Sorted(maps.Keys(granted)) {
+		groupAttributes = append(groupAttributes, stringAttribute(name, granted[name]...))
+	}
+
+	return resolved, groupAttributes, nil
+}
+
+// formatGroups converts group names into the format a service expects. Groups without a DN are placed beneath
+// group_base_dn, and those without an id are given one derived from their name, so that it does not change.
+func (s *Server) formatGroups(names []string, format string) ([]string, error) {
+	if format == groupFormatName || len(names) == 0 {
+		return names, nil
+	}
+
+	groups, err := s.Store.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*Group{}
+	for _, group := range groups {
+		byName[group.Name] = group
+	}
+
+	formatted := make([]string, len(names))
+	for i, name := range names {
+		group, ok := byName[name]
+		if !ok {
+			group = &Group{Name: name}
+		}
+
+		switch format {
+		case groupFormatDn:
+			formatted[i] = withDefault(group.Dn, "cn="+ldap.EscapeDN(name)+","+s.config.GroupBaseDn)
+		case groupFormatId:
+			formatted[i] = withDefault(group.Id, uuid.NewSHA1(groupNamespace, []byte(name)).String())
+		}
+	}
+
+	return formatted, nil
+}
+
+// defaultGroupBaseDn places groups in an organizational unit beneath the domain components of the host name
+func defaultGroupBaseDn(hostname string) string {
+	parts := []string{"ou=groups"}
+	for _, label := range strings.Split(hostname, ".") {
+		if label != "" {
+			parts = append(parts, "dc="+ldap.EscapeDN(label))
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// serviceGroupFormats returns the group formats that services override group_format with
+func serviceGroupFormats(services []Service) []string {
+	var formats []string
+	for _, service := range services {
+		if service.GroupFormat != "" {
+			formats = append(formats, service.GroupFormat)
+		}
+	}
+
+	return formats
+}
+
+// check ensures that the rule has a condition and that its pattern compiles
+func (r GroupRule) check() error {
+	if r.EmailDomain == "" && r.Attribute == "" && r.UsernamePattern == "" {
+		return errors.New("no conditions")
+	}
+
+	if r.Equals != "" && r.Attribute == "" {
+		return errors.New("equals needs an attribute")
+	}
+
+	if _, err := regexp.Compile(r.UsernamePattern); err != nil {
+		return fmt.Errorf("invalid username_pattern: %w", err)
+	}
+
+	return nil
+}
+
+// matches reports whether a user with the values, as returned by ruleValues, matches the rule
+func (r GroupRule) matches(values map[string][]string) bool {
+	if r.EmailDomain != "" {
+		_, domain, ok := strings.Cut(firstValue(values["email"]), "@")
+		if !ok || !strings.EqualFold(domain, strings.TrimPrefix(r.EmailDomain, "@")) {
+			return false
+		}
+	}
+
+	if r.Attribute != "" && !slices.Contains(values[r.Attribute], r.Equals) {
+		return false
+	}
+
+	if r.UsernamePattern != "" {
+		pattern, err := regexp.Compile(r.UsernamePattern)
+		if err != nil || !pattern.MatchString(firstValue(values["username"])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ruleValues collects what rules can match a user on: their fields, named as in the configuration, and the attributes
+// they were authenticated with, by both name and friendly name
+func ruleValues(user *samlidp.User, profile *Profile, attributes []saml.Attribute) map[string][]string {
+	values := map[string][]string{
+		"username":           {user.Name},
+		"email":              {user.Email},
+		"first_name":         {user.GivenName},
+		"last_name":          {user.Surname},
+		"common_name":        {user.CommonName},
+		"scoped_affiliation": {user.ScopedAffiliation},
+		"display_name":       {profile.DisplayName},
+		"phone":              {profile.Phone},
+		"title":              {profile.Title},
+		"department":         {profile.Department},
+		"organization":       {profile.Organization},
+		"employee_number":    {profile.EmployeeNumber},
+		"manager":            {profile.Manager},
+		"locale":             {profile.Locale},
+		"timezone":           {profile.Timezone},
+	}
+
+	for _, attribute := range attributes {
+		for _, value := range attribute.Values {
+			values[attribute.Name] = append(values[attribute.Name], value.Value)
+			if attribute.FriendlyName != "" && attribute.FriendlyName != attribute.Name {
+				values[attribute.FriendlyName] = append(values[attribute.FriendlyName], value.Value)
+			}
+		}
+	}
+
+	return values
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
@@ -0,0 +1,134 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// nestedGroups puts the test user's own group, foobar, at the bottom of a chain of AD-style nested groups
+func nestedGroups(config *Config) {
+	config.Groups = []Group{
+		{Name: "all-staff", Subgroups: []string{"engineering"}, Attributes: map[string][]string{"role": {"employee"}}},
+		{Name: "engineering", Description: "Everyone who builds things", Subgroups: []string{"backend"}},
+		{Name: "backend", Subgroups: []string{"foobar"}, Dn: "CN=Backend,OU=Teams,DC=corp,DC=example", Id: "0f0e7c62-backend"},
+		{Name: "admins", Members: []string{"test"}, Attributes: map[string][]string{"role": {"admin", "employee"}}},
+		{Name: "loop-a", Subgroups: []string{"loop-b"}},
+		{Name: "loop-b", Subgroups: []string{"loop-a", "admins"}},
+		{Name: "unrelated", Subgroups: []string{"elsewhere"}, Attributes: map[string][]string{"role": {"guest"}}},
+	}
+}
+
+func TestGroups_Nested(t *testing.T) {
+	server := newTestServer(t, nestedGroups)
+
+	attributes := assertionAttributes(t, server)
+	assert.ElementsMatch(t,
+		[]string{"foobar", "backend", "engineering", "all-staff", "admins", "loop-a", "loop-b"},
+		attributeValues(attributes["eduPersonAffiliation"]))
+	assert.ElementsMatch(t, []string{"employee", "admin"}, attributeValues(attributes["role"]))
+
+	// Members listed by a group are members as far as SCIM is concerned too
+	users, err := server.Store.GetUsers()
+	require.NoError(t, err)
+	members := server.toScimGroup("admins", users).Members
+	require.Len(t, members, 1)
+	assert.Equal(t, "test", members[0].Value)
+}
+
+func TestGroups_Formats(t *testing.T) {
+	server := newTestServer(t, nestedGroups, func(config *Config) {
+		config.GroupFormat = groupFormatDn
+		config.Services[1].GroupFormat = groupFormatId
+	})
+
+	attributes := assertionAttributes(t, server)
+	groups := attributeValues(attributes["eduPersonAffiliation"])
+	assert.Contains(t, groups, "cn=foobar,ou=groups,dc=localhost")
+	assert.Contains(t, groups, "CN=Backend,OU=Teams,DC=corp,DC=example")
+
+	rstr := signInWsFed(t, server, testEntityId+"-saml11")
+	var roles []string
+	for _, value := range rstr.FindElements(`.//Attribute[@AttributeName='role']/AttributeValue`) {
+		roles = append(roles, value.Text())
+	}
+	assert.Contains(t, roles, "0f0e7c62-backend")
+	assert.Contains(t, roles, uuid.NewSHA1(groupNamespace, []byte("foobar")).String())
+
+	// The session itself keeps the names, so that each service can be given its own format
+	sessions, err := server.Store.GetUserSessions("test")
+	require.NoError(t, err)
+	require.NotEmpty(t, sessions)
+	assert.Contains(t, sessions[0].Groups, "backend")
+
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Contains(t, idToken.Groups, "cn=foobar,ou=groups,dc=localhost")
+}
+
+func TestLoadGroups_Invalid(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadGroups([]Group{{Name: "dupe"}, {Name: "dupe"}})
+	assert.ErrorIs(t, err, ErrAlreadyExists)
+
+	err = server.LoadGroups([]Group{{Name: "bad", Dn: "not a DN"}})
+	assert.ErrorContains(t, err, "invalid dn")
+
+	err = server.LoadGroups([]Group{{Name: "self", Subgroups: []string{"self"}}})
+	assert.ErrorContains(t, err, "its own subgroup")
+
+	err = server.LoadGroups([]Group{{Name: "empty", Rules: []GroupRule{{}}}})
+	assert.ErrorContains(t, err, "no conditions")
+
+	err = server.LoadGroups([]Group{{Name: "pattern", Rules: []GroupRule{{UsernamePattern: "("}}}})
+	assert.ErrorContains(t, err, "invalid username_pattern")
+}
+
+func TestGroups_Rules(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.Users[0].Department = "Quality"
+		config.Groups = []Group{
+			{Name: "testers", Rules: []GroupRule{{EmailDomain: "TEST.com"}}},
+			{Name: "quality", Rules: []GroupRule{{Attribute: "department", Equals: "Sales"}, {Attribute: "department", Equals: "Quality"}}},
+			{Name: "short-names", Rules: []GroupRule{{UsernamePattern: "^t...$", Attribute: "first_name", Equals: "Nobody"}}},
+			{Name: "everyone", Subgroups: []string{"testers"}},
+		}
+	})
+
+	attributes := assertionAttributes(t, server)
+	assert.ElementsMatch(t,
+		[]string{"foobar", "testers", "quality", "everyone"},
+		attributeValues(attributes["eduPersonAffiliation"]))
+
+	// The account page shows the groups the session was resolved into
+	form := url.Values{"username": {"test"}, "password": {"test"}}
+	w := serve(server, postForm(accountRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<li>quality</li>")
+	assert.NotContains(t, w.Body.String(), "<li>short-names</li>")
+}
@@ -0,0 +1,734 @@
+package idp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	importRoute = "/users/import"
+
+	formatCsv      = "csv"
+	formatJson     = "json"
+	formatLdif     = "ldif"
+	formatHtpasswd = "htpasswd"
+)
+
+// ImportError points to the entry of a user file that could not be imported
+type ImportError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// csvColumns maps normalized column headers, as typically found in spreadsheets, to user fields
+var csvColumns = map[string]string{
+	"username":           "username",
+	"user":               "username",
+	"login":              "username",
+	"userid":             "username",
+	"uid":                "username",
+	"samaccountname":     "username",
+	"email":              "email",
+	"emailaddress":       "email",
+	"mail":               "email",
+	"password":           "password",
+	"pass":               "password",
+	"pwd":                "password",
+	"firstname":          "first_name",
+	"givenname":          "first_name",
+	"first":              "first_name",
+	"lastname":           "last_name",
+	"surname":            "last_name",
+	"familyname":         "last_name",
+	"sn":                 "last_name",
+	"last":               "last_name",
+	"groups":             "groups",
+	"group":              "groups",
+	"roles":              "groups",
+	"memberof":           "groups",
+	"status":             "status",
+	"validfrom":          "valid_from",
+	"validuntil":         "valid_until",
+	"totpsecret":         "totp_secret",
+	"certificatesubject": "certificate_subject",
+	"subjectdn":          "certificate_subject",
+	"commonname":         "common_name",
+	"cn":                 "common_name",
+	"fullname":           "common_name",
+	"displayname":        "display_name",
+	"scopedaffiliation":  "scoped_affiliation",
+	"phone":              "phone",
+	"phonenumber":        "phone",
+	"telephonenumber":    "phone",
+	"title":              "title",
+	"jobtitle":           "title",
+	"department":         "department",
+	"ou":                 "department",
+	"organization":       "organization",
+	"organisation":       "organization",
+	"company":            "organization",
+	"o":                  "organization",
+	"employeenumber":     "employee_number",
+	"employeeid":         "employee_number",
+	"manager":            "manager",
+	"locale":             "locale",
+	"language":           "locale",
+	"preferredlanguage":  "locale",
+	"timezone":           "timezone",
+	"zoneinfo":           "timezone",
+}
+
+// ReadUserFiles reads the users from each file, ready to be passed to Server.LoadUsers
+func ReadUserFiles(files []UserFile) ([]User, error) {
+	var users []User
+
+	for _, file := range files {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		read, err := readUsers(f, file.Path, file)
+		_ = f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, read...)
+	}
+
+	return users, nil
+}
+
+func readUsers(r io.Reader, name string, file UserFile) ([]User, error) {
+	format := strings.ToLower(file.Format)
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	}
+
+	var users []User
+	var err error
+
+	switch format {
+	case formatCsv:
+		users, err = readCsvUsers(r, file.Columns)
+	case formatJson:
+		users, err = readJsonUsers(r)
+	case formatLdif:
+		users, err = readLdifUsers(r)
+	case formatHtpasswd:
+		users, err = readHtpasswdUsers(r)
+	default:
+		return nil, fmt.Errorf("%s: unknown user file format %q", name, format)
+	}
+
+	var importErr *ImportError
+	if errors.As(err, &importErr) {
+		importErr.File = name
+	}
+
+	return users, err
+}
+
+func readCsvUsers(r io.Reader, columns map[string]string) ([]User, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, csvImportError(err)
+	}
+
+	fields := make([]string, len(header))
+	for i, column := range header {
+		// Spreadsheet applications like to start their exports with a byte order mark
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+
+		for mapped, field := range columns {
+			if strings.EqualFold(mapped, column) {
+				fields[i] = field
+			}
+		}
+
+		if fields[i] == "" {
+			fields[i] = csvColumns[strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(column))]
+		}
+	}
+
+	if !slices.Contains(fields, "username") {
+		return nil, &ImportError{Line: 1, Err: errors.New("no username column")}
+	}
+
+	var users []User
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, csvImportError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		user := User{}
+		for i, value := range record {
+			if i >= len(fields) {
+				break
+			}
+
+			if err = setUserField(&user, fields[i], strings.TrimSpace(value)); err != nil {
+				return nil, &ImportError{Line: line, Err: err}
+			}
+		}
+
+		if user.Username == "" {
+			return nil, &ImportError{Line: line, Err: errors.New("missing username")}
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func csvImportError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &ImportError{Line: parseErr.Line, Err: parseErr.Err}
+	}
+
+	return &ImportError{Line: 1, Err: err}
+}
+
+func setUserField(user *User, field, value string) error {
+	switch field {
+	case "":
+	case "username":
+		user.Username = value
+	case "email":
+		user.Email = value
+	case "password":
+		user.Password = value
+	case "first_name":
+		user.FirstName = value
+	case "last_name":
+		user.LastName = value
+	case "status":
+		user.Status = value
+	case "valid_from":
+		user.ValidFrom = value
+	case "valid_until":
+		user.ValidUntil = value
+	case "totp_secret":
+		user.TotpSecret = value
+	case "certificate_subject":
+		user.CertificateSubject = value
+	case "common_name":
+		user.CommonName = value
+	case "display_name":
+		user.DisplayName = value
+	case "scoped_affiliation":
+		user.ScopedAffiliation = value
+	case "phone":
+		user.Phone = value
+	case "title":
+		user.Title = value
+	case "department":
+		user.Department = value
+	case "organization":
+		user.Organization = value
+	case "employee_number":
+		user.EmployeeNumber = value
+	case "manager":
+		user.Manager = value
+	case "locale":
+		user.Locale = value
+	case "timezone":
+		user.Timezone = value
+	case "groups":
+		for _, group := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' || r == '|' }) {
+			if group = strings.TrimSpace(group); group != "" {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown user field %q", field)
+	}
+
+	return nil
+}
+
+func readJsonUsers(r io.Reader) ([]User, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n")) + 1
+	}
+
+	// Type errors are relative to the value being decoded, while syntax errors are relative to the whole file
+	jsonError := func(err error, start int64) error {
+		offset := start
+
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			offset = syntaxErr.Offset
+		}
+
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			offset = start + typeErr.Offset
+		}
+
+		return &ImportError{Line: lineAt(offset), Err: err}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, &ImportError{Line: 1, Err: errors.New("expected an array of users")}
+	}
+
+	var users []User
+
+	for decoder.More() {
+		// The decoder's offset is just before the object, which may be preceded by a comma and whitespace
+		start := decoder.InputOffset()
+		start += int64(len(data[start:]) - len(bytes.TrimLeft(data[start:], ", \t\r\n")))
+
+		var user User
+		if err = decoder.Decode(&user); err != nil {
+			return nil, jsonError(err, start)
+		}
+
+		if user.Username == "" {
+			return nil, &ImportError{Line: lineAt(start), Err: errors.New("missing username")}
+		}
+
+		users = append(users, user)
+	}
+
+	if _, err = decoder.Token(); err != nil {
+		return nil, jsonError(err, decoder.InputOffset())
+	}
+
+	return users, nil
+}
+
+type ldifRecord struct {
+	line       int
+	dn         string
+	attributes map[string][]string
+}
+
+func (r *ldifRecord) first(names ...string) string {
+	for _, name := range names {
+		if values := r.attributes[strings.ToLower(name)]; len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+func (r *ldifRecord) hasObjectClass(classes ...string) bool {
+	for _, class := range r.attributes["objectclass"] {
+		for _, candidate := range classes {
+			if strings.EqualFold(class, candidate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// readLdifUsers reads person entries from an LDIF export. Membership is taken from memberOf attributes and from
+// any group entries in the same file.
+func readLdifUsers(r io.Reader) ([]User, error) {
+	records, err := parseLdif(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	userDns := map[string]int{}
+	usernames := map[string]int{}
+
+	for _, record := range records {
+		if record.hasObjectClass("groupOfNames", "groupOfUniqueNames", "posixGroup", "group") {
+			continue
+		}
+		if record.first("uid") == "" && !record.hasObjectClass("person", "organizationalPerson", "inetOrgPerson", "posixAccount", "user") {
+			continue
+		}
+
+		user := User{
+			Username:          record.first("uid", "sAMAccountName", "cn"),
+			Email:             record.first("mail"),
+			FirstName:         record.first("givenName"),
+			LastName:          record.first("sn"),
+			CommonName:        record.first("cn"),
+			DisplayName:       record.first("displayName"),
+			ScopedAffiliation: record.first("eduPersonScopedAffiliation"),
+			Phone:             record.first("telephoneNumber"),
+			Title:             record.first("title"),
+			Department:        record.first("department", "ou"),
+			Organization:      record.first("company", "o"),
+			EmployeeNumber:    record.first("employeeNumber", "employeeID"),
+			Manager:           record.first("manager"),
+			Locale:            record.first("preferredLanguage"),
+		}
+
+		if user.Username == "" {
+			return nil, &ImportError{Line: record.line, Err: errors.New("missing uid")}
+		}
+
+		if password := record.first("userPassword"); password != "" {
+			scheme, hash, hashed := strings.Cut(strings.TrimPrefix(password, "{"), "}")
+			switch {
+			case !strings.HasPrefix(password, "{") || !hashed:
+				user.Password = password
+			case slices.Contains([]string{"CRYPT", "BCRYPT", "ARGON2"}, strings.ToUpper(scheme)):
+				user.PasswordHash = hash
+			case strings.HasPrefix(strings.ToUpper(scheme), "PBKDF2"):
+				// OpenLDAP's PBKDF2 hashes are passlib's without the leading identifier
+				user.PasswordHash = "$" + strings.ToLower(scheme) + "$" + hash
+			default:
+				return nil, &ImportError{Line: record.line, Err: fmt.Errorf("unsupported password scheme {%s}", scheme)}
+			}
+
+			if user.PasswordHash != "" {
+				if err = checkPasswordHash(user.PasswordHash); err != nil {
+					return nil, &ImportError{Line: record.line, Err: err}
+				}
+			}
+		}
+
+		for _, group := range record.attributes["memberof"] {
+			user.Groups = append(user.Groups, groupNameFromDn(group))
+		}
+
+		userDns[strings.ToLower(record.dn)] = len(users)
+		usernames[user.Username] = len(users)
+		users = append(users, user)
+	}
+
+	for _, record := range records {
+		if !record.hasObjectClass("groupOfNames", "groupOfUniqueNames", "posixGroup", "group") {
+			continue
+		}
+
+		name := record.first("cn")
+		if name == "" {
+			name = groupNameFromDn(record.dn)
+		}
+
+		var members []int
+		for _, member := range append(record.attributes["member"], record.attributes["uniquemember"]...) {
+			if i, ok := userDns[strings.ToLower(member)]; ok {
+				members = append(members, i)
+			}
+		}
+		for _, member := range record.attributes["memberuid"] {
+			if i, ok := usernames[member]; ok {
+				members = append(members, i)
+			}
+		}
+
+		for _, i := range members {
+			if !slices.Contains(users[i].Groups, name) {
+				users[i].Groups = append(users[i].Groups, name)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+func parseLdif(r io.Reader) ([]*ldifRecord, error) {
+	scanner := bufio.NewScanner(r)
+
+	var records []*ldifRecord
+	var record *ldifRecord
+
+	// Attribute values may be folded across several lines, so each one is only parsed once it is complete
+	var pending string
+	var pendingLine int
+
+	flush := func() error {
+		if pending == "" {
+			return nil
+		}
+
+		attribute, value, err := parseLdifLine(pending)
+		if err != nil {
+			return &ImportError{Line: pendingLine, Err: err}
+		}
+		pending = ""
+
+		switch {
+		case attribute == "version" && record == nil:
+		case attribute == "changetype" && !strings.EqualFold(value, "add"):
+			return &ImportError{Line: pendingLine, Err: fmt.Errorf("unsupported changetype %q", value)}
+		case attribute == "dn":
+			record = &ldifRecord{line: pendingLine, dn: value, attributes: map[string][]string{}}
+			records = append(records, record)
+		case record == nil:
+			return &ImportError{Line: pendingLine, Err: errors.New("expected dn")}
+		default:
+			record.attributes[attribute] = append(record.attributes[attribute], value)
+		}
+
+		return nil
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case strings.HasPrefix(text, " ") && pending != "":
+			pending += text[1:]
+			continue
+		case strings.HasPrefix(text, "#"):
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return nil, err
+		}
+
+		if strings.TrimSpace(text) == "" {
+			record = nil
+			continue
+		}
+
+		pending, pendingLine = text, line
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func parseLdifLine(text string) (string, string, error) {
+	attribute, value, ok := strings.Cut(text, ":")
+	if !ok {
+		return "", "", fmt.Errorf("expected \"attribute: value\", got %q", text)
+	}
+
+	// Attribute options such as language tags are ignored
+	attribute, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(attribute)), ";")
+
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value for %s: %w", attribute, err)
+		}
+		return attribute, string(decoded), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", fmt.Errorf("URL values are not supported for %s", attribute)
+	}
+
+	return attribute, strings.TrimSpace(value), nil
+}
+
+// readHtpasswdUsers reads credentials from an htpasswd file. Hashes made with the SHA1 and crypt options of
+// htpasswd are not supported
+func readHtpasswdUsers(r io.Reader) ([]User, error) {
+	scanner := bufio.NewScanner(r)
+
+	var users []User
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, &ImportError{Line: line, Err: errors.New(`expected "username:hash"`)}
+		}
+
+		if err := checkPasswordHash(hash); err != nil {
+			return nil, &ImportError{Line: line, Err: err}
+		}
+
+		users = append(users, User{Username: username, PasswordHash: hash, credentialsOnly: true})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// mergeCredentials applies credential-only entries to the user with the same username, if there is one
+func mergeCredentials(users []User) []User {
+	var merged []User
+	index := map[string]int{}
+
+	for _, user := range users {
+		if !user.credentialsOnly {
+			index[user.Username] = len(merged)
+			merged = append(merged, user)
+		}
+	}
+
+	for _, user := range users {
+		if !user.credentialsOnly {
+			continue
+		}
+
+		if i, ok := index[user.Username]; ok {
+			merged[i].Password = ""
+			merged[i].PasswordHash = user.PasswordHash
+			continue
+		}
+
+		merged = append(merged, user)
+	}
+
+	return merged
+}
+
+func (s *Server) importUsers(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `a user file must be uploaded as "file"`})
+		return
+	}
+
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	users, err := readUsers(f, header.Filename, UserFile{Format: c.PostForm("format")})
+	if err != nil {
+		response := gin.H{"error": err.Error()}
+
+		var importErr *ImportError
+		if errors.As(err, &importErr) {
+			response["line"] = importErr.Line
+		}
+
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Users are only replaced when asked to, and nothing is imported if any of them would be
+	conflicts, err := s.importConflicts(users, c.PostForm("replace") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(conflicts) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "users already exist", "conflicts": conflicts})
+		return
+	}
+
+	if err = s.LoadUsers(users); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrAlreadyExists) {
+			status = http.StatusConflict
+		}
+
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": len(users)})
+}
+
+// importConflict is a user that cannot be imported without replacing another
+type importConflict struct {
+	Username string `json:"username"`
+	Error    string `json:"error"`
+}
+
+// importConflicts returns the users that already exist, unless they are to be replaced, and those whose email address
+// belongs to another user
+func (s *Server) importConflicts(users []User, replace bool) ([]importConflict, error) {
+	var conflicts []importConflict
+
+	for _, user := range mergeCredentials(users) {
+		_, err := s.Store.GetUser(user.Username)
+		if err == nil && !replace {
+			conflicts = append(conflicts, importConflict{Username: user.Username, Error: "user already exists"})
+			continue
+		}
+		if err != nil && !errors.Is(err, samlidp.ErrNotFound) {
+			return nil, err
+		}
+
+		if user.Email == "" {
+			continue
+		}
+
+		owners, err := s.Store.GetUsersByEmail(user.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, owner := range owners {
+			if owner.Name != user.Username {
+				conflicts = append(conflicts, importConflict{
+					Username: user.Username,
+					Error:    fmt.Sprintf("email %s belongs to user %s", user.Email, owner.Name),
+				})
+				break
+			}
+		}
+	}
+
+	return conflicts, nil
+}
@@ -0,0 +1,223 @@
+package idp
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImport_Csv(t *testing.T) {
+	data := "\ufeffLogin,E-mail Address,First Name,Last Name,Roles,Notes\n" +
+		"alice,alice@example.com,Alice,Smith,admins; developers,likes tea\n" +
+		"\n" +
+		"bob,bob@example.com,Bob,Jones,,\n"
+
+	users, err := readUsers(strings.NewReader(data), "users.csv", UserFile{Columns: map[string]string{"E-mail Address": "email"}})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, User{Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "Smith", Groups: []string{"admins", "developers"}}, users[0])
+	assert.Equal(t, "bob", users[1].Username)
+}
+
+func TestImport_CsvMissingUsername(t *testing.T) {
+	data := "username,email\nalice,alice@example.com\n,nobody@example.com\n"
+
+	_, err := readUsers(strings.NewReader(data), "users.csv", UserFile{})
+
+	var importErr *ImportError
+	require.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 3, importErr.Line)
+	assert.Equal(t, "users.csv:3: missing username", err.Error())
+}
+
+func TestImport_Json(t *testing.T) {
+	data := `[
+  {"username": "alice", "email": "alice@example.com", "groups": ["admins"]},
+  {"username": "bob", "first_name": 42}
+]`
+
+	_, err := readUsers(strings.NewReader(data), "users.json", UserFile{})
+
+	var importErr *ImportError
+	require.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 3, importErr.Line)
+
+	users, err := readUsers(strings.NewReader(strings.Replace(data, "42", `"Bob"`, 1)), "users.json", UserFile{})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, []string{"admins"}, users[0].Groups)
+	assert.Equal(t, "Bob", users[1].FirstName)
+}
+
+func TestImport_Ldif(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	data := `version: 1
+
+# Alice
+dn: uid=alice,ou=people,dc=example,dc=org
+objectClass: inetOrgPerson
+uid: alice
+mail: alice@example.com
+givenName: Alice
+sn: Smith
+userPassword: {CRYPT}` + string(hash) + `
+memberOf: cn=admins,ou=groups,dc=example,dc=org
+
+dn: uid=bob,ou=people,dc=example,dc=org
+objectClass: inetOrgPerson
+uid: bob
+cn:: Qm9iIEpvbmVz
+description: a long
+  folded value
+userPassword: plain
+
+dn: cn=developers,ou=groups,dc=example,dc=org
+objectClass: groupOfNames
+cn: developers
+member: uid=alice,ou=people,dc=example,dc=org
+member: uid=bob,ou=people,dc=example,dc=org
+`
+
+	users, err := readUsers(strings.NewReader(data), "users.ldif", UserFile{})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	assert.Equal(t, "alice", users[0].Username)
+	assert.Equal(t, string(hash), users[0].PasswordHash)
+	assert.Equal(t, []string{"admins", "developers"}, users[0].Groups)
+
+	assert.Equal(t, "bob", users[1].Username)
+	assert.Equal(t, "plain", users[1].Password)
+	assert.Equal(t, []string{"developers"}, users[1].Groups)
+}
+
+func TestImport_LdifUnsupportedScheme(t *testing.T) {
+	data := "dn: uid=alice,dc=example,dc=org\nuid: alice\n\ndn: uid=bob,dc=example,dc=org\nuid: bob\nuserPassword: {SSHA}abc\n"
+
+	_, err := readUsers(strings.NewReader(data), "users.ldif", UserFile{})
+
+	var importErr *ImportError
+	require.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 4, importErr.Line)
+}
+
+func TestImport_Htpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	server := newTestServer(t)
+
+	users, err := readUsers(strings.NewReader("# comment\ntest:"+string(hash)+"\nnew:"+string(hash)+"\n"), ".htpasswd", UserFile{})
+	require.NoError(t, err)
+	require.NoError(t, server.LoadUsers(users))
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.Equal(t, "test@test.com", user.Email)
+	require.NoError(t, bcrypt.CompareHashAndPassword(user.HashedPassword, []byte("secret")))
+
+	_, _, err = server.authenticate("new", "secret", "")
+	require.NoError(t, err)
+
+	_, err = readUsers(strings.NewReader("test:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), "users", UserFile{Format: "htpasswd"})
+
+	var importErr *ImportError
+	require.ErrorAs(t, err, &importErr)
+	assert.Equal(t, 1, importErr.Line)
+}
+
+func TestImport_Endpoint(t *testing.T) {
+	server := newTestServer(t)
+
+	upload := func(filename, content string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", filename)
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest(http.MethodPost, importRoute, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return serve(server, req)
+	}
+
+	w := upload("personas.csv", "username,email,password\nalice,alice@example.com,secret\n")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, _, err := server.authenticate("alice", "secret", "")
+	require.NoError(t, err)
+
+	w = upload("personas.csv", "username,email\nbob,bob@example.com\n\"carol,carol@example.com\n")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response struct {
+		Line int `json:"line"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Line)
+}
+
+func TestImport_EndpointConflicts(t *testing.T) {
+	server := newTestServer(t)
+
+	upload := func(content string, replace bool) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "personas.csv")
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		if replace {
+			require.NoError(t, writer.WriteField("replace", "true"))
+		}
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest(http.MethodPost, importRoute, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return serve(server, req)
+	}
+
+	// Nothing is imported if any user already exists, or has the email address of another user
+	w := upload("username,email,password\nalice,alice@example.com,secret\ntest,test@test.com,new\nbob,test@test.com,secret\n", false)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	var response struct {
+		Conflicts []importConflict `json:"conflicts"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []importConflict{
+		{Username: "test", Error: "user already exists"},
+		{Username: "bob", Error: "email test@test.com belongs to user test"},
+	}, response.Conflicts)
+
+	_, err := server.Store.GetUser("alice")
+	assert.Error(t, err)
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.NoError(t, err)
+
+	// Existing users are replaced when asked to
+	w = upload("username,email,password\nalice,alice@example.com,secret\ntest,test@test.com,new\n", true)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, _, err = server.authenticate("test", "new", "")
+	require.NoError(t, err)
+
+	// Users in the same file that clash are rejected before any are saved
+	w = upload("username,email,password\ncarol,carol@example.com,secret\ndave,CAROL@example.com,secret\n", true)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	_, err = server.Store.GetUser("carol")
+	assert.Error(t, err)
+}
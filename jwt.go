@@ -0,0 +1,131 @@
+package idp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const jwtAlgorithm = "RS256"
+
+var (
+	errMalformedJwt = errors.New("malformed jwt")
+	errJwtSignature = errors.New("invalid jwt signature")
+)
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyId     string `json:"kid,omitempty"`
+}
+
+type jsonWebKey struct {
+	KeyType   string   `json:"kty"`
+	Use       string   `json:"use"`
+	Algorithm string   `json:"alg"`
+	KeyId     string   `json:"kid"`
+	Modulus   string   `json:"n"`
+	Exponent  string   `json:"e"`
+	X5c       []string `json:"x5c,omitempty"`
+}
+
+func signJwt(key *rsa.PrivateKey, header jwtHeader, claims any) (string, error) {
+	header.Algorithm = jwtAlgorithm
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyJwt checks the signature of the token and unmarshals its claims. Validating the claims
+// themselves (expiry, issuer, etc.) is left to the caller.
+func verifyJwt(key *rsa.PublicKey, token string, claims any) (*jwtHeader, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJwt
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformedJwt
+	}
+
+	header := &jwtHeader{}
+	if err = json.Unmarshal(headerJson, header); err != nil {
+		return nil, errMalformedJwt
+	}
+
+	if header.Algorithm != jwtAlgorithm {
+		return nil, errJwtSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedJwt
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return nil, errJwtSignature
+	}
+
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformedJwt
+	}
+
+	if err = json.Unmarshal(claimsJson, claims); err != nil {
+		return nil, errMalformedJwt
+	}
+
+	return header, nil
+}
+
+func buildJsonWebKey(key *rsa.PublicKey, cert *x509.Certificate) jsonWebKey {
+	jwk := jsonWebKey{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: jwtAlgorithm,
+		KeyId:     keyId(key),
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+
+	if cert != nil {
+		jwk.X5c = []string{base64.StdEncoding.EncodeToString(cert.Raw)}
+	}
+
+	return jwk
+}
+
+// keyId derives a stable key identifier from the public key so that it survives restarts
+// when a certificate and key are loaded from the filesystem
+func keyId(key *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	digest := sha256.Sum256(der)
+
+	return base64.RawURLEncoding.EncodeToString(digest[:16])
+}
@@ -0,0 +1,233 @@
+package idp
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/go-ldap/ldap/v3"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ldapModeFallback = "fallback"
+	ldapModeReplace  = "replace"
+
+	ldapTimeout = 10 * time.Second
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// ldapDirectory authenticates users by binding to an LDAP directory as them
+type ldapDirectory struct {
+	options LdapOptions
+}
+
+func newLdapDirectory(options LdapOptions) *ldapDirectory {
+	if options.UserFilter == "" {
+		options.UserFilter = "(uid={username})"
+	}
+	if options.Mode == "" {
+		options.Mode = ldapModeFallback
+	}
+	if options.GroupFilter == "" {
+		options.GroupFilter = "(member={dn})"
+	}
+	if options.GroupNameAttribute == "" {
+		options.GroupNameAttribute = "cn"
+	}
+
+	attributes := &options.Attributes
+	attributes.Username = withDefault(attributes.Username, "uid")
+	attributes.Email = withDefault(attributes.Email, "mail")
+	attributes.FirstName = withDefault(attributes.FirstName, "givenName")
+	attributes.LastName = withDefault(attributes.LastName, "sn")
+	attributes.CommonName = withDefault(attributes.CommonName, "cn")
+	attributes.Groups = withDefault(attributes.Groups, "memberOf")
+
+	return &ldapDirectory{options: options}
+}
+
+// authenticate looks up the user with the service account, then verifies the password by binding as them
+func (d *ldapDirectory) authenticate(username, password string) (*samlidp.User, []saml.Attribute, error) {
+	// Most directories treat a bind with an empty password as an anonymous bind, which always succeeds
+	if username == "" || password == "" {
+		return nil, nil, errInvalidCredentials
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if err = d.bindServiceAccount(conn); err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := d.findUser(conn, username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups, err := d.findGroups(conn, entry, username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil, errInvalidCredentials
+		}
+		return nil, nil, err
+	}
+
+	attributes := d.options.Attributes
+	user := &samlidp.User{
+		Name:       withDefault(entry.GetAttributeValue(attributes.Username), username),
+		Email:      entry.GetAttributeValue(attributes.Email),
+		GivenName:  entry.GetAttributeValue(attributes.FirstName),
+		Surname:    entry.GetAttributeValue(attributes.LastName),
+		CommonName: entry.GetAttributeValue(attributes.CommonName),
+		Groups:     groups,
+	}
+
+	return user, d.customAttributes(entry), nil
+}
+
+func (d *ldapDirectory) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: d.options.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(d.options.Url, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if d.options.StartTls {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (d *ldapDirectory) bindServiceAccount(conn *ldap.Conn) error {
+	if d.options.BindDn == "" {
+		return nil
+	}
+
+	return conn.Bind(d.options.BindDn, d.options.BindPassword)
+}
+
+func (d *ldapDirectory) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(d.options.UserFilter, "{username}", ldap.EscapeFilter(username))
+
+	attributes := d.options.Attributes
+	requested := []string{
+		attributes.Username,
+		attributes.Email,
+		attributes.FirstName,
+		attributes.LastName,
+		attributes.CommonName,
+		attributes.Groups,
+	}
+	for _, attribute := range d.options.CustomAttributes {
+		requested = append(requested, attribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.options.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		0,
+		false,
+		filter,
+		requested,
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, errInvalidCredentials
+		}
+		return nil, err
+	}
+
+	// An ambiguous filter must not let someone sign in as whichever user happens to come first
+	if len(result.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+
+	return result.Entries[0], nil
+}
+
+func (d *ldapDirectory) findGroups(conn *ldap.Conn, entry *ldap.Entry, username string) ([]string, error) {
+	if d.options.GroupBaseDn == "" {
+		var groups []string
+		for _, value := range entry.GetAttributeValues(d.options.Attributes.Groups) {
+			groups = append(groups, groupNameFromDn(value))
+		}
+		return groups, nil
+	}
+
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(entry.DN),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(d.options.GroupFilter)
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.options.GroupBaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		[]string{d.options.GroupNameAttribute},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var groups []string
+	for _, group := range result.Entries {
+		groups = append(groups, withDefault(group.GetAttributeValue(d.options.GroupNameAttribute), groupNameFromDn(group.DN)))
+	}
+
+	return groups, nil
+}
+
+func (d *ldapDirectory) customAttributes(entry *ldap.Entry) []saml.Attribute {
+	var attributes []saml.Attribute
+
+	for _, name := range slices.Sorted(maps.Keys(d.options.CustomAttributes)) {
+		values := entry.GetAttributeValues(d.options.CustomAttributes[name])
+		if len(values) == 0 {
+			continue
+		}
+
+		attributes = append(attributes, stringAttribute(name, values...))
+	}
+
+	return attributes
+}
+
+// groupNameFromDn returns the value of the first RDN, e.g. "admins" for "cn=admins,ou=groups,dc=example,dc=org"
+func groupNameFromDn(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+
+	return parsed.RDNs[0].Attributes[0].Value
+}
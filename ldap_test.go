@@ -0,0 +1,116 @@
+package idp
+
+import (
+	"fmt"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newTestDirectory(t *testing.T) *testdirectory.Directory {
+	directory := testdirectory.Start(t,
+		testdirectory.WithNoTLS(t),
+		testdirectory.WithDefaults(t, &testdirectory.Defaults{AllowAnonymousBind: true}),
+	)
+
+	memberOf := testdirectory.NewMemberOf(t, []string{"admins", "developers"})
+	directory.SetUsers(testdirectory.NewUsers(t, []string{"alice"}, testdirectory.WithMembersOf(t, memberOf...))...)
+	directory.SetGroups(testdirectory.NewGroup(t, "engineering", []string{"alice"}))
+
+	return directory
+}
+
+func newLdapTestServer(t *testing.T, configure ...func(*LdapOptions)) *Server {
+	directory := newTestDirectory(t)
+
+	return newTestServer(t, func(config *Config) {
+		config.Ldap = &LdapOptions{
+			Url:        fmt.Sprintf("ldap://%s:%d", directory.Host(), directory.Port()),
+			BaseDn:     testdirectory.DefaultUserDN,
+			UserFilter: "(cn={username})",
+			Attributes: LdapAttributes{Username: "name", Email: "email"},
+		}
+
+		for _, fn := range configure {
+			fn(config.Ldap)
+		}
+	})
+}
+
+func TestLdap_Authenticate(t *testing.T) {
+	server := newLdapTestServer(t, func(options *LdapOptions) {
+		options.CustomAttributes = map[string]string{"mail": "email"}
+	})
+
+	user, attributes, err := server.ldap.authenticate("alice", "password")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Name)
+	assert.Equal(t, "alice@example.com", user.Email)
+	assert.Equal(t, []string{"admins", "developers"}, user.Groups)
+
+	require.Len(t, attributes, 1)
+	assert.Equal(t, "mail", attributes[0].Name)
+	assert.Equal(t, "alice@example.com", attributes[0].Values[0].Value)
+}
+
+func TestLdap_GroupSearch(t *testing.T) {
+	server := newLdapTestServer(t, func(options *LdapOptions) {
+		options.GroupBaseDn = testdirectory.DefaultGroupDN
+	})
+
+	user, _, err := server.ldap.authenticate("alice", "password")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"engineering"}, user.Groups)
+}
+
+func TestLdap_InvalidCredentials(t *testing.T) {
+	server := newLdapTestServer(t)
+
+	_, _, err := server.ldap.authenticate("alice", "wrong")
+	require.ErrorIs(t, err, errInvalidCredentials)
+
+	_, _, err = server.ldap.authenticate("alice", "")
+	require.ErrorIs(t, err, errInvalidCredentials)
+
+	_, _, err = server.ldap.authenticate("bob", "password")
+	require.ErrorIs(t, err, errInvalidCredentials)
+}
+
+func TestLdap_Modes(t *testing.T) {
+	server := newLdapTestServer(t)
+
+	_, _, err := server.authenticate("test", "test", "")
+	require.NoError(t, err)
+
+	_, _, err = server.authenticate("alice", "password", "")
+	require.NoError(t, err)
+
+	server = newLdapTestServer(t, func(options *LdapOptions) {
+		options.Mode = ldapModeReplace
+	})
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.ErrorIs(t, err, errInvalidCredentials)
+}
+
+func TestLdap_Login(t *testing.T) {
+	server := newLdapTestServer(t)
+
+	form := authorizeParams()
+	form.Set("username", "alice")
+	form.Set("password", "password")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.NotEmpty(t, location.Query().Get("code"))
+
+	session, err := server.Store.GetSession(w.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", session.UserName)
+}
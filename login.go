@@ -7,26 +7,74 @@ import (
 	"net/http"
 )
 
+var identifierLabels = map[string]string{
+	identifierUsername: "Username",
+	identifierEmail:    "Email",
+	identifierAny:      "Username or email",
+}
+
 type LoginPageData struct {
 	Title       string
 	Description template.HTML
 	Users       []User
 	Toast       string
 	Username    string
+	Label       string
 	Url         string
-	SamlRequest string
-	RelayState  string
+	Fields      map[string]string
+
+	// Set if users can log in with a passkey, which is where the login starts
+	PasskeyUrl string
+
+	// Set if users can log in with a code sent to their email address
+	EmailLogin bool
+
+	// The user whose client certificate the browser presented, who can log in with it
+	CertificateUser string
+}
+
+// loginForm describes where the login page posts its credentials to, along with
+// the hidden fields required to resume the protocol flow that triggered the login.
+// Service is the SAML service provider, OIDC client or WS-Federation realm that the user is logging in to, if any.
+// Hint is the identifier of the user the relying party expects to log in, if it said so.
+// If reject is set, it answers logins to accounts that cannot be used instead of the login page.
+type loginForm struct {
+	Url     string
+	Fields  map[string]string
+	Service string
+	Hint    string
+	reject  func(w http.ResponseWriter, err *accountError) error
+}
+
+func samlLoginForm(req *saml.IdpAuthnRequest) loginForm {
+	form := loginForm{
+		Url: req.IDP.SSOURL.String(),
+		Fields: map[string]string{
+			"SAMLRequest": base64.StdEncoding.EncodeToString(req.RequestBuffer),
+			"RelayState":  req.RelayState,
+		},
+	}
+
+	if req.ServiceProviderMetadata != nil {
+		form.Service = req.ServiceProviderMetadata.EntityID
+	}
+
+	if subject := req.Request.Subject; subject != nil && subject.NameID != nil {
+		form.Hint = subject.NameID.Value
+	}
+
+	return form
 }
 
-func (s *Server) serveLoginPage(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest, toast string) {
+func (s *Server) serveLoginPage(w http.ResponseWriter, r *http.Request, form loginForm, toast string) {
 	data := LoginPageData{
 		Title:       "Login",
 		Description: "",
 		Toast:       toast,
-		Username:    r.PostForm.Get("username"),
-		Url:         req.IDP.SSOURL.String(),
-		SamlRequest: base64.StdEncoding.EncodeToString(req.RequestBuffer),
-		RelayState:  req.RelayState,
+		Username:    withDefault(r.PostForm.Get("username"), form.Hint),
+		Label:       identifierLabels[s.config.LoginPage.Identifier],
+		Url:         form.Url,
+		Fields:      form.Fields,
 	}
 
 	options := s.config.LoginPage
@@ -43,6 +91,16 @@ func (s *Server) serveLoginPage(w http.ResponseWriter, r *http.Request, req *sam
 		data.Users = s.config.Users
 	}
 
+	if s.webauthn != nil {
+		data.PasskeyUrl = s.endpointUrl(passkeyLoginRoute)
+	}
+
+	data.EmailLogin = s.config.EmailLogin != nil
+
+	if user, err := s.certificateUser(r); err == nil {
+		data.CertificateUser = user.Name
+	}
+
 	render := s.router.HTMLRender.Instance("login.html", data)
 
 	err := render.Render(w)
@@ -0,0 +1,202 @@
+package idp
+
+import (
+	"errors"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const (
+	userRoute         = "/users/:name"
+	userSessionsRoute = "/users/:name/sessions"
+	userAccountRoute  = "/users/:name/account"
+	userTotpRoute     = "/users/:name/totp"
+	userPasskeysRoute = "/users/:name/passkeys"
+	servicesRoute     = "/services"
+)
+
+// registerManagementRoutes adds the routes used to remove users, services and sessions while testing deprovisioning
+func (s *Server) registerManagementRoutes(group *gin.RouterGroup) {
+	group.DELETE(userRoute, s.deleteUser)
+	group.DELETE(userSessionsRoute, s.revokeUserSessions)
+	group.PUT(userAccountRoute, s.updateAccount)
+	group.DELETE(userTotpRoute, s.resetTotp)
+	group.DELETE(userPasskeysRoute, s.deletePasskeys)
+	group.DELETE(servicesRoute, s.deleteService)
+}
+
+func (s *Server) deleteUser(c *gin.Context) {
+	name := c.Param("name")
+
+	if _, err := s.Store.GetUser(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	if err := s.Store.DeleteUser(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// revokeUserSessions logs the user out everywhere. The user need not be in the Store, as directory users are not.
+func (s *Server) revokeUserSessions(c *gin.Context) {
+	if err := s.Store.DeleteUserSessions(c.Param("name")); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// accountUpdate holds the fields of an account that can be changed while the IdP is running. Fields that are left out
+// keep their value.
+type accountUpdate struct {
+	Status             *string `json:"status"`
+	ValidFrom          *string `json:"valid_from"`
+	ValidUntil         *string `json:"valid_until"`
+	MustChangePassword *bool   `json:"must_change_password"`
+	CertificateSubject *string `json:"certificate_subject"`
+}
+
+// updateAccount changes the status, validity dates and other given fields of a user's account, which also clears any
+// lockout. Everything else, such as the password history, is kept.
+func (s *Server) updateAccount(c *gin.Context) {
+	name := c.Param("name")
+
+	if _, err := s.Store.GetUser(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	var update accountUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := s.account(name)
+	if err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	if err = update.apply(account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account.FailedLogins = 0
+	account.FirstFailedLogin = time.Time{}
+	account.LockedUntil = time.Time{}
+
+	if err = s.Store.AddAccount(account); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// apply changes the account's fields that the update gives, checking them as they would be when loading users
+func (u accountUpdate) apply(account *Account) error {
+	user := User{Username: account.Username}
+	if u.Status != nil {
+		user.Status = *u.Status
+	}
+	if u.ValidFrom != nil {
+		user.ValidFrom = *u.ValidFrom
+	}
+	if u.ValidUntil != nil {
+		user.ValidUntil = *u.ValidUntil
+	}
+	if u.CertificateSubject != nil {
+		user.CertificateSubject = *u.CertificateSubject
+	}
+
+	checked, err := newAccount(user)
+	if err != nil {
+		return err
+	}
+
+	if u.Status != nil {
+		account.Status = checked.Status
+	}
+	if u.ValidFrom != nil {
+		account.ValidFrom = checked.ValidFrom
+	}
+	if u.ValidUntil != nil {
+		account.ValidUntil = checked.ValidUntil
+	}
+	if u.CertificateSubject != nil {
+		account.CertificateSubject = checked.CertificateSubject
+	}
+	if u.MustChangePassword != nil {
+		account.MustChangePassword = *u.MustChangePassword
+	}
+
+	return nil
+}
+
+// resetTotp removes the user's authenticator, so they have to enroll a new one if enrollment is enabled
+func (s *Server) resetTotp(c *gin.Context) {
+	name := c.Param("name")
+
+	if _, err := s.Store.GetTotpDevice(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	if err := s.Store.DeleteTotpDevice(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// deletePasskeys removes all the passkeys the user has registered
+func (s *Server) deletePasskeys(c *gin.Context) {
+	name := c.Param("name")
+
+	if _, err := s.Store.GetPasskeys(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	if err := s.Store.DeletePasskeys(name); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) deleteService(c *gin.Context) {
+	entityId := c.Query("entity_id")
+
+	if _, err := s.Store.GetServiceProvider(entityId); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	if err := s.Store.DeleteServiceProvider(entityId); err != nil {
+		managementFail(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func managementFail(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, samlidp.ErrNotFound) {
+		status = http.StatusNotFound
+	}
+
+	c.JSON(status, gin.H{"error": err.Error()})
+}
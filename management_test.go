@@ -0,0 +1,147 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addTestSession(t *testing.T, store *Store, id, username string) {
+	require.NoError(t, store.AddSession(&saml.Session{ID: id, UserName: username, ExpireTime: time.Now().Add(time.Hour)}))
+}
+
+func TestManagement_DeleteUser(t *testing.T) {
+	server := newTestServer(t)
+	addTestSession(t, server.Store, "1", "test")
+
+	w := serve(server, httptest.NewRequest(http.MethodDelete, "/users/test", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err := server.Store.GetUser("test")
+	require.Error(t, err)
+
+	_, err = server.Store.GetSession("1")
+	require.Error(t, err)
+
+	w = serve(server, httptest.NewRequest(http.MethodDelete, "/users/test", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestManagement_RevokeUserSessions(t *testing.T) {
+	server := newTestServer(t)
+	addTestSession(t, server.Store, "1", "test")
+	addTestSession(t, server.Store, "2", "other")
+
+	w := serve(server, httptest.NewRequest(http.MethodDelete, "/users/test/sessions", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err := server.Store.GetSession("1")
+	require.Error(t, err)
+
+	_, err = server.Store.GetSession("2")
+	require.NoError(t, err)
+
+	_, err = server.Store.GetUser("test")
+	require.NoError(t, err)
+}
+
+func TestManagement_DeleteService(t *testing.T) {
+	server := newTestServer(t)
+	require.NoError(t, server.Store.AddSyncStatus(&SyncStatus{Service: testEntityId, Username: "test"}))
+	require.NoError(t, server.Store.AddSyncStatus(&SyncStatus{Service: testEntityId + "/other", Username: "test"}))
+
+	w := serve(server, httptest.NewRequest(http.MethodDelete, "/services?entity_id="+url.QueryEscape(testEntityId), nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err := server.Store.GetServiceProvider(testEntityId)
+	require.Error(t, err)
+
+	_, err = server.Store.GetSyncStatus(testEntityId, "test")
+	require.Error(t, err)
+
+	_, err = server.Store.GetSyncStatus(testEntityId+"/other", "test")
+	require.NoError(t, err)
+
+	w = serve(server, httptest.NewRequest(http.MethodDelete, "/services?entity_id="+url.QueryEscape(testEntityId), nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestManagement_DeletedUserCannotRefresh(t *testing.T) {
+	server := newTestServer(t)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(exchangeCode(server, authorize(t, server), testVerifier).Body.Bytes(), &tokens))
+
+	require.NoError(t, server.Store.DeleteUser("test"))
+
+	w := serve(server, postForm(tokenRoute, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {testClientId},
+		"refresh_token": {tokens.RefreshToken},
+	}))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "session has ended")
+}
+
+func TestManagement_UpdateAccount(t *testing.T) {
+	server := newTestServer(t)
+	addTestSession(t, server.Store, "1", "test")
+
+	req := httptest.NewRequest(http.MethodPut, "/users/test/account", strings.NewReader(`{"status": "disabled"}`))
+	w := serve(server, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, _, err := server.authenticate("test", "test", "")
+	require.ErrorIs(t, err, errAccountDisabled)
+
+	_, err = server.Store.GetSession("1")
+	require.Error(t, err)
+
+	req = httptest.NewRequest(http.MethodPut, "/users/test/account", strings.NewReader(`{"status": "unknown"}`))
+	require.Equal(t, http.StatusBadRequest, serve(server, req).Code)
+
+	// Fields that are left out are kept
+	req = httptest.NewRequest(http.MethodPut, "/users/test/account", strings.NewReader(`{}`))
+	require.Equal(t, http.StatusOK, serve(server, req).Code)
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.ErrorIs(t, err, errAccountDisabled)
+
+	req = httptest.NewRequest(http.MethodPut, "/users/test/account", strings.NewReader(`{"status": "active"}`))
+	require.Equal(t, http.StatusOK, serve(server, req).Code)
+
+	_, _, err = server.authenticate("test", "test", "")
+	require.NoError(t, err)
+}
+
+func TestManagement_UpdateAccountKeepsHistory(t *testing.T) {
+	server := newTestServer(t)
+
+	changedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, server.Store.AddAccount(&Account{
+		Username:           "test",
+		Status:             accountActive,
+		PasswordChangedAt:  changedAt,
+		PasswordHistory:    [][]byte{[]byte("previous-hash")},
+		CertificateSubject: "CN=Test User",
+		FailedLogins:       2,
+	}))
+
+	req := httptest.NewRequest(http.MethodPut, "/users/test/account", strings.NewReader(`{"valid_until": "2099-01-01"}`))
+	require.Equal(t, http.StatusOK, serve(server, req).Code)
+
+	account, err := server.Store.GetAccount("test")
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("previous-hash")}, account.PasswordHistory)
+	assert.True(t, changedAt.Equal(account.PasswordChangedAt))
+	assert.Equal(t, "CN=Test User", account.CertificateSubject)
+	assert.Equal(t, 2099, account.ValidUntil.Year())
+	assert.Zero(t, account.FailedLogins)
+}
@@ -0,0 +1,227 @@
+package idp
+
+import (
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// memoryRepository keeps users and sessions in maps, with indexes for the lookups that would otherwise scan
+// every user or session. Values are copied on the way in and out, so callers cannot modify what is stored.
+type memoryRepository struct {
+	mu sync.RWMutex
+
+	users        map[string]*samlidp.User
+	usersByName  index
+	usersByEmail index
+	groupMembers index
+
+	sessions     map[string]*saml.Session
+	userSessions index
+}
+
+// index maps a key to the set of ids that have it
+type index map[string]map[string]struct{}
+
+func (i index) add(key, id string) {
+	if i[key] == nil {
+		i[key] = map[string]struct{}{}
+	}
+	i[key][id] = struct{}{}
+}
+
+func (i index) remove(key, id string) {
+	delete(i[key], id)
+	if len(i[key]) == 0 {
+		delete(i, key)
+	}
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		users:        map[string]*samlidp.User{},
+		usersByName:  index{},
+		usersByEmail: index{},
+		groupMembers: index{},
+		sessions:     map[string]*saml.Session{},
+		userSessions: index{},
+	}
+}
+
+func (r *memoryRepository) GetUser(name string) (*samlidp.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[name]
+	if !ok {
+		return nil, samlidp.ErrNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (r *memoryRepository) GetUsers() ([]*samlidp.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]*samlidp.User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, copyUser(user))
+	}
+
+	return users, nil
+}
+
+func (r *memoryRepository) GetUsersByName(name string) ([]*samlidp.User, error) {
+	return r.indexedUsers(r.usersByName, strings.ToLower(name)), nil
+}
+
+func (r *memoryRepository) GetUsersByEmail(email string) ([]*samlidp.User, error) {
+	return r.indexedUsers(r.usersByEmail, strings.ToLower(email)), nil
+}
+
+func (r *memoryRepository) GetGroupMembers(group string) ([]*samlidp.User, error) {
+	return r.indexedUsers(r.groupMembers, group), nil
+}
+
+func (r *memoryRepository) indexedUsers(index index, key string) []*samlidp.User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]*samlidp.User, 0, len(index[key]))
+	for name := range index[key] {
+		users = append(users, copyUser(r.users[name]))
+	}
+
+	return users
+}
+
+func (r *memoryRepository) PutUser(user *samlidp.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unindexUser(user.Name)
+
+	stored := copyUser(user)
+	r.users[stored.Name] = stored
+
+	r.usersByName.add(strings.ToLower(stored.Name), stored.Name)
+	r.usersByEmail.add(strings.ToLower(stored.Email), stored.Name)
+	for _, group := range stored.Groups {
+		r.groupMembers.add(group, stored.Name)
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) DeleteUser(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unindexUser(name)
+	delete(r.users, name)
+
+	return nil
+}
+
+func (r *memoryRepository) unindexUser(name string) {
+	existing, ok := r.users[name]
+	if !ok {
+		return
+	}
+
+	r.usersByName.remove(strings.ToLower(name), name)
+	r.usersByEmail.remove(strings.ToLower(existing.Email), name)
+	for _, group := range existing.Groups {
+		r.groupMembers.remove(group, name)
+	}
+}
+
+func (r *memoryRepository) GetSession(id string) (*saml.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, samlidp.ErrNotFound
+	}
+
+	return copySession(session), nil
+}
+
+func (r *memoryRepository) GetSessions() ([]*saml.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make([]*saml.Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, copySession(session))
+	}
+
+	return sessions, nil
+}
+
+func (r *memoryRepository) GetUserSessions(name string) ([]*saml.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make([]*saml.Session, 0, len(r.userSessions[name]))
+	for id := range r.userSessions[name] {
+		sessions = append(sessions, copySession(r.sessions[id]))
+	}
+
+	return sessions, nil
+}
+
+func (r *memoryRepository) PutSession(session *saml.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.sessions[session.ID]; ok {
+		r.userSessions.remove(existing.UserName, existing.ID)
+	}
+
+	r.sessions[session.ID] = copySession(session)
+	r.userSessions.add(session.UserName, session.ID)
+
+	return nil
+}
+
+func (r *memoryRepository) DeleteSession(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.sessions[id]; ok {
+		r.userSessions.remove(existing.UserName, id)
+		delete(r.sessions, id)
+	}
+
+	return nil
+}
+
+func copyUser(user *samlidp.User) *samlidp.User {
+	copied := *user
+	copied.HashedPassword = slices.Clone(user.HashedPassword)
+	copied.Groups = slices.Clone(user.Groups)
+
+	if user.PlaintextPassword != nil {
+		password := *user.PlaintextPassword
+		copied.PlaintextPassword = &password
+	}
+
+	return &copied
+}
+
+func copySession(session *saml.Session) *saml.Session {
+	copied := *session
+	copied.Groups = slices.Clone(session.Groups)
+	copied.CustomAttributes = slices.Clone(session.CustomAttributes)
+
+	for i, attribute := range copied.CustomAttributes {
+		copied.CustomAttributes[i].Values = slices.Clone(attribute.Values)
+	}
+
+	return &copied
+}
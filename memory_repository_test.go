@@ -0,0 +1,164 @@
+package idp
+
+import (
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testRepositories() map[string]func() userRepository {
+	return map[string]func() userRepository{
+		"memory": func() userRepository { return newMemoryRepository() },
+		"kv":     func() userRepository { return &kvRepository{backend: &samlidp.MemoryStore{}} },
+	}
+}
+
+func userNames(users []*samlidp.User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Name
+	}
+	return names
+}
+
+func TestRepository_Indexes(t *testing.T) {
+	for name, newRepository := range testRepositories() {
+		t.Run(name, func(t *testing.T) {
+			repository := newRepository()
+
+			require.NoError(t, repository.PutUser(&samlidp.User{Name: "alice", Email: "Alice@Example.com", Groups: []string{"admins", "developers"}}))
+			require.NoError(t, repository.PutUser(&samlidp.User{Name: "bob", Email: "bob@example.com", Groups: []string{"developers"}}))
+
+			users, err := repository.GetUsersByEmail("alice@example.com")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alice"}, userNames(users))
+
+			users, err = repository.GetUsersByName("BOB")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"bob"}, userNames(users))
+
+			users, err = repository.GetGroupMembers("developers")
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"alice", "bob"}, userNames(users))
+
+			require.NoError(t, repository.PutUser(&samlidp.User{Name: "alice", Email: "alice@example.org", Groups: []string{"admins"}}))
+
+			users, err = repository.GetUsersByEmail("alice@example.com")
+			require.NoError(t, err)
+			assert.Empty(t, users)
+
+			users, err = repository.GetGroupMembers("developers")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"bob"}, userNames(users))
+
+			require.NoError(t, repository.DeleteUser("bob"))
+
+			users, err = repository.GetUsersByName("bob")
+			require.NoError(t, err)
+			assert.Empty(t, users)
+
+			users, err = repository.GetGroupMembers("developers")
+			require.NoError(t, err)
+			assert.Empty(t, users)
+
+			_, err = repository.GetUser("bob")
+			require.ErrorIs(t, err, samlidp.ErrNotFound)
+		})
+	}
+}
+
+func TestRepository_UserSessions(t *testing.T) {
+	for name, newRepository := range testRepositories() {
+		t.Run(name, func(t *testing.T) {
+			repository := newRepository()
+
+			require.NoError(t, repository.PutSession(&saml.Session{ID: "1", UserName: "alice"}))
+			require.NoError(t, repository.PutSession(&saml.Session{ID: "2", UserName: "alice"}))
+			require.NoError(t, repository.PutSession(&saml.Session{ID: "3", UserName: "bob"}))
+			require.NoError(t, repository.DeleteSession("2"))
+
+			sessions, err := repository.GetUserSessions("alice")
+			require.NoError(t, err)
+			require.Len(t, sessions, 1)
+			assert.Equal(t, "1", sessions[0].ID)
+		})
+	}
+}
+
+func TestMemoryRepository_CopiesValues(t *testing.T) {
+	repository := newMemoryRepository()
+
+	user := &samlidp.User{Name: "alice", Groups: []string{"admins"}}
+	require.NoError(t, repository.PutUser(user))
+	user.Groups[0] = "changed"
+
+	stored, err := repository.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admins"}, stored.Groups)
+
+	stored.Groups[0] = "changed"
+
+	stored, err = repository.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admins"}, stored.Groups)
+}
+
+func benchmarkStores(b *testing.B, users int, run func(b *testing.B, store *Store)) {
+	stores := map[string]func() *Store{
+		"indexed": func() *Store { return &Store{} },
+		"kv":      func() *Store { return &Store{Backend: &samlidp.MemoryStore{}} },
+	}
+
+	for name, newStore := range stores {
+		b.Run(name, func(b *testing.B) {
+			store := newStore()
+			for i := range users {
+				err := store.AddUser(&samlidp.User{
+					Name:           fmt.Sprintf("user%d", i),
+					Email:          fmt.Sprintf("user%d@example.com", i),
+					HashedPassword: []byte("$2a$10$abcdefghijklmnopqrstuuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"),
+					Groups:         []string{fmt.Sprintf("group%d", i%100)},
+				})
+				require.NoError(b, err)
+			}
+
+			b.ResetTimer()
+			run(b, store)
+		})
+	}
+}
+
+func BenchmarkStore_GetUser(b *testing.B) {
+	benchmarkStores(b, 50000, func(b *testing.B, store *Store) {
+		for i := 0; b.Loop(); i++ {
+			_, _ = store.GetUser(fmt.Sprintf("user%d", i%50000))
+		}
+	})
+}
+
+func BenchmarkStore_GetUsersByEmail(b *testing.B) {
+	benchmarkStores(b, 5000, func(b *testing.B, store *Store) {
+		for i := 0; b.Loop(); i++ {
+			_, _ = store.GetUsersByEmail(fmt.Sprintf("user%d@example.com", i%5000))
+		}
+	})
+}
+
+func BenchmarkStore_GetGroupMembers(b *testing.B) {
+	benchmarkStores(b, 5000, func(b *testing.B, store *Store) {
+		for i := 0; b.Loop(); i++ {
+			_, _ = store.GetGroupMembers(fmt.Sprintf("group%d", i%100))
+		}
+	})
+}
+
+func BenchmarkStore_GetUsers(b *testing.B) {
+	benchmarkStores(b, 5000, func(b *testing.B, store *Store) {
+		for b.Loop() {
+			_, _ = store.GetUsers()
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package idp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"image/png"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	mfaField     = "mfa_token"
+	mfaTimeout   = 10 * time.Minute
+	totpPeriod   = 30 // seconds
+	totpQrSize   = 200
+	amrAttribute = "amr"
+
+	defaultTotpSkew = 1
+
+	// mfaMaxAttempts is the number of wrong codes or passkeys after which a login has to be started again
+	mfaMaxAttempts = 5
+
+	// mfaAuthnContext is asserted as the AuthnContextClassRef of sessions that used a second factor
+	mfaAuthnContext = "https://refeds.org/profile/mfa"
+)
+
+// The authentication methods of a session, as defined by RFC 8176
+const (
+	amrPassword = "pwd"
+	amrOtp      = "otp"
+	amrMfa      = "mfa"
+)
+
+var errInvalidTotpCode = errors.New("invalid TOTP code")
+
+// totpDevice is the authenticator a user has enrolled. Codes are only accepted once, so LastStep records the time
+// step of the last code used.
+type totpDevice struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+	LastStep int64  `json:"last_step,omitempty"`
+}
+
+// mfaChallenge lets a user whose password was correct complete their login with a second factor.
+// Secret is set while the user is enrolling a new authenticator, and Passkey if they can use one of their passkeys.
+// Attributes are those the user was authenticated with, such as from a webhook, which their session starts with, and
+// User is kept for users from a directory or webhook, as they are not in the Store.
+type mfaChallenge struct {
+	Username   string           `json:"username"`
+	ExpireTime time.Time        `json:"expire_time"`
+	Totp       bool             `json:"totp,omitempty"`
+	Secret     string           `json:"secret,omitempty"`
+	Attributes []saml.Attribute `json:"attributes,omitempty"`
+	User       *samlidp.User    `json:"user,omitempty"`
+	Attempts   int              `json:"attempts,omitempty"`
+
+	Passkey        *webauthn.SessionData         `json:"passkey,omitempty"`
+	PasskeyOptions *protocol.CredentialAssertion `json:"passkey_options,omitempty"`
+}
+
+type MfaPageData struct {
+	Title    string
+	Errors   []string
+	Username string
+	Url      string
+	Fields   map[string]string
+	Totp     bool
+
+	// Set while enrolling, for users to add the secret to their authenticator
+	QrCode template.URL
+	Secret string
+
+	// Set if the user can use one of their passkeys instead of a code
+	PasskeyOptions *protocol.CredentialAssertion
+}
+
+// checkTotpSecret rejects secrets that codes cannot be generated from, i.e. that are not base32
+func checkTotpSecret(secret string) error {
+	if _, err := totp.GenerateCodeCustom(secret, time.Time{}, totpOptions()); err != nil {
+		return fmt.Errorf("invalid totp_secret: %w", err)
+	}
+
+	return nil
+}
+
+func totpOptions() totp.ValidateOpts {
+	return totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+}
+
+// verify checks the code against the time steps around now, accepting each step at most once
+func (d *totpDevice) verify(code string, now time.Time, skew int) error {
+	step := now.Unix() / totpPeriod
+
+	for offset := -skew; offset <= skew; offset++ {
+		candidate := step + int64(offset)
+		if candidate <= d.LastStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(d.Secret, time.Unix(candidate*totpPeriod, 0), totpOptions())
+		if err != nil {
+			return err
+		}
+
+		if expected == strings.TrimSpace(code) {
+			d.LastStep = candidate
+			return nil
+		}
+	}
+
+	return errInvalidTotpCode
+}
+
+// loadTotpDevice saves the TOTP secret of a configured user. A device the user enrolled themselves is kept if the
+// configuration has no secret for them, and one whose secret is unchanged keeps the record of its used codes.
+func (s *Server) loadTotpDevice(user User) error {
+	if user.TotpSecret == "" {
+		return nil
+	}
+
+	device, err := s.Store.GetTotpDevice(user.Username)
+	if err == nil && device.Secret == user.TotpSecret {
+		return nil
+	}
+	if err != nil && !errors.Is(err, samlidp.ErrNotFound) {
+		return err
+	}
+
+	return s.Store.AddTotpDevice(&totpDevice{Username: user.Username, Secret: user.TotpSecret})
+}
+
+// completeLogin starts the session of a user whose password was correct, unless they have a second factor to enter
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, form loginForm, user *samlidp.User, attributes []saml.Attribute) *saml.Session {
+	_, err := s.Store.GetTotpDevice(user.Name)
+	if err != nil && !errors.Is(err, samlidp.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+	hasTotp := err == nil
+
+	passkeys, err := s.secondFactorPasskeys(user.Name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	if hasTotp || passkeys != nil {
+		challenge := &mfaChallenge{Username: user.Name, Totp: hasTotp, Attributes: attributes}
+		if _, err = s.Store.GetUser(user.Name); errors.Is(err, samlidp.ErrNotFound) {
+			challenge.User = user
+		}
+
+		s.startMfa(w, form, challenge, passkeys)
+		return nil
+	}
+
+	// Only configured users can enroll, as directory users are not kept in the Store
+	if s.config.Totp.Enroll {
+		if _, err = s.Store.GetUser(user.Name); err == nil {
+			key, err := totp.Generate(totp.GenerateOpts{Issuer: s.config.Totp.Issuer, AccountName: user.Name})
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return nil
+			}
+
+			challenge := &mfaChallenge{Username: user.Name, Totp: true, Secret: key.Secret(), Attributes: attributes}
+			s.startMfa(w, form, challenge, nil)
+			return nil
+		}
+	}
+
+	return s.startSession(w, r, user, attributes)
+}
+
+// startMfa asks the user for their second factor. If they have passkeys to use, the browser is asked for one of them.
+func (s *Server) startMfa(w http.ResponseWriter, form loginForm, challenge *mfaChallenge, passkeys *passkeyUser) {
+	token := uuid.NewString()
+	challenge.ExpireTime = saml.TimeNow().Add(mfaTimeout)
+
+	if passkeys != nil {
+		options, session, err := s.webauthn.BeginLogin(passkeys)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		challenge.Passkey = session
+		challenge.PasskeyOptions = options
+	}
+
+	if err := s.Store.AddMfaChallenge(token, challenge); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	s.serveMfaPage(w, form, token, challenge, nil)
+}
+
+// resolveMfa completes a login once the user has entered a valid TOTP code or used one of their passkeys
+func (s *Server) resolveMfa(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	token := r.PostForm.Get(mfaField)
+
+	challenge, err := s.Store.GetMfaChallenge(token)
+	if err != nil || saml.TimeNow().After(challenge.ExpireTime) {
+		s.serveLoginPage(w, r, form, "Your code was not entered in time, please log in again")
+		return nil
+	}
+
+	user, err := s.Store.GetUser(challenge.Username)
+	if errors.Is(err, samlidp.ErrNotFound) && challenge.User != nil {
+		user, err = challenge.User, nil
+	}
+	if err != nil {
+		s.serveLoginPage(w, r, form, "")
+		return nil
+	}
+
+	var methods []string
+	if response := r.PostForm.Get(passkeyResponseField); response != "" {
+		var passkeys *passkeyUser
+		if passkeys, err = s.Store.GetPasskeys(user.Name); err == nil {
+			methods, err = s.verifyPasskey(passkeys, challenge.Passkey, response)
+		}
+	} else {
+		methods, err = s.verifyTotp(challenge, r.PostForm.Get("totp_code"))
+	}
+
+	var problem string
+	switch {
+	case errors.Is(err, errInvalidTotpCode):
+		problem = "The code is invalid or has already been used"
+	case errors.Is(err, errInvalidPasskey):
+		problem = "Your passkey was not recognised"
+	case err != nil:
+		log.Error().Err(err).Msg("error verifying second factor")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	if problem != "" {
+		challenge.Attempts++
+		if challenge.Attempts >= mfaMaxAttempts {
+			_ = s.Store.DeleteMfaChallenge(token)
+			s.serveLoginPage(w, r, form, "Too many invalid codes were entered, please log in again")
+			return nil
+		}
+
+		if err = s.Store.AddMfaChallenge(token, challenge); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil
+		}
+
+		s.serveMfaPage(w, form, token, challenge, []string{problem})
+		return nil
+	}
+
+	_ = s.Store.DeleteMfaChallenge(token)
+
+	// The methods of the second factor replace any that the first one recorded
+	attributes := slices.DeleteFunc(slices.Clone(challenge.Attributes), func(attribute saml.Attribute) bool {
+		return attribute.Name == amrAttribute
+	})
+
+	return s.startSession(w, r, user, append(attributes, methodsAttribute(methods...)))
+}
+
+// verifyTotp checks the code against the user's authenticator, or the one they are enrolling
+func (s *Server) verifyTotp(challenge *mfaChallenge, code string) ([]string, error) {
+	if !challenge.Totp {
+		return nil, errInvalidTotpCode
+	}
+
+	device := &totpDevice{Username: challenge.Username, Secret: challenge.Secret}
+	if challenge.Secret == "" {
+		var err error
+		if device, err = s.Store.GetTotpDevice(challenge.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := device.verify(code, saml.TimeNow(), s.config.Totp.Skew); err != nil {
+		return nil, err
+	}
+
+	if err := s.Store.AddTotpDevice(device); err != nil {
+		return nil, err
+	}
+
+	return []string{amrPassword, amrOtp, amrMfa}, nil
+}
+
+func (s *Server) serveMfaPage(w http.ResponseWriter, form loginForm, token string, challenge *mfaChallenge, errs []string) {
+	fields := maps.Clone(form.Fields)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields[mfaField] = token
+
+	data := MfaPageData{
+		Title:    "Verification Code",
+		Errors:   errs,
+		Username: challenge.Username,
+		Url:      form.Url,
+		Fields:   fields,
+		Totp:     challenge.Totp,
+
+		PasskeyOptions: challenge.PasskeyOptions,
+	}
+
+	if challenge.Secret != "" {
+		qrCode, err := s.totpQrCode(challenge.Username, challenge.Secret)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		data.Title = "Set Up Authenticator"
+		data.QrCode = qrCode
+		data.Secret = challenge.Secret
+	}
+
+	render := s.router.HTMLRender.Instance("mfa.html", data)
+
+	err := render.Render(w)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// totpQrCode renders the otpauth URI of the secret as a PNG data URI
+func (s *Server) totpQrCode(username, secret string) (template.URL, error) {
+	issuer := s.config.Totp.Issuer
+
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + username,
+		RawQuery: url.Values{
+			"secret": {secret},
+			"issuer": {issuer},
+		}.Encode(),
+	}
+
+	key, err := otp.NewKeyFromURL(uri.String())
+	if err != nil {
+		return "", err
+	}
+
+	image, err := key.Image(totpQrSize, totpQrSize)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, image); err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// methodsAttribute records how the user authenticated in their session, and is asserted along with their attributes
+func methodsAttribute(methods ...string) saml.Attribute {
+	return stringAttribute(amrAttribute, methods...)
+}
+
+// sessionMethods returns how the user of the session authenticated, which is by password unless recorded otherwise
+func sessionMethods(session *saml.Session) []string {
+	for _, attribute := range session.CustomAttributes {
+		if attribute.Name != amrAttribute {
+			continue
+		}
+
+		var methods []string
+		for _, value := range attribute.Values {
+			methods = append(methods, value.Value)
+		}
+		return methods
+	}
+
+	return []string{amrPassword}
+}
+
+// assertionMaker asserts the session as the service sees it, in the MFA authentication context for sessions that
+// used a second factor, and the TLS client context for those started with a client certificate. Attributes from the
+// attribute provider, if there is one, are merged into the assertion.
+type assertionMaker struct {
+	saml.DefaultAssertionMaker
+	server *Server
+}
+
+func (m assertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	service := req.ServiceProviderMetadata.EntityID
+
+	session, err := m.server.serviceSession(session, service)
+	if err != nil {
+		return err
+	}
+
+	if err = m.DefaultAssertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	attributes, err := m.server.attributes.attributes(session, service)
+	if err != nil {
+		return err
+	}
+
+	if len(attributes) > 0 {
+		if len(req.Assertion.AttributeStatements) == 0 {
+			req.Assertion.AttributeStatements = []saml.AttributeStatement{{}}
+		}
+		mergeAttributes(&req.Assertion.AttributeStatements[0], attributes)
+	}
+
+	var context string
+	switch methods := sessionMethods(session); {
+	case slices.Contains(methods, amrMfa):
+		context = mfaAuthnContext
+	case slices.Contains(methods, amrSmartCard):
+		context = tlsClientAuthnContext
+	default:
+		return nil
+	}
+
+	for i := range req.Assertion.AuthnStatements {
+		req.Assertion.AuthnStatements[i].AuthnContext.AuthnContextClassRef = &saml.AuthnContextClassRef{Value: context}
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/crewjam/saml"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const testTotpSecret = "JBSWY3DPEHPK3PXP"
+
+// mfaToken returns the token carried by a verification code page
+func mfaToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	match := regexp.MustCompile(`name="` + mfaField + `" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	return match[1]
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	code, err := totp.GenerateCode(secret, at)
+	require.NoError(t, err)
+
+	return code
+}
+
+// withTotpUser adds a user, mfa, who has to enter a TOTP code after their password
+func withTotpUser(config *Config) {
+	config.Users = append(config.Users, User{Username: "mfa", Email: "mfa@test.com", Password: "test", TotpSecret: testTotpSecret})
+}
+
+func TestMfa_Totp(t *testing.T) {
+	now := time.Now()
+	saml.TimeNow = func() time.Time { return now }
+	t.Cleanup(func() { saml.TimeNow = time.Now })
+
+	server := newTestServer(t, withTotpUser)
+
+	login := func() string {
+		form := authorizeParams()
+		form.Set("username", "mfa")
+		form.Set("password", "test")
+
+		w := serve(server, postForm(authorizeRoute, form))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Result().Cookies())
+
+		return mfaToken(t, w)
+	}
+
+	verify := func(token, code string) *httptest.ResponseRecorder {
+		form := authorizeParams()
+		form.Set(mfaField, token)
+		form.Set("totp_code", code)
+
+		return serve(server, postForm(authorizeRoute, form))
+	}
+
+	token := login()
+
+	w := verify(token, "not a code")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "The code is invalid")
+
+	code := totpCode(t, testTotpSecret, now)
+
+	w = verify(token, code)
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, []string{amrPassword, amrOtp, amrMfa}, idToken.AuthMethods)
+
+	// Each code can only be used once
+	w = verify(login(), code)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "already been used")
+
+	// Users without a secret are not asked for a code
+	assert.NotEmpty(t, authorize(t, server))
+}
+
+func TestMfa_MaxAttempts(t *testing.T) {
+	server := newTestServer(t, withTotpUser)
+
+	form := authorizeParams()
+	form.Set("username", "mfa")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	token := mfaToken(t, w)
+
+	verify := func(code string) *httptest.ResponseRecorder {
+		form := authorizeParams()
+		form.Set(mfaField, token)
+		form.Set("totp_code", code)
+
+		return serve(server, postForm(authorizeRoute, form))
+	}
+
+	for range mfaMaxAttempts - 1 {
+		w = verify("000000")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "The code is invalid")
+	}
+
+	w = verify("000000")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Too many invalid codes")
+
+	// Not even the right code gets the user in once the challenge is gone
+	w = verify(totpCode(t, testTotpSecret, time.Now()))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "please log in again")
+}
+
+func TestMfa_KeepsAttributes(t *testing.T) {
+	webhook := newTestWebhook(t, 0)
+	server := webhookTestServer(t, webhook)
+	require.NoError(t, server.Store.AddTotpDevice(&totpDevice{Username: "alice", Secret: testTotpSecret}))
+
+	samlRequest := samlRequest(t, server)
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest},
+		"username":    {"alice"},
+		"password":    {"secret"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest},
+		mfaField:      {mfaToken(t, w)},
+		"totp_code":   {totpCode(t, testTotpSecret, time.Now())},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	assert.Equal(t, "alice-persistent-id", response.Assertion.Subject.NameID.Value)
+
+	attributes := map[string][]string{}
+	for _, attribute := range response.Assertion.AttributeStatements[0].Attributes {
+		for _, value := range attribute.Values {
+			attributes[attribute.FriendlyName] = append(attributes[attribute.FriendlyName], value.Value)
+		}
+	}
+	assert.Equal(t, []string{"R&D"}, attributes["department"])
+	assert.Equal(t, []string{amrPassword, amrOtp, amrMfa}, attributes[amrAttribute])
+}
+
+func TestMfa_Skew(t *testing.T) {
+	now := time.Now()
+
+	tests := map[time.Duration]bool{
+		0:                             true,
+		-totpPeriod * time.Second:     true,
+		totpPeriod * time.Second:      true,
+		-3 * totpPeriod * time.Second: false,
+	}
+
+	for offset, valid := range tests {
+		device := &totpDevice{Username: "mfa", Secret: testTotpSecret}
+
+		err := device.verify(totpCode(t, testTotpSecret, now.Add(offset)), now, defaultTotpSkew)
+		if valid {
+			assert.NoError(t, err, offset)
+		} else {
+			assert.ErrorIs(t, err, errInvalidTotpCode, offset)
+		}
+	}
+}
+
+func TestMfa_Enroll(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.Totp.Enroll = true
+	})
+
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "data:image/png;base64,")
+
+	match := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+	secret := match[1]
+
+	form = authorizeParams()
+	form.Set(mfaField, mfaToken(t, w))
+	form.Set("totp_code", totpCode(t, secret, time.Now()))
+
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	device, err := server.Store.GetTotpDevice("test")
+	require.NoError(t, err)
+	assert.Equal(t, secret, device.Secret)
+
+	// The authenticator can be reset, so the user enrolls a new one
+	w = serve(server, httptest.NewRequest(http.MethodDelete, "/users/test/totp", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err = server.Store.GetTotpDevice("test")
+	require.Error(t, err)
+}
+
+func TestMfa_SamlAuthnContext(t *testing.T) {
+	server := newTestServer(t, withTotpUser)
+	request := samlRequest(t, server)
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {request},
+		"username":    {"mfa"},
+		"password":    {"test"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {request},
+		mfaField:      {mfaToken(t, w)},
+		"totp_code":   {totpCode(t, testTotpSecret, time.Now())},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	require.NotEmpty(t, response.Assertion.AuthnStatements)
+	assert.Equal(t, mfaAuthnContext, response.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value)
+}
+
+func TestMfa_InvalidSecret(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadUsers([]User{{Username: "bad", Password: "test", TotpSecret: "not base32!"}})
+	require.ErrorContains(t, err, "totp_secret")
+}
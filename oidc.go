@@ -0,0 +1,641 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	discoveryRoute = "/.well-known/openid-configuration"
+	jwksRoute      = "/oidc/jwks"
+	authorizeRoute = "/oidc/authorize"
+	tokenRoute     = "/oidc/token"
+	userInfoRoute  = "/oidc/userinfo"
+	logoutRoute    = "/oidc/logout"
+
+	authorizationCodeLifetime = 5 * time.Minute
+	refreshTokenLifetime      = 30 * 24 * time.Hour
+
+	accessTokenType = "at+jwt"
+)
+
+var (
+	errInvalidClient = errors.New("invalid client credentials")
+	errNotRsaKey     = errors.New("OIDC requires an RSA signing key")
+)
+
+// authorizationGrant captures everything needed to mint tokens for an authorization code or refresh token
+type authorizationGrant struct {
+	ClientId            string     `json:"client_id"`
+	RedirectUri         string     `json:"redirect_uri,omitempty"`
+	Scope               string     `json:"scope"`
+	Nonce               string     `json:"nonce,omitempty"`
+	CodeChallenge       string     `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string     `json:"code_challenge_method,omitempty"`
+	SessionId           string     `json:"session_id"`
+	AuthTime            time.Time  `json:"auth_time"`
+	AuthMethods         []string   `json:"amr,omitempty"`
+	ExpireTime          time.Time  `json:"expire_time"`
+	Claims              userClaims `json:"claims"`
+}
+
+type userClaims struct {
+	Subject           string   `json:"sub"`
+	Name              string   `json:"name,omitempty"`
+	GivenName         string   `json:"given_name,omitempty"`
+	FamilyName        string   `json:"family_name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"email_verified,omitempty"`
+	PhoneNumber       string   `json:"phone_number,omitempty"`
+	Locale            string   `json:"locale,omitempty"`
+	Zoneinfo          string   `json:"zoneinfo,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	AuthTime  int64  `json:"auth_time"`
+	Nonce     string `json:"nonce,omitempty"`
+	SessionId string `json:"sid,omitempty"`
+
+	// The authentication methods used, from which relying parties can tell whether a second factor was entered
+	AuthMethods []string `json:"amr,omitempty"`
+	userClaims
+}
+
+type accessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	JwtId     string `json:"jti"`
+	ClientId  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	SessionId string `json:"sid,omitempty"`
+	userClaims
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+type oidcError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (s *Server) registerOidcRoutes(group *gin.RouterGroup) {
+	group.GET(discoveryRoute, s.serveDiscovery)
+	group.GET(jwksRoute, s.serveJwks)
+	group.GET(authorizeRoute, s.serveAuthorize)
+	group.POST(authorizeRoute, s.serveAuthorize)
+	group.POST(tokenRoute, s.serveToken)
+	group.GET(userInfoRoute, s.serveUserInfo)
+	group.POST(userInfoRoute, s.serveUserInfo)
+	group.GET(logoutRoute, s.serveLogout)
+	group.POST(logoutRoute, s.serveLogout)
+}
+
+func (s *Server) serveDiscovery(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                s.issuer(),
+		"authorization_endpoint":                s.endpointUrl(authorizeRoute),
+		"token_endpoint":                        s.endpointUrl(tokenRoute),
+		"userinfo_endpoint":                     s.endpointUrl(userInfoRoute),
+		"jwks_uri":                              s.endpointUrl(jwksRoute),
+		"end_session_endpoint":                  s.endpointUrl(logoutRoute),
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwtAlgorithm},
+		"scopes_supported":                      []string{"openid", "profile", "email", "phone", "groups", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "sid", "amr",
+			"name", "given_name", "family_name", "preferred_username", "email", "email_verified", "phone_number",
+			"locale", "zoneinfo", "groups",
+		},
+	})
+}
+
+func (s *Server) serveJwks(c *gin.Context) {
+	key, err := s.signingKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, oidcError{Code: "server_error", Description: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys": []jsonWebKey{buildJsonWebKey(&key.PublicKey, s.idp.Certificate)},
+	})
+}
+
+func (s *Server) serveAuthorize(c *gin.Context) {
+	r := c.Request
+	if err := r.ParseForm(); err != nil {
+		c.String(http.StatusBadRequest, "Malformed authorization request")
+		return
+	}
+
+	clientId := r.Form.Get("client_id")
+	redirectUri := r.Form.Get("redirect_uri")
+	state := r.Form.Get("state")
+
+	// Until the client and redirect URI are verified, errors cannot be sent back to the client
+	client, err := s.Store.GetClient(clientId)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Unknown client_id")
+		return
+	}
+
+	if !slices.Contains(client.RedirectUris, redirectUri) {
+		c.String(http.StatusBadRequest, "Unregistered redirect_uri")
+		return
+	}
+
+	fail := func(code, description string) {
+		redirectWithParams(c, redirectUri, map[string]string{
+			"error":             code,
+			"error_description": description,
+			"state":             state,
+		})
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the authorization code flow is supported")
+		return
+	}
+
+	scope := r.Form.Get("scope")
+	if !slices.Contains(strings.Fields(scope), "openid") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+
+	codeChallenge := r.Form.Get("code_challenge")
+	codeChallengeMethod := r.Form.Get("code_challenge_method")
+	if codeChallenge != "" && codeChallengeMethod == "" {
+		codeChallengeMethod = "plain"
+	}
+
+	if codeChallengeMethod != "" && codeChallengeMethod != "plain" && codeChallengeMethod != "S256" {
+		fail("invalid_request", "unsupported code_challenge_method")
+		return
+	}
+
+	if client.ClientSecret == "" && codeChallenge == "" {
+		fail("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	form := loginForm{
+		Url:     s.endpointUrl(authorizeRoute),
+		Fields:  map[string]string{},
+		Service: r.Form.Get("client_id"),
+		Hint:    r.Form.Get("login_hint"),
+	}
+	for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		if value := r.Form.Get(name); value != "" {
+			form.Fields[name] = value
+		}
+	}
+
+	session := s.resolveSession(c.Writer, r, form)
+	if session == nil {
+		return
+	}
+
+	asserted, err := s.serviceSession(session, client.ClientId)
+	if err != nil {
+		fail("server_error", err.Error())
+		return
+	}
+
+	grant := &authorizationGrant{
+		ClientId:            client.ClientId,
+		RedirectUri:         redirectUri,
+		Scope:               scope,
+		Nonce:               r.Form.Get("nonce"),
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+		SessionId:           session.ID,
+		AuthTime:            session.CreateTime,
+		AuthMethods:         sessionMethods(session),
+		ExpireTime:          saml.TimeNow().Add(authorizationCodeLifetime),
+		Claims:              sessionClaims(asserted),
+	}
+
+	code := randomToken()
+	if err = s.Store.AddAuthorizationCode(code, grant); err != nil {
+		fail("server_error", err.Error())
+		return
+	}
+
+	redirectWithParams(c, redirectUri, map[string]string{
+		"code":  code,
+		"state": state,
+	})
+}
+
+func (s *Server) serveToken(c *gin.Context) {
+	client, err := s.authenticateClient(c.Request)
+	if err != nil {
+		c.Header("WWW-Authenticate", "Basic")
+		c.JSON(http.StatusUnauthorized, oidcError{Code: "invalid_client", Description: err.Error()})
+		return
+	}
+
+	var grant *authorizationGrant
+
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		code := c.PostForm("code")
+
+		grant, err = s.Store.GetAuthorizationCode(code)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "unknown authorization code"})
+			return
+		}
+
+		// Authorization codes are single use, regardless of whether the exchange succeeds
+		_ = s.Store.DeleteAuthorizationCode(code)
+
+		if grant.RedirectUri != c.PostForm("redirect_uri") {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "redirect_uri does not match"})
+			return
+		}
+
+		if !verifyCodeChallenge(grant, c.PostForm("code_verifier")) {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "invalid code_verifier"})
+			return
+		}
+	case "refresh_token":
+		token := c.PostForm("refresh_token")
+
+		grant, err = s.Store.GetRefreshToken(token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "unknown refresh token"})
+			return
+		}
+
+		// Checked before the token is used up, so that other clients cannot revoke it
+		if grant.ClientId != client.ClientId {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "grant was issued to another client"})
+			return
+		}
+
+		// Refresh tokens are rotated on every use
+		_ = s.Store.DeleteRefreshToken(token)
+
+		// Ending the session, e.g. by logging out or deleting the user, revokes the refresh tokens issued in it,
+		// as does the session expiring
+		session, err := s.Store.GetSession(grant.SessionId)
+		if err != nil || saml.TimeNow().After(session.ExpireTime) {
+			c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "session has ended"})
+			return
+		}
+
+		// Nonces only apply to the ID token issued from the original authentication
+		grant.Nonce = ""
+	default:
+		c.JSON(http.StatusBadRequest, oidcError{Code: "unsupported_grant_type", Description: grantType})
+		return
+	}
+
+	if grant.ClientId != client.ClientId {
+		c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "grant was issued to another client"})
+		return
+	}
+
+	if saml.TimeNow().After(grant.ExpireTime) {
+		c.JSON(http.StatusBadRequest, oidcError{Code: "invalid_grant", Description: "grant has expired"})
+		return
+	}
+
+	response, err := s.issueTokens(grant)
+	if err != nil {
+		log.Error().Err(err).Msg("error issuing OIDC tokens")
+		c.JSON(http.StatusInternalServerError, oidcError{Code: "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) serveUserInfo(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		token = c.PostForm("access_token")
+	}
+
+	claims, err := s.verifyAccessToken(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, oidcError{Code: "invalid_token", Description: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, claims.userClaims)
+}
+
+func (s *Server) serveLogout(c *gin.Context) {
+	r := c.Request
+	if err := r.ParseForm(); err != nil {
+		c.String(http.StatusBadRequest, "Malformed logout request")
+		return
+	}
+
+	clientId := r.Form.Get("client_id")
+
+	if hint := r.Form.Get("id_token_hint"); hint != "" {
+		key, err := s.signingKey()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Expired ID tokens are still acceptable hints, so only the signature is verified
+		claims := &idTokenClaims{}
+		if _, err = verifyJwt(&key.PublicKey, hint, claims); err != nil {
+			c.String(http.StatusBadRequest, "Invalid id_token_hint")
+			return
+		}
+
+		clientId = claims.Audience
+	}
+
+	redirectUri := r.Form.Get("post_logout_redirect_uri")
+	if redirectUri != "" {
+		client, err := s.Store.GetClient(clientId)
+		if err != nil || !slices.Contains(client.PostLogoutRedirectUris, redirectUri) {
+			c.String(http.StatusBadRequest, "Unregistered post_logout_redirect_uri")
+			return
+		}
+	}
+
+	s.endSession(c.Writer, r)
+
+	if redirectUri == "" {
+		c.String(http.StatusOK, "You have been logged out")
+		return
+	}
+
+	redirectWithParams(c, redirectUri, map[string]string{
+		"state": r.Form.Get("state"),
+	})
+}
+
+func (s *Server) issueTokens(grant *authorizationGrant) (*tokenResponse, error) {
+	key, err := s.signingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := saml.TimeNow()
+	lifetime := time.Duration(s.config.SessionMaxAge) * time.Minute
+	expires := now.Add(lifetime)
+	claims := scopedClaims(grant.Claims, grant.Scope)
+
+	accessToken, err := signJwt(key, jwtHeader{Type: accessTokenType, KeyId: keyId(&key.PublicKey)}, accessTokenClaims{
+		Issuer:     s.issuer(),
+		Audience:   grant.ClientId,
+		ExpiresAt:  expires.Unix(),
+		IssuedAt:   now.Unix(),
+		JwtId:      uuid.NewString(),
+		ClientId:   grant.ClientId,
+		Scope:      grant.Scope,
+		SessionId:  grant.SessionId,
+		userClaims: claims,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := signJwt(key, jwtHeader{Type: "JWT", KeyId: keyId(&key.PublicKey)}, idTokenClaims{
+		Issuer:      s.issuer(),
+		Audience:    grant.ClientId,
+		ExpiresAt:   expires.Unix(),
+		IssuedAt:    now.Unix(),
+		AuthTime:    grant.AuthTime.Unix(),
+		Nonce:       grant.Nonce,
+		SessionId:   grant.SessionId,
+		AuthMethods: grant.AuthMethods,
+		userClaims:  claims,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(lifetime.Seconds()),
+		IdToken:     idToken,
+		Scope:       grant.Scope,
+	}
+
+	// Refresh tokens are only issued to clients that ask for offline access
+	if !slices.Contains(strings.Fields(grant.Scope), "offline_access") {
+		return response, nil
+	}
+
+	refreshGrant := *grant
+	refreshGrant.RedirectUri = ""
+	refreshGrant.CodeChallenge = ""
+	refreshGrant.CodeChallengeMethod = ""
+	refreshGrant.ExpireTime = now.Add(refreshTokenLifetime)
+
+	response.RefreshToken = randomToken()
+	if err = s.Store.AddRefreshToken(response.RefreshToken, &refreshGrant); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (s *Server) verifyAccessToken(token string) (*accessTokenClaims, error) {
+	key, err := s.signingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &accessTokenClaims{}
+	header, err := verifyJwt(&key.PublicKey, token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Type != accessTokenType {
+		return nil, errors.New("token is not an access token")
+	}
+
+	if claims.Issuer != s.issuer() {
+		return nil, errors.New("token was issued by another issuer")
+	}
+
+	if saml.TimeNow().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token has expired")
+	}
+
+	return claims, nil
+}
+
+func (s *Server) authenticateClient(r *http.Request) (*Client, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// Basic credentials are form encoded before being base64 encoded (RFC 6749 2.3.1)
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := s.Store.GetClient(clientId)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	if subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(clientSecret)) != 1 {
+		return nil, errInvalidClient
+	}
+
+	return client, nil
+}
+
+func (s *Server) signingKey() (*rsa.PrivateKey, error) {
+	key, ok := s.idp.Key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errNotRsaKey
+	}
+
+	return key, nil
+}
+
+func (s *Server) issuer() string {
+	return strings.TrimSuffix(s.host.String(), "/")
+}
+
+func (s *Server) endpointUrl(route string) string {
+	endpoint := s.host
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + route
+
+	return endpoint.String()
+}
+
+func sessionClaims(session *saml.Session) userClaims {
+	name := withDefault(sessionAttribute(session, "displayName"), session.UserCommonName)
+	if name == "" {
+		name = strings.TrimSpace(session.UserGivenName + " " + session.UserSurname)
+	}
+
+	return userClaims{
+		Subject:           session.UserName,
+		Name:              name,
+		GivenName:         session.UserGivenName,
+		FamilyName:        session.UserSurname,
+		PreferredUsername: session.UserName,
+		Email:             session.UserEmail,
+		EmailVerified:     session.UserEmail != "",
+		PhoneNumber:       sessionAttribute(session, "telephoneNumber"),
+		Locale:            sessionAttribute(session, "preferredLanguage"),
+		Zoneinfo:          sessionAttribute(session, "zoneinfo"),
+		Groups:            session.Groups,
+	}
+}
+
+// scopedClaims strips the claims that were not granted by the requested scopes
+func scopedClaims(claims userClaims, scope string) userClaims {
+	scopes := strings.Fields(scope)
+	scoped := userClaims{Subject: claims.Subject}
+
+	if slices.Contains(scopes, "profile") {
+		scoped.Name = claims.Name
+		scoped.GivenName = claims.GivenName
+		scoped.FamilyName = claims.FamilyName
+		scoped.PreferredUsername = claims.PreferredUsername
+		scoped.Locale = claims.Locale
+		scoped.Zoneinfo = claims.Zoneinfo
+	}
+
+	if slices.Contains(scopes, "email") {
+		scoped.Email = claims.Email
+		scoped.EmailVerified = claims.EmailVerified
+	}
+
+	if slices.Contains(scopes, "phone") {
+		scoped.PhoneNumber = claims.PhoneNumber
+	}
+
+	if slices.Contains(scopes, "groups") {
+		scoped.Groups = claims.Groups
+	}
+
+	return scoped
+}
+
+func verifyCodeChallenge(grant *authorizationGrant, verifier string) bool {
+	switch grant.CodeChallengeMethod {
+	case "":
+		return true
+	case "S256":
+		digest := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(digest[:]) == grant.CodeChallenge
+	default:
+		return verifier == grant.CodeChallenge
+	}
+}
+
+func redirectWithParams(c *gin.Context, target string, params map[string]string) {
+	u, err := url.Parse(target)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+
+	query := u.Query()
+	for name, value := range params {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, u.String())
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,269 @@
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	testClientId    = "test-client"
+	testRedirectUri = "http://localhost:9000/callback"
+	testVerifier    = "a-very-long-and-random-code-verifier-for-testing"
+)
+
+func authorizeParams() url.Values {
+	digest := sha256.Sum256([]byte(testVerifier))
+
+	return url.Values{
+		"client_id":             {testClientId},
+		"redirect_uri":          {testRedirectUri},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile email groups offline_access"},
+		"state":                 {"xyz"},
+		"nonce":                 {"abc"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(digest[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func authorize(t *testing.T, server *Server) string {
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "xyz", location.Query().Get("state"))
+	require.NotEmpty(t, location.Query().Get("code"))
+
+	return location.Query().Get("code")
+}
+
+func exchangeCode(server *Server, code, verifier string) *httptest.ResponseRecorder {
+	return serve(server, postForm(tokenRoute, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {testClientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	}))
+}
+
+func TestOidc_Discovery(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, discoveryRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var discovery map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &discovery))
+	assert.Equal(t, "http://localhost:8080", discovery["issuer"])
+	assert.Equal(t, "http://localhost:8080/oidc/token", discovery["token_endpoint"])
+}
+
+func TestOidc_Jwks(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, jwksRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "RSA", jwks.Keys[0].KeyType)
+}
+
+func TestOidc_AuthorizeShowsLoginPage(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `name="code_challenge"`)
+}
+
+func TestOidc_AuthorizeRejectsUnknownRedirect(t *testing.T) {
+	server := newTestServer(t)
+
+	params := authorizeParams()
+	params.Set("redirect_uri", "http://evil.test/callback")
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+params.Encode(), nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOidc_PublicClientRequiresPkce(t *testing.T) {
+	server := newTestServer(t)
+
+	params := authorizeParams()
+	params.Del("code_challenge")
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+params.Encode(), nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=invalid_request")
+}
+
+func TestOidc_CodeFlow(t *testing.T) {
+	server := newTestServer(t)
+
+	w := exchangeCode(server, authorize(t, server), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	require.NotEmpty(t, tokens.RefreshToken)
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, "test", idToken.Subject)
+	assert.Equal(t, "abc", idToken.Nonce)
+	assert.Equal(t, testClientId, idToken.Audience)
+	assert.Equal(t, "test@test.com", idToken.Email)
+
+	req := httptest.NewRequest(http.MethodGet, userInfoRoute, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w = serve(server, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var userInfo userClaims
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &userInfo))
+	assert.Equal(t, "Test User", userInfo.Name)
+	assert.Equal(t, []string{"foobar"}, userInfo.Groups)
+}
+
+func TestOidc_CodeIsSingleUse(t *testing.T) {
+	server := newTestServer(t)
+	code := authorize(t, server)
+
+	require.Equal(t, http.StatusOK, exchangeCode(server, code, testVerifier).Code)
+	require.Equal(t, http.StatusBadRequest, exchangeCode(server, code, testVerifier).Code)
+}
+
+func TestOidc_InvalidCodeVerifier(t *testing.T) {
+	server := newTestServer(t)
+
+	w := exchangeCode(server, authorize(t, server), "wrong")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOidc_RefreshTokenRotation(t *testing.T) {
+	server := newTestServer(t)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(exchangeCode(server, authorize(t, server), testVerifier).Body.Bytes(), &tokens))
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return serve(server, postForm(tokenRoute, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {testClientId},
+			"refresh_token": {token},
+		}))
+	}
+
+	w := refresh(tokens.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var refreshed tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+	require.Equal(t, http.StatusBadRequest, refresh(tokens.RefreshToken).Code)
+}
+
+func TestOidc_RefreshTokenChecks(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.Clients = append(config.Clients, Client{ClientId: "other-client", RedirectUris: []string{testRedirectUri}})
+	})
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(exchangeCode(server, authorize(t, server), testVerifier).Body.Bytes(), &tokens))
+
+	refresh := func(clientId string) *httptest.ResponseRecorder {
+		return serve(server, postForm(tokenRoute, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {clientId},
+			"refresh_token": {tokens.RefreshToken},
+		}))
+	}
+
+	// Another client can neither use the token nor revoke it
+	w := refresh("other-client")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "another client")
+
+	// Once the session expires, so do its refresh tokens
+	later := time.Now().Add(time.Duration(server.config.SessionMaxAge+1) * time.Minute)
+	saml.TimeNow = func() time.Time { return later }
+	t.Cleanup(func() { saml.TimeNow = time.Now })
+
+	w = refresh(testClientId)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "session has ended")
+}
+
+func TestOidc_RefreshTokenNeedsOfflineAccess(t *testing.T) {
+	server := newTestServer(t)
+
+	form := authorizeParams()
+	form.Set("scope", "openid email")
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.Empty(t, tokens.RefreshToken)
+}
+
+func TestOidc_SharedSession(t *testing.T) {
+	server := newTestServer(t)
+
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	req := httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil)
+	req.AddCookie(cookies[0])
+	w = serve(server, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "code=")
+
+	req = httptest.NewRequest(http.MethodGet, logoutRoute+"?client_id="+testClientId+"&post_logout_redirect_uri="+url.QueryEscape(testRedirectUri), nil)
+	req.AddCookie(cookies[0])
+	w = serve(server, req)
+	require.Equal(t, http.StatusFound, w.Code)
+
+	_, err := server.Store.GetSession(cookies[0].Value)
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"maps"
+	"slices"
+)
+
+// checkOverrides ensures that every override names a service, and that no service is overridden twice
+func checkOverrides(overrides []ServiceOverride) error {
+	seen := map[string]bool{}
+	for _, override := range overrides {
+		if override.EntityId == "" {
+			return errors.New("override without an entity_id")
+		}
+
+		if seen[override.EntityId] {
+			return fmt.Errorf("service %s is overridden more than once", override.EntityId)
+		}
+		seen[override.EntityId] = true
+	}
+
+	return nil
+}
+
+// serviceOverride returns the named user's override for the service, if they have one
+func (s *Server) serviceOverride(name, service string) (*ServiceOverride, error) {
+	profile, err := s.profile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(profile.Overrides, func(override ServiceOverride) bool {
+		return override.EntityId == service
+	})
+	if i < 0 {
+		return nil, nil
+	}
+
+	return &profile.Overrides[i], nil
+}
+
+// apply changes the session, which must be a copy that only the service sees
+func (o *ServiceOverride) apply(session *saml.Session) {
+	if o.Email != "" {
+		if session.NameID == session.UserEmail {
+			session.NameID = o.Email
+		}
+		session.UserEmail = o.Email
+	}
+
+	if o.NameId != "" {
+		session.NameID = o.NameId
+	}
+
+	if len(o.Attributes) == 0 {
+		return
+	}
+
+	attributes := slices.Clone(session.CustomAttributes)
+	for _, name := range slices.Sorted(maps.Keys(o.Attributes)) {
+		values := o.Attributes[name]
+		i := slices.IndexFunc(attributes, func(attribute saml.Attribute) bool {
+			return attribute.Name == name || attribute.FriendlyName == name
+		})
+
+		switch {
+		case i < 0 && len(values) > 0:
+			attributes = append(attributes, stringAttribute(name, values...))
+		case i >= 0 && len(values) == 0:
+			attributes = slices.Delete(attributes, i, i+1)
+		case i >= 0:
+			attributes[i].Values = stringAttribute(name, values...).Values
+		}
+	}
+	session.CustomAttributes = attributes
+}
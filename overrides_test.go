@@ -0,0 +1,59 @@
+package idp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.Users[0].Title = "QA Engineer"
+		config.Users[0].Overrides = []ServiceOverride{{
+			EntityId: testEntityId,
+			Email:    "linked@other.com",
+			Attributes: map[string][]string{
+				"role":  {"admin"},
+				"title": {},
+			},
+		}}
+	})
+
+	w := serve(server, postForm(ssoRoute, url.Values{
+		"SAMLRequest": {samlRequest(t, server)},
+		"username":    {"test"},
+		"password":    {"test"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	response := samlResponse(t, w)
+	require.NotNil(t, response.Assertion)
+	assert.Equal(t, "linked@other.com", response.Assertion.Subject.NameID.Value)
+
+	attributes := assertionAttributes(t, server)
+	assert.Equal(t, []string{"linked@other.com"}, attributeValues(attributes["mail"]))
+	assert.Equal(t, []string{"admin"}, attributeValues(attributes["role"]))
+	assert.NotContains(t, attributes, "title")
+
+	// Other services are told about the user as they are
+	rstr := signInWsFed(t, server, testEntityId+"-saml11")
+	email := rstr.FindElement(`.//Attribute[@AttributeName='emailaddress']/AttributeValue`)
+	require.NotNil(t, email)
+	assert.Equal(t, "test@test.com", email.Text())
+
+	sessions, err := server.Store.GetUserSessions("test")
+	require.NoError(t, err)
+	for _, session := range sessions {
+		assert.Equal(t, "test@test.com", session.UserEmail)
+	}
+
+	err = server.LoadUsers([]User{{
+		Username:  "twice",
+		Email:     "twice@test.com",
+		Password:  "test",
+		Overrides: []ServiceOverride{{EntityId: testEntityId}, {EntityId: testEntityId}},
+	}})
+	assert.ErrorContains(t, err, "overridden more than once")
+}
@@ -0,0 +1,367 @@
+package idp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	passkeyLoginRoute    = "/passkeys/login"
+	accountPasskeysRoute = accountRoute + "/passkeys"
+
+	passkeyField         = "passkey_token"
+	passkeyResponseField = "passkey_response"
+	passkeyTimeout       = 5 * time.Minute
+
+	// Authentication methods of RFC 8176 used by passkeys
+	amrHardwareKey = "hwk"
+)
+
+var (
+	userVerifications = []string{
+		string(protocol.VerificationRequired),
+		string(protocol.VerificationPreferred),
+		string(protocol.VerificationDiscouraged),
+	}
+
+	errInvalidPasskey = errors.New("invalid passkey")
+)
+
+// passkeyUser holds the passkeys a user has registered. Its Id is the user handle that authenticators keep with each
+// passkey, which is random so that it still refers to the user after they are renamed.
+type passkeyUser struct {
+	Username    string                `json:"username"`
+	Id          []byte                `json:"id"`
+	Credentials []webauthn.Credential `json:"credentials"`
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return u.Id
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// updateCredential replaces the stored copy of a credential, such as after its signature counter has moved on
+func (u *passkeyUser) updateCredential(credential *webauthn.Credential) {
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].ID, credential.ID) {
+			u.Credentials[i] = *credential
+		}
+	}
+}
+
+// passkeyCeremony is the state of a passkey registration or login between the browser being asked for a credential
+// and it being verified. Username is only set for registrations.
+type passkeyCeremony struct {
+	Username   string               `json:"username,omitempty"`
+	ExpireTime time.Time            `json:"expire_time"`
+	Session    webauthn.SessionData `json:"session"`
+}
+
+// passkeyStart is what the browser needs to ask the authenticator for a credential, and to send it back with
+type passkeyStart struct {
+	Token   string `json:"token"`
+	Options any    `json:"options"`
+}
+
+func newWebAuthn(host url.URL, options PasskeyOptions) (*webauthn.WebAuthn, error) {
+	origins := options.Origins
+	if len(origins) == 0 {
+		origins = []string{host.Scheme + "://" + host.Host}
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          withDefault(options.RpId, host.Hostname()),
+		RPDisplayName: withDefault(options.RpName, host.Hostname()),
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.UserVerificationRequirement(options.UserVerification),
+		},
+	})
+}
+
+func (s *Server) registerPasskeyRoutes(group *gin.RouterGroup) {
+	group.POST(passkeyLoginRoute, s.startPasskeyLogin)
+	group.POST(accountPasskeysRoute, s.startPasskeyRegistration)
+	group.POST(accountPasskeysRoute+"/:token", s.finishPasskeyRegistration)
+}
+
+// passkeys returns the passkeys of the named user. Users who have not registered any are given their user handle
+// now, so that it stays the same from the start of their first registration to its end.
+func (s *Server) passkeys(name string) (*passkeyUser, error) {
+	passkeys, err := s.Store.GetPasskeys(name)
+	if !errors.Is(err, samlidp.ErrNotFound) {
+		return passkeys, err
+	}
+
+	id := uuid.New()
+	passkeys = &passkeyUser{Username: name, Id: id[:]}
+
+	return passkeys, s.Store.AddPasskeys(passkeys)
+}
+
+// addPasskeyCeremony saves the state of a ceremony, returning the token that the browser continues it with
+func (s *Server) addPasskeyCeremony(username string, session *webauthn.SessionData) (string, error) {
+	token := uuid.NewString()
+
+	err := s.Store.AddPasskeyCeremony(token, &passkeyCeremony{
+		Username:   username,
+		ExpireTime: saml.TimeNow().Add(passkeyTimeout),
+		Session:    *session,
+	})
+
+	return token, err
+}
+
+// passkeyCeremony returns the state of the ceremony that the token continues, which must not have expired
+func (s *Server) passkeyCeremony(token string) (*passkeyCeremony, error) {
+	ceremony, err := s.Store.GetPasskeyCeremony(token)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = s.Store.DeletePasskeyCeremony(token)
+
+	if saml.TimeNow().After(ceremony.ExpireTime) {
+		return nil, samlidp.ErrNotFound
+	}
+
+	return ceremony, nil
+}
+
+// startPasskeyLogin asks the browser for any passkey of this IdP, so that users need not enter their username
+func (s *Server) startPasskeyLogin(c *gin.Context) {
+	if s.webauthn == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	options, session, err := s.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := s.addPasskeyCeremony("", session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, passkeyStart{Token: token, Options: options})
+}
+
+// resolvePasskeyLogin logs in the user whose passkey the browser returned
+func (s *Server) resolvePasskeyLogin(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	if s.webauthn == nil {
+		s.serveLoginPage(w, r, form, "")
+		return nil
+	}
+
+	ceremony, err := s.passkeyCeremony(r.PostForm.Get(passkeyField))
+	if err != nil {
+		s.serveLoginPage(w, r, form, "Your passkey was not used in time, please try again")
+		return nil
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(r.PostForm.Get(passkeyResponseField)))
+	if err != nil {
+		s.failLogin(w, r, form, nil, errInvalidPasskey)
+		return nil
+	}
+
+	found, credential, err := s.webauthn.ValidatePasskeyLogin(func(_, handle []byte) (webauthn.User, error) {
+		return s.Store.GetPasskeysByHandle(handle)
+	}, ceremony.Session, parsed)
+	if err != nil {
+		s.failLogin(w, r, form, nil, errInvalidPasskey)
+		return nil
+	}
+
+	passkeys := found.(*passkeyUser)
+
+	user, err := s.Store.GetUser(passkeys.Username)
+	if err != nil {
+		s.failLogin(w, r, form, nil, errInvalidPasskey)
+		return nil
+	}
+
+	if err = s.savePasskeyUse(passkeys, credential); err != nil {
+		s.failLogin(w, r, form, user, err)
+		return nil
+	}
+
+	return s.startPasswordlessSession(w, r, form, user, passkeyMethods(parsed)...)
+}
+
+// startPasswordlessSession logs in a user who proved who they are without their password. It stands in for the
+// password, so the account must be usable just the same.
+func (s *Server) startPasswordlessSession(w http.ResponseWriter, r *http.Request, form loginForm, user *samlidp.User, methods ...string) *saml.Session {
+	account, err := s.account(user.Name)
+	if err == nil {
+		err = account.check(saml.TimeNow(), s.passwordMaxAge())
+	}
+	if err != nil {
+		s.failLogin(w, r, form, user, err)
+		return nil
+	}
+
+	return s.startSession(w, r, user, []saml.Attribute{methodsAttribute(methods...)})
+}
+
+// verifyPasskey checks a passkey used as a second factor, which must be one of the user's own
+func (s *Server) verifyPasskey(passkeys *passkeyUser, session *webauthn.SessionData, response string) ([]string, error) {
+	if s.webauthn == nil || session == nil {
+		return nil, errInvalidPasskey
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(response))
+	if err != nil {
+		return nil, errInvalidPasskey
+	}
+
+	credential, err := s.webauthn.ValidateLogin(passkeys, *session, parsed)
+	if err != nil {
+		return nil, errInvalidPasskey
+	}
+
+	if err = s.savePasskeyUse(passkeys, credential); err != nil {
+		return nil, err
+	}
+
+	return []string{amrPassword, amrHardwareKey, amrMfa}, nil
+}
+
+func (s *Server) savePasskeyUse(passkeys *passkeyUser, credential *webauthn.Credential) error {
+	passkeys.updateCredential(credential)
+	return s.Store.AddPasskeys(passkeys)
+}
+
+// passkeyMethods describes the use of a passkey. Verifying the user, by a PIN or biometrics, makes it a second factor.
+func passkeyMethods(parsed *protocol.ParsedCredentialAssertionData) []string {
+	if parsed.Response.AuthenticatorData.Flags.HasUserVerified() {
+		return []string{amrHardwareKey, amrMfa}
+	}
+
+	return []string{amrHardwareKey}
+}
+
+// startPasskeyRegistration asks the browser to create a passkey for the user who is logged in
+func (s *Server) startPasskeyRegistration(c *gin.Context) {
+	passkeys, ok := s.accountPasskeys(c)
+	if !ok {
+		return
+	}
+
+	exclusions := webauthn.Credentials(passkeys.Credentials).CredentialDescriptors()
+
+	options, session, err := s.webauthn.BeginRegistration(passkeys, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := s.addPasskeyCeremony(passkeys.Username, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, passkeyStart{Token: token, Options: options})
+}
+
+// finishPasskeyRegistration saves the passkey that the browser created
+func (s *Server) finishPasskeyRegistration(c *gin.Context) {
+	passkeys, ok := s.accountPasskeys(c)
+	if !ok {
+		return
+	}
+
+	ceremony, err := s.passkeyCeremony(c.Param("token"))
+	if err != nil || ceremony.Username != passkeys.Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the passkey was not created in time, please try again"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	credential, err := s.webauthn.CreateCredential(passkeys, ceremony.Session, parsed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	passkeys.Credentials = append(passkeys.Credentials, *credential)
+
+	if err = s.Store.AddPasskeys(passkeys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"passkeys": len(passkeys.Credentials)})
+}
+
+// accountPasskeys returns the passkeys of the user who is logged in, who must be one of the Store's users
+func (s *Server) accountPasskeys(c *gin.Context) (*passkeyUser, bool) {
+	if s.webauthn == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+
+	session, err := s.cookieSession(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "log in to register a passkey"})
+		return nil, false
+	}
+
+	if _, err = s.Store.GetUser(session.UserName); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "passkeys cannot be registered for directory users"})
+		return nil, false
+	}
+
+	passkeys, err := s.passkeys(session.UserName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return passkeys, true
+}
+
+// secondFactorPasskeys returns the passkeys a user has to use after their password, if any
+func (s *Server) secondFactorPasskeys(name string) (*passkeyUser, error) {
+	if s.webauthn == nil || !s.config.Passkeys.SecondFactor {
+		return nil, nil
+	}
+
+	passkeys, err := s.Store.GetPasskeys(name)
+	if errors.Is(err, samlidp.ErrNotFound) || (err == nil && len(passkeys.Credentials) == 0) {
+		return nil, nil
+	}
+
+	return passkeys, err
+}
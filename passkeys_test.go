@@ -0,0 +1,289 @@
+package idp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "http://localhost:8080"
+
+// softwareAuthenticator creates and uses a single passkey, as a browser and its authenticator would
+type softwareAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	require.NoError(t, err)
+
+	return &softwareAuthenticator{t: t, key: key, credentialId: credentialId}
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *softwareAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, err := json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	require.NoError(a.t, err)
+
+	return data
+}
+
+// authenticatorData is the relying party's ID hash, the flags and the signature counter
+func (a *softwareAuthenticator) authenticatorData(rpId string, flags protocol.AuthenticatorFlags) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	a.signCount++
+
+	data := append(rpIdHash[:], byte(flags))
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+// create answers the options of a registration with an attestation of the "none" format
+func (a *softwareAuthenticator) create(options protocol.CredentialCreation) string {
+	a.userHandle = options.Response.User.ID.([]byte)
+
+	publicKey, err := webauthncbor.Marshal(map[int]any{
+		1:  2,  // EC2 key type
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(a.t, err)
+
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified | protocol.FlagAttestedCredentialData
+	authData := a.authenticatorData(options.Response.RelyingParty.ID, flags)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	require.NoError(a.t, err)
+
+	response, err := json.Marshal(map[string]any{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(a.clientData("webauthn.create", options.Response.Challenge.String())),
+			"attestationObject": encode(attestation),
+		},
+	})
+	require.NoError(a.t, err)
+
+	return string(response)
+}
+
+// get answers the options of a login by signing the challenge
+func (a *softwareAuthenticator) get(options protocol.CredentialAssertion) string {
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	authData := a.authenticatorData(options.Response.RelyingPartyID, flags)
+	clientData := a.clientData("webauthn.get", options.Response.Challenge.String())
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(a.t, err)
+
+	response, err := json.Marshal(map[string]any{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(a.userHandle),
+		},
+	})
+	require.NoError(a.t, err)
+
+	return string(response)
+}
+
+// withPasskeys enables passkeys with the default options
+func withPasskeys(config *Config) {
+	config.Passkeys = &PasskeyOptions{}
+}
+
+// loginCookies logs in with a password through the account page, returning the session cookie
+func loginCookies(t *testing.T, server *Server) []*http.Cookie {
+	w := serve(server, postForm(accountRoute, url.Values{"username": {"test"}, "password": {"test"}}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	return cookies
+}
+
+func withCookies(req *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// registerPasskey registers a passkey for the test user through the account page
+func registerPasskey(t *testing.T, server *Server) *softwareAuthenticator {
+	cookies := loginCookies(t, server)
+
+	w := serve(server, withCookies(httptest.NewRequest(http.MethodPost, accountPasskeysRoute, nil), cookies))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var start struct {
+		Token   string                      `json:"token"`
+		Options protocol.CredentialCreation `json:"options"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &start))
+
+	// User IDs arrive base64 encoded, as the browser would see them
+	id, err := base64.RawURLEncoding.DecodeString(start.Options.Response.User.ID.(string))
+	require.NoError(t, err)
+	start.Options.Response.User.ID = id
+
+	authenticator := newSoftwareAuthenticator(t)
+	body := authenticator.create(start.Options)
+
+	req := httptest.NewRequest(http.MethodPost, accountPasskeysRoute+"/"+start.Token, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	w = serve(server, withCookies(req, cookies))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	return authenticator
+}
+
+func TestPasskeys_Register(t *testing.T) {
+	server := newTestServer(t, withPasskeys)
+	registerPasskey(t, server)
+
+	passkeys, err := server.Store.GetPasskeys("test")
+	require.NoError(t, err)
+	assert.Len(t, passkeys.Credentials, 1)
+
+	// The account page needs a session to register passkeys for
+	w := serve(server, httptest.NewRequest(http.MethodPost, accountPasskeysRoute, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPasskeys_PasswordlessLogin(t *testing.T) {
+	server := newTestServer(t, withPasskeys)
+	authenticator := registerPasskey(t, server)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+authorizeParams().Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login with a passkey")
+
+	w = serve(server, httptest.NewRequest(http.MethodPost, passkeyLoginRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var start struct {
+		Token   string                       `json:"token"`
+		Options protocol.CredentialAssertion `json:"options"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &start))
+
+	form := authorizeParams()
+	form.Set(passkeyField, start.Token)
+	form.Set(passkeyResponseField, authenticator.get(start.Options))
+
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, "test", idToken.Subject)
+	assert.Equal(t, []string{amrHardwareKey, amrMfa}, idToken.AuthMethods)
+
+	// Ceremonies can only be completed once
+	form.Set(passkeyResponseField, authenticator.get(start.Options))
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "please try again")
+}
+
+func TestPasskeys_SecondFactor(t *testing.T) {
+	server := newTestServer(t, withPasskeys, func(config *Config) {
+		config.Passkeys.SecondFactor = true
+	})
+	authenticator := registerPasskey(t, server)
+
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `name="totp_code"`)
+
+	match := regexp.MustCompile(`submitPasskey\(this.form, ([^)]+)\)`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	var options protocol.CredentialAssertion
+	require.NoError(t, json.Unmarshal([]byte(html.UnescapeString(match[1])), &options))
+	require.Len(t, options.Response.AllowedCredentials, 1)
+
+	form = authorizeParams()
+	form.Set(mfaField, mfaToken(t, w))
+	form.Set(passkeyResponseField, newSoftwareAuthenticator(t).get(options))
+
+	// Only the user's own passkeys are accepted
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Your passkey was not recognised")
+
+	form.Set(passkeyResponseField, authenticator.get(options))
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+}
+
+func TestPasskeys_DeletedWithUser(t *testing.T) {
+	server := newTestServer(t, withPasskeys)
+	registerPasskey(t, server)
+
+	require.NoError(t, server.Store.DeleteUser("test"))
+
+	_, err := server.Store.GetPasskeys("test")
+	assert.Error(t, err)
+}
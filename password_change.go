@@ -0,0 +1,314 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	accountRoute = "/account"
+
+	passwordChangeField   = "password_change_token"
+	passwordChangeTimeout = 10 * time.Minute
+
+	defaultPasswordMinLength = 8
+)
+
+// passwordChange lets a user who logged in with an expired password choose a new one without logging in again
+type passwordChange struct {
+	Username   string    `json:"username"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+type PasswordPageData struct {
+	Title    string
+	Message  string
+	Errors   []string
+	Success  bool
+	Username string
+	Url      string
+	Fields   map[string]string
+	Rules    []string
+
+	// RequireCurrent asks for the current password, which is not needed right after logging in
+	RequireCurrent bool
+
+	// ReadOnly hides the form, for users whose password is kept elsewhere
+	ReadOnly bool
+
+	// Set on the account page if users can register passkeys, which is where registration starts
+	PasskeyUrl string
+	Passkeys   int
+
+	// Groups lists the groups that the session was resolved into at login, so that rules can be checked
+	Groups []string
+}
+
+func (s *Server) registerAccountRoutes(group *gin.RouterGroup) {
+	group.GET(accountRoute, s.serveAccount)
+	group.POST(accountRoute, s.serveAccount)
+}
+
+func (s *Server) passwordMaxAge() time.Duration {
+	return time.Duration(s.config.PasswordPolicy.MaxAge) * 24 * time.Hour
+}
+
+// passwordRules describes the password policy to users
+func (s *Server) passwordRules() []string {
+	policy := s.config.PasswordPolicy
+
+	rules := []string{fmt.Sprintf("At least %d characters", policy.MinLength)}
+	if policy.RequireUppercase {
+		rules = append(rules, "An uppercase letter")
+	}
+	if policy.RequireLowercase {
+		rules = append(rules, "A lowercase letter")
+	}
+	if policy.RequireDigit {
+		rules = append(rules, "A digit")
+	}
+	if policy.RequireSymbol {
+		rules = append(rules, "A symbol")
+	}
+	if policy.History > 0 {
+		rules = append(rules, fmt.Sprintf("Different from your last %d passwords", policy.History+1))
+	} else {
+		rules = append(rules, "Different from your current password")
+	}
+
+	return rules
+}
+
+// checkNewPassword returns the ways in which the password breaks the policy
+func (s *Server) checkNewPassword(user *samlidp.User, account *Account, password, confirmation string) []string {
+	policy := s.config.PasswordPolicy
+
+	var problems []string
+	if password != confirmation {
+		problems = append(problems, "The passwords do not match")
+	}
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("Use at least %d characters", policy.MinLength))
+	}
+	if policy.RequireUppercase && !strings.ContainsFunc(password, unicode.IsUpper) {
+		problems = append(problems, "Use an uppercase letter")
+	}
+	if policy.RequireLowercase && !strings.ContainsFunc(password, unicode.IsLower) {
+		problems = append(problems, "Use a lowercase letter")
+	}
+	if policy.RequireDigit && !strings.ContainsFunc(password, unicode.IsDigit) {
+		problems = append(problems, "Use a digit")
+	}
+	if policy.RequireSymbol && !strings.ContainsFunc(password, isSymbol) {
+		problems = append(problems, "Use a symbol")
+	}
+
+	for _, hash := range append([][]byte{user.HashedPassword}, account.PasswordHistory...) {
+		if verifyPassword(hash, password) {
+			problems = append(problems, "Choose a password you have not used before")
+			break
+		}
+	}
+
+	return problems
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+}
+
+// changePassword replaces the user's password, keeping the previous one in their history
+func (s *Server) changePassword(user *samlidp.User, account *Account, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), s.config.BcryptCost)
+	if err != nil {
+		return err
+	}
+
+	history := append([][]byte{user.HashedPassword}, account.PasswordHistory...)
+	account.PasswordHistory = history[:min(len(history), s.config.PasswordPolicy.History)]
+	if len(account.PasswordHistory) == 0 {
+		account.PasswordHistory = nil
+	}
+
+	account.MustChangePassword = false
+	account.PasswordChangedAt = saml.TimeNow()
+	if account.Status == accountPasswordExpired {
+		account.Status = accountActive
+	}
+
+	user.HashedPassword = hashedPassword
+	if err = s.Store.UpdateUser(user.Name, user); err != nil {
+		return err
+	}
+
+	return s.Store.AddAccount(account)
+}
+
+// startPasswordChange asks a user to choose a new password before their login completes. The page posts back to
+// where the login form did, carrying a token in place of the credentials that were already checked.
+func (s *Server) startPasswordChange(w http.ResponseWriter, form loginForm, user *samlidp.User, reason string) {
+	token := uuid.NewString()
+
+	err := s.Store.AddPasswordChange(token, &passwordChange{
+		Username:   user.Name,
+		ExpireTime: saml.TimeNow().Add(passwordChangeTimeout),
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	s.servePasswordPage(w, PasswordPageData{
+		Title:    "Change Password",
+		Message:  reason,
+		Username: user.Name,
+		Url:      form.Url,
+		Fields:   passwordChangeFields(form, token),
+		Rules:    s.passwordRules(),
+	})
+}
+
+// resolvePasswordChange completes a login once the user has chosen a new password that follows the policy
+func (s *Server) resolvePasswordChange(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	token := r.PostForm.Get(passwordChangeField)
+
+	change, err := s.Store.GetPasswordChange(token)
+	if err != nil || saml.TimeNow().After(change.ExpireTime) {
+		s.serveLoginPage(w, r, form, "Your password was not changed in time, please log in again")
+		return nil
+	}
+
+	user, err := s.Store.GetUser(change.Username)
+	if err != nil {
+		s.serveLoginPage(w, r, form, "")
+		return nil
+	}
+
+	account, err := s.account(user.Name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	password := r.PostForm.Get("new_password")
+
+	if problems := s.checkNewPassword(user, account, password, r.PostForm.Get("confirm_password")); len(problems) > 0 {
+		s.servePasswordPage(w, PasswordPageData{
+			Title:    "Change Password",
+			Errors:   problems,
+			Username: user.Name,
+			Url:      form.Url,
+			Fields:   passwordChangeFields(form, token),
+			Rules:    s.passwordRules(),
+		})
+		return nil
+	}
+
+	if err = s.changePassword(user, account, password); err != nil {
+		log.Error().Err(err).Msg("error changing password")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	_ = s.Store.DeletePasswordChange(token)
+
+	return s.completeLogin(w, r, form, user, nil)
+}
+
+func passwordChangeFields(form loginForm, token string) map[string]string {
+	fields := maps.Clone(form.Fields)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields[passwordChangeField] = token
+
+	return fields
+}
+
+// serveAccount lets users that are logged in change their password and register passkeys
+func (s *Server) serveAccount(c *gin.Context) {
+	r := c.Request
+	_ = r.ParseForm()
+
+	form := loginForm{Url: s.endpointUrl(accountRoute), Fields: map[string]string{}}
+
+	session := s.resolveSession(c.Writer, r, form)
+	if session == nil {
+		return
+	}
+
+	data := PasswordPageData{
+		Title:          "Account",
+		Username:       session.UserName,
+		Url:            form.Url,
+		Rules:          s.passwordRules(),
+		RequireCurrent: true,
+		Groups:         session.Groups,
+	}
+
+	user, err := s.Store.GetUser(session.UserName)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		data.Message = "Your password is managed by your directory"
+		data.ReadOnly = true
+		s.servePasswordPage(c.Writer, data)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if s.webauthn != nil {
+		passkeys, err := s.passkeys(user.Name)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		data.PasskeyUrl = s.endpointUrl(accountPasskeysRoute)
+		data.Passkeys = len(passkeys.Credentials)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get("new_password") != "" {
+		account, err := s.account(user.Name)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		password := r.PostForm.Get("new_password")
+
+		if !verifyPassword(user.HashedPassword, r.PostForm.Get("current_password")) {
+			data.Errors = []string{"Your current password is incorrect"}
+		} else if data.Errors = s.checkNewPassword(user, account, password, r.PostForm.Get("confirm_password")); len(data.Errors) == 0 {
+			if err = s.changePassword(user, account, password); err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			data.Success = true
+		}
+	}
+
+	s.servePasswordPage(c.Writer, data)
+}
+
+func (s *Server) servePasswordPage(w http.ResponseWriter, data PasswordPageData) {
+	render := s.router.HTMLRender.Instance("password.html", data)
+
+	err := render.Render(w)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,188 @@
+package idp
+
+import (
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// passwordChangeToken returns the token carried by a password change page
+func passwordChangeToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	match := regexp.MustCompile(`name="` + passwordChangeField + `" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	return match[1]
+}
+
+func changePasswordForm(token, password, confirmation string) url.Values {
+	form := authorizeParams()
+	form.Set(passwordChangeField, token)
+	form.Set("new_password", password)
+	form.Set("confirm_password", confirmation)
+
+	return form
+}
+
+func TestPasswordChange_Forced(t *testing.T) {
+	server := newTestServer(t, withAccountStates, func(config *Config) {
+		config.Users = append(config.Users, User{Username: "new", Password: "test", MustChangePassword: true})
+	})
+
+	for _, username := range []string{"expired-password", "new"} {
+		form := authorizeParams()
+		form.Set("username", username)
+		form.Set("password", "test")
+
+		w := serve(server, postForm(authorizeRoute, form))
+		require.Equal(t, http.StatusOK, w.Code)
+		token := passwordChangeToken(t, w)
+
+		// Passwords that break the policy are refused without losing the login
+		w = serve(server, postForm(authorizeRoute, changePasswordForm(token, "short", "short")))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Use at least 8 characters")
+
+		w = serve(server, postForm(authorizeRoute, changePasswordForm(token, "long enough", "different")))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "The passwords do not match")
+
+		w = serve(server, postForm(authorizeRoute, changePasswordForm(token, "long enough", "long enough")))
+		require.Equal(t, http.StatusFound, w.Code, username)
+		assert.NotEmpty(t, w.Result().Cookies())
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.NotEmpty(t, location.Query().Get("code"))
+
+		_, _, err = server.authenticate(username, "long enough", "")
+		require.NoError(t, err, username)
+
+		// The token can only be used once
+		w = serve(server, postForm(authorizeRoute, changePasswordForm(token, "another one", "another one")))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "please log in again")
+	}
+}
+
+func TestPasswordChange_Timeout(t *testing.T) {
+	now := time.Now()
+	saml.TimeNow = func() time.Time { return now }
+	t.Cleanup(func() { saml.TimeNow = time.Now })
+
+	server := newTestServer(t, withAccountStates)
+
+	form := authorizeParams()
+	form.Set("username", "expired-password")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	token := passwordChangeToken(t, w)
+
+	now = now.Add(passwordChangeTimeout + time.Minute)
+
+	w = serve(server, postForm(authorizeRoute, changePasswordForm(token, "long enough", "long enough")))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "please log in again")
+}
+
+func TestPasswordChange_Policy(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.PasswordPolicy = PasswordPolicyOptions{
+			MinLength:        4,
+			RequireUppercase: true,
+			RequireLowercase: true,
+			RequireDigit:     true,
+			RequireSymbol:    true,
+			History:          2,
+		}
+	})
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+	account, err := server.account("test")
+	require.NoError(t, err)
+
+	assert.Len(t, server.checkNewPassword(user, account, "abcd", "abcd"), 3)
+	assert.Empty(t, server.checkNewPassword(user, account, "Ab1!", "Ab1!"))
+	assert.NotEmpty(t, server.checkNewPassword(user, account, "test", "test"))
+
+	for _, password := range []string{"First1!", "Second2!", "Third3!"} {
+		require.NoError(t, server.changePassword(user, account, password))
+	}
+
+	// The last two passwords are remembered along with the current one
+	assert.NotEmpty(t, server.checkNewPassword(user, account, "First1!", "First1!"))
+	assert.NotEmpty(t, server.checkNewPassword(user, account, "Second2!", "Second2!"))
+	assert.NotEmpty(t, server.checkNewPassword(user, account, "Third3!", "Third3!"))
+	assert.Empty(t, server.checkNewPassword(user, account, "Fourth4!", "Fourth4!"))
+
+	stored, err := server.Store.GetAccount("test")
+	require.NoError(t, err)
+	assert.Len(t, stored.PasswordHistory, 2)
+	assert.False(t, stored.PasswordChangedAt.IsZero())
+}
+
+func TestPasswordChange_MaxAge(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.PasswordPolicy.MaxAge = 90
+		config.Users = append(config.Users,
+			User{Username: "old", Password: "test", PasswordChangedAt: "2000-01-01"},
+			User{Username: "recent", Password: "test", PasswordChangedAt: time.Now().Format(time.RFC3339)},
+		)
+	})
+
+	_, _, err := server.authenticate("old", "test", "")
+	assert.ErrorIs(t, err, errPasswordExpired)
+
+	_, _, err = server.authenticate("recent", "test", "")
+	assert.NoError(t, err)
+
+	// Passwords of unknown age never expire
+	_, _, err = server.authenticate("test", "test", "")
+	assert.NoError(t, err)
+}
+
+func TestPasswordChange_AccountPage(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, accountRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `name="password"`)
+
+	form := url.Values{"username": {"test"}, "password": {"test"}}
+	w = serve(server, postForm(accountRoute, form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `name="current_password"`)
+
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	change := func(current string) *httptest.ResponseRecorder {
+		req := postForm(accountRoute, url.Values{
+			"current_password": {current},
+			"new_password":     {"long enough"},
+			"confirm_password": {"long enough"},
+		})
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return serve(server, req)
+	}
+
+	w = change("wrong")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Your current password is incorrect")
+
+	w = change("test")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Your password was changed successfully")
+
+	_, _, err := server.authenticate("test", "long enough", "")
+	require.NoError(t, err)
+}
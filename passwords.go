@@ -0,0 +1,229 @@
+package idp
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/GehirnInc/crypt"
+	"github.com/GehirnInc/crypt/apr1_crypt"
+	"github.com/GehirnInc/crypt/md5_crypt"
+	"github.com/GehirnInc/crypt/sha256_crypt"
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"hash"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errUnsupportedHash = errors.New("unsupported password hash, expected bcrypt, argon2id, PBKDF2, SHA-crypt or MD5-crypt")
+
+// Password hashes are recognised by their prefix, following the formats used by crypt(3), passlib and Django
+var cryptPrefixes = map[string]func() crypt.Crypter{
+	"$5$":    sha256_crypt.New,
+	"$6$":    sha512_crypt.New,
+	"$1$":    md5_crypt.New,
+	"$apr1$": apr1_crypt.New,
+}
+
+type pbkdf2Hash struct {
+	digest     func() hash.Hash
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// checkPasswordHash reports whether the hash is in a format that verifyPassword understands
+func checkPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2Hash(hash)
+		return err
+	case isPbkdf2Hash(hash):
+		_, err := parsePbkdf2Hash(hash)
+		return err
+	}
+
+	if crypter := cryptFromHash(hash); crypter != nil {
+		_, err := crypter.Cost(hash)
+		return err
+	}
+
+	return errUnsupportedHash
+}
+
+// verifyPassword compares a password with a hash in any of the formats accepted by checkPasswordHash
+func verifyPassword(hashedPassword []byte, password string) bool {
+	hash := string(hashedPassword)
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		parsed, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+
+		key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(key, parsed.key) == 1
+	case isPbkdf2Hash(hash):
+		parsed, err := parsePbkdf2Hash(hash)
+		if err != nil {
+			return false
+		}
+
+		key, err := pbkdf2.Key(parsed.digest, password, parsed.salt, parsed.iterations, len(parsed.key))
+		return err == nil && subtle.ConstantTimeCompare(key, parsed.key) == 1
+	}
+
+	if crypter := cryptFromHash(hash); crypter != nil {
+		return crypter.Verify(hash, []byte(password)) == nil
+	}
+
+	return false
+}
+
+func cryptFromHash(hash string) crypt.Crypter {
+	for prefix, newCrypter := range cryptPrefixes {
+		if strings.HasPrefix(hash, prefix) {
+			return newCrypter()
+		}
+	}
+
+	return nil
+}
+
+// parseArgon2Hash parses the PHC string format, e.g. "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>"
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, errors.New("malformed argon2id hash")
+	}
+
+	parsed := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	// argon2 panics rather than failing on parameters it cannot use, and needs at least 8 KiB of memory per thread
+	if parsed.time < 1 || parsed.threads < 1 || parsed.memory < 8*uint32(parsed.threads) {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+
+	return parsed, nil
+}
+
+func isPbkdf2Hash(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2") || strings.HasPrefix(hash, "pbkdf2_")
+}
+
+// parsePbkdf2Hash parses both the passlib format, e.g. "$pbkdf2-sha256$29000$<salt>$<key>" using passlib's
+// variant of base64, and the Django format, e.g. "pbkdf2_sha256$600000$<salt>$<key>" with a plain text salt
+func parsePbkdf2Hash(hash string) (*pbkdf2Hash, error) {
+	passlib := strings.HasPrefix(hash, "$")
+
+	parts := strings.Split(strings.TrimPrefix(hash, "$"), "$")
+	if len(parts) != 4 {
+		return nil, errors.New("malformed PBKDF2 hash")
+	}
+
+	parsed := &pbkdf2Hash{}
+
+	switch strings.TrimLeft(strings.TrimPrefix(parts[0], "pbkdf2"), "-_") {
+	case "", "sha1":
+		parsed.digest = sha1.New
+	case "sha256":
+		parsed.digest = sha256.New
+	case "sha512":
+		parsed.digest = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 digest %q", parts[0])
+	}
+
+	var err error
+	if parsed.iterations, err = strconv.Atoi(parts[1]); err != nil || parsed.iterations < 1 {
+		return nil, errors.New("malformed PBKDF2 iterations")
+	}
+
+	if passlib {
+		// passlib uses "." instead of "+" and omits padding
+		encoding := base64.RawStdEncoding
+		if parsed.salt, err = encoding.DecodeString(strings.ReplaceAll(parts[2], ".", "+")); err != nil {
+			return nil, fmt.Errorf("malformed PBKDF2 salt: %w", err)
+		}
+		if parsed.key, err = encoding.DecodeString(strings.ReplaceAll(parts[3], ".", "+")); err != nil {
+			return nil, fmt.Errorf("malformed PBKDF2 key: %w", err)
+		}
+	} else {
+		parsed.salt = []byte(parts[2])
+		if parsed.key, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+			return nil, fmt.Errorf("malformed PBKDF2 key: %w", err)
+		}
+	}
+
+	return parsed, nil
+}
+
+// hashPasswords hashes the passwords of users that do not have a password hash, spreading the work over every CPU.
+// The hashes are returned in the same order as the users.
+func hashPasswords(users []User, cost int) ([][]byte, error) {
+	hashes := make([][]byte, len(users))
+	errs := make([]error, len(users))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for range runtime.NumCPU() {
+		wg.Go(func() {
+			for i := range indexes {
+				if users[i].PasswordHash != "" {
+					hashes[i] = []byte(users[i].PasswordHash)
+					continue
+				}
+
+				hashes[i], errs[i] = bcrypt.GenerateFromPassword([]byte(users[i].Password), cost)
+			}
+		})
+	}
+
+	for i := range users {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error hashing password for %s: %w", users[i].Username, err)
+		}
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,78 @@
+package idp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	salt := []byte("somesaltsomesalt")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)))
+
+	tests := []struct {
+		hash     string
+		password string
+	}{
+		{string(bcryptHash), "secret"},
+		{argon2Hash, "secret"},
+		{"$pbkdf2-sha256$6400$66UI/S.nXIk8jcbdHx3Fhg$wgfoKHd15bqHq4tu481H6GsuOVCDo1xP7VS25w7e.i8", "password"},
+		{"$pbkdf2-sha512$1000$66UI/S.nXIk8jcbdHx3Fhg$OLqIWrkGSISXWkMXzc1X/jw.fEC410APGBe5R3nb/mVoYj4GTGBgwguA7RAHe4eFZWihQ6x0RbgVFFy85WXBPQ", "password"},
+		{"pbkdf2_sha256$1000$seasalt$YIWkt6M1JFXrHg5s0jZjBSc7C2Cz6QvchSJ0h8Y+i7c=", "password"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.hash[:8], func(t *testing.T) {
+			require.NoError(t, checkPasswordHash(test.hash))
+			assert.True(t, verifyPassword([]byte(test.hash), test.password))
+			assert.False(t, verifyPassword([]byte(test.hash), "wrong"))
+		})
+	}
+}
+
+func TestCheckPasswordHash_Unsupported(t *testing.T) {
+	require.ErrorIs(t, checkPasswordHash("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="), errUnsupportedHash)
+	require.Error(t, checkPasswordHash("$argon2id$v=19$m=1024$salt"))
+	for _, parameters := range []string{"m=65536,t=1,p=0", "m=65536,t=0,p=1", "m=7,t=1,p=1", "m=16,t=1,p=4"} {
+		hash := "$argon2id$v=19$" + parameters + "$c2FsdHNhbHQ$a2V5a2V5"
+		require.ErrorContains(t, checkPasswordHash(hash), "invalid argon2id parameters", parameters)
+		assert.False(t, verifyPassword([]byte(hash), "secret"))
+	}
+	require.Error(t, checkPasswordHash("$pbkdf2-md5$1000$salt$key"))
+	assert.False(t, verifyPassword([]byte("plain"), "plain"))
+}
+
+func TestLoadUsers_PasswordHash(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.BcryptCost = bcrypt.MinCost
+		config.Users = append(config.Users, User{
+			Username:     "hashed",
+			PasswordHash: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		})
+	})
+
+	_, _, err := server.authenticate("hashed", "Hello world!", "")
+	require.NoError(t, err)
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+
+	cost, err := bcrypt.Cost(user.HashedPassword)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost, cost)
+
+	err = server.LoadUsers([]User{{Username: "broken", PasswordHash: "{SSHA}abc"}})
+	require.ErrorIs(t, err, errUnsupportedHash)
+}
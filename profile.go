@@ -0,0 +1,168 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"slices"
+	"strings"
+)
+
+// profileFields are the optional user fields that the create user form accepts, named as in the configuration
+var profileFields = []string{
+	"common_name", "display_name", "scoped_affiliation", "phone", "title", "department", "organization",
+	"employee_number", "manager", "locale", "timezone",
+}
+
+// Profile holds the standard profile fields and service overrides of a user, which samlidp.User has no room for
+type Profile struct {
+	Username       string `json:"username"`
+	DisplayName    string `json:"display_name,omitempty"`
+	Phone          string `json:"phone,omitempty"`
+	Title          string `json:"title,omitempty"`
+	Department     string `json:"department,omitempty"`
+	Organization   string `json:"organization,omitempty"`
+	EmployeeNumber string `json:"employee_number,omitempty"`
+	Manager        string `json:"manager,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+	Timezone       string `json:"timezone,omitempty"`
+
+	Overrides []ServiceOverride `json:"overrides,omitempty"`
+}
+
+// profileAttribute is how a profile field is released: by its inetOrgPerson or eduPerson OID in SAML assertions,
+// and by its claim URI in WS-Federation tokens
+type profileAttribute struct {
+	oid          string
+	friendlyName string
+	claim        string
+	displayName  string
+	value        func(*Profile) string
+}
+
+// profileAttributes follow the claim URIs of Azure AD, which uses its own attribute names where AD FS defines none.
+// There is no standard attribute for time zones, so the OpenID Connect claim name is used.
+var profileAttributes = []profileAttribute{
+	{"2.16.840.1.113730.3.1.241", "displayName", "http://schemas.microsoft.com/identity/claims/displayname", "Display Name", func(p *Profile) string { return p.DisplayName }},
+	{"2.5.4.20", "telephoneNumber", claimsNamespace + "/otherphone", "Other Phone", func(p *Profile) string { return p.Phone }},
+	{"2.5.4.12", "title", claimsNamespace + "/jobtitle", "Job Title", func(p *Profile) string { return p.Title }},
+	{"2.5.4.11", "ou", claimsNamespace + "/department", "Department", func(p *Profile) string { return p.Department }},
+	{"2.5.4.10", "o", claimsNamespace + "/companyname", "Company Name", func(p *Profile) string { return p.Organization }},
+	{"2.16.840.1.113730.3.1.3", "employeeNumber", claimsNamespace + "/employeeid", "Employee ID", func(p *Profile) string { return p.EmployeeNumber }},
+	{"0.9.2342.19200300.100.1.10", "manager", claimsNamespace + "/manager", "Manager", func(p *Profile) string { return p.Manager }},
+	{"2.16.840.1.113730.3.1.39", "preferredLanguage", claimsNamespace + "/preferredlanguage", "Preferred Language", func(p *Profile) string { return p.Locale }},
+	{"", "zoneinfo", claimsNamespace + "/timezone", "Time Zone", func(p *Profile) string { return p.Timezone }},
+}
+
+var errInvalidScopedAffiliation = errors.New("invalid scoped_affiliation")
+
+func newProfile(user User) *Profile {
+	return &Profile{
+		Username:       user.Username,
+		DisplayName:    user.DisplayName,
+		Phone:          user.Phone,
+		Title:          user.Title,
+		Department:     user.Department,
+		Organization:   user.Organization,
+		EmployeeNumber: user.EmployeeNumber,
+		Manager:        user.Manager,
+		Locale:         user.Locale,
+		Timezone:       user.Timezone,
+		Overrides:      user.Overrides,
+	}
+}
+
+// isEmpty reports whether none of the profile's fields are set and it has no overrides
+func (p *Profile) isEmpty() bool {
+	return len(p.Overrides) == 0 && !slices.ContainsFunc(profileAttributes, func(attribute profileAttribute) bool {
+		return attribute.value(p) != ""
+	})
+}
+
+// attributes returns the session attributes of the profile's fields that are set
+func (p *Profile) attributes() []saml.Attribute {
+	var attributes []saml.Attribute
+	for _, attribute := range profileAttributes {
+		value := attribute.value(p)
+		if value == "" {
+			continue
+		}
+
+		if attribute.oid == "" {
+			attributes = append(attributes, stringAttribute(attribute.friendlyName, value))
+			continue
+		}
+
+		attributes = append(attributes, saml.Attribute{
+			FriendlyName: attribute.friendlyName,
+			Name:         "urn:oid:" + attribute.oid,
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: value}},
+		})
+	}
+
+	return attributes
+}
+
+// checkScopedAffiliation ensures that an eduPersonScopedAffiliation is an affiliation and a scope, as in
+// "member@example.com"
+func checkScopedAffiliation(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	affiliation, scope, ok := strings.Cut(value, "@")
+	if !ok || affiliation == "" || scope == "" || strings.Contains(scope, "@") {
+		return fmt.Errorf("%w %q", errInvalidScopedAffiliation, value)
+	}
+
+	return nil
+}
+
+// loadProfile saves the profile of a configured user, removing any that is left over from before if it has no fields
+func (s *Server) loadProfile(user User) error {
+	profile := newProfile(user)
+	if profile.isEmpty() {
+		return s.Store.DeleteProfile(user.Username)
+	}
+
+	return s.Store.AddProfile(profile)
+}
+
+// profile returns the profile of the named user, which has no fields set if nothing has been recorded about it
+func (s *Server) profile(name string) (*Profile, error) {
+	profile, err := s.Store.GetProfile(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return &Profile{Username: name}, nil
+	}
+
+	return profile, err
+}
+
+// sessionAttribute returns the first value of the session's custom attribute with the friendly name
+func sessionAttribute(session *saml.Session, friendlyName string) string {
+	for _, attribute := range session.CustomAttributes {
+		if attribute.FriendlyName == friendlyName && len(attribute.Values) > 0 {
+			return attribute.Values[0].Value
+		}
+	}
+
+	return ""
+}
+
+// profileClaims returns the WS-Federation claims of the profile attributes in the session
+func profileClaims(session *saml.Session) []wsFedClaim {
+	var claims []wsFedClaim
+	for _, attribute := range profileAttributes {
+		i := strings.LastIndex(attribute.claim, "/")
+		claims = append(claims, wsFedClaim{
+			Namespace:   attribute.claim[:i],
+			Name:        attribute.claim[i+1:],
+			DisplayName: attribute.displayName,
+			Values:      nonEmpty(sessionAttribute(session, attribute.friendlyName)),
+		})
+	}
+
+	return claims
+}
@@ -0,0 +1,147 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func profileTestServer(t *testing.T) *Server {
+	return newTestServer(t, func(config *Config) {
+		user := &config.Users[0]
+		user.CommonName = "Test User"
+		user.DisplayName = "Tester"
+		user.ScopedAffiliation = "member@test.com"
+		user.Phone = "+1 555 0100"
+		user.Title = "QA Engineer"
+		user.Department = "Quality"
+		user.Organization = "Test Corp"
+		user.EmployeeNumber = "E-1001"
+		user.Manager = "boss"
+		user.Locale = "en-GB"
+		user.Timezone = "Europe/London"
+	})
+}
+
+func TestProfile_Saml(t *testing.T) {
+	server := profileTestServer(t)
+
+	attributes := assertionAttributes(t, server)
+
+	expected := map[string]string{
+		"cn":                "Test User",
+		"scopedAffiliation": "member@test.com",
+		"displayName":       "Tester",
+		"telephoneNumber":   "+1 555 0100",
+		"title":             "QA Engineer",
+		"ou":                "Quality",
+		"o":                 "Test Corp",
+		"employeeNumber":    "E-1001",
+		"manager":           "boss",
+		"preferredLanguage": "en-GB",
+		"zoneinfo":          "Europe/London",
+	}
+	for name, value := range expected {
+		assert.Equal(t, []string{value}, attributeValues(attributes[name]), name)
+	}
+
+	assert.Equal(t, "urn:oid:2.16.840.1.113730.3.1.241", attributes["displayName"].Name)
+	assert.Equal(t, "urn:oid:1.3.6.1.4.1.5923.1.1.1.9", attributes["scopedAffiliation"].Name)
+}
+
+func TestProfile_WsFedAndOidc(t *testing.T) {
+	server := profileTestServer(t)
+
+	rstr := signInWsFed(t, server, testEntityId+"-saml11")
+	title := rstr.FindElement(`.//Attribute[@AttributeName='jobtitle']`)
+	require.NotNil(t, title)
+	assert.Equal(t, claimsNamespace, title.SelectAttrValue("AttributeNamespace", ""))
+	assert.Equal(t, "QA Engineer", title.FindElement("./AttributeValue").Text())
+	assert.NotNil(t, rstr.FindElement(`.//Attribute[@AttributeName='CommonName']`))
+
+	form := authorizeParams()
+	form.Set("scope", "openid profile phone")
+	form.Set("username", "test")
+	form.Set("password", "test")
+
+	w := serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	w = exchangeCode(server, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	key, err := server.signingKey()
+	require.NoError(t, err)
+
+	idToken := &idTokenClaims{}
+	_, err = verifyJwt(&key.PublicKey, tokens.IdToken, idToken)
+	require.NoError(t, err)
+	assert.Equal(t, "Tester", idToken.Name)
+	assert.Equal(t, "+1 555 0100", idToken.PhoneNumber)
+	assert.Equal(t, "en-GB", idToken.Locale)
+	assert.Equal(t, "Europe/London", idToken.Zoneinfo)
+	assert.Empty(t, idToken.Email)
+}
+
+func TestProfile_LoadUsers(t *testing.T) {
+	server := profileTestServer(t)
+
+	profile, err := server.Store.GetProfile("test")
+	require.NoError(t, err)
+	assert.Equal(t, "Quality", profile.Department)
+
+	// Reloading the user without profile fields removes their profile
+	require.NoError(t, server.LoadUsers([]User{{Username: "test", Email: "test@test.com", Password: "test"}}))
+	_, err = server.Store.GetProfile("test")
+	assert.Error(t, err)
+
+	err = server.LoadUsers([]User{{Username: "bad", Email: "bad@test.com", Password: "test", ScopedAffiliation: "member"}})
+	assert.ErrorIs(t, err, errInvalidScopedAffiliation)
+}
+
+func TestProfile_CreateUserPage(t *testing.T) {
+	server := newTestServer(t)
+
+	form := url.Values{
+		"username":           {"someone"},
+		"email":              {"someone@test.com"},
+		"first_name":         {"Some"},
+		"last_name":          {"One"},
+		"password":           {"secret"},
+		"common_name":        {"Some One"},
+		"scoped_affiliation": {"staff"},
+		"title":              {"Manager"},
+	}
+
+	w := serve(server, postForm("/users/create", form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Scoped Affiliation must look like member@example.com")
+	assert.Contains(t, w.Body.String(), `value="Manager"`)
+
+	form.Set("scoped_affiliation", "staff@test.com")
+	w = serve(server, postForm("/users/create", form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	user, err := server.Store.GetUser("someone")
+	require.NoError(t, err)
+	assert.Equal(t, "Some One", user.CommonName)
+	assert.Equal(t, "staff@test.com", user.ScopedAffiliation)
+
+	profile, err := server.Store.GetProfile("someone")
+	require.NoError(t, err)
+	assert.Equal(t, "Manager", profile.Title)
+
+	// Profiles go with their user
+	require.NoError(t, server.Store.DeleteUser("someone"))
+	_, err = server.Store.GetProfile("someone")
+	assert.Error(t, err)
+}
@@ -0,0 +1,398 @@
+package idp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	provisioningRoute = "/provisioning"
+
+	provisioningTimeout   = 10 * time.Second
+	provisioningQueueSize = 1000
+
+	deprovisionDelete     = "delete"
+	deprovisionDeactivate = "deactivate"
+)
+
+// SyncStatus records the outcome of the last attempt to provision a user into a service
+type SyncStatus struct {
+	Service   string    `json:"service"`
+	Username  string    `json:"username"`
+	RemoteId  string    `json:"remote_id,omitempty"`
+	Operation string    `json:"operation"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type provisioningJob struct {
+	service Service
+	user    *samlidp.User
+	name    string
+
+	// previousName is set when the user was renamed, so that the service updates the user it already has
+	previousName string
+}
+
+// provisioner pushes user changes to the SCIM endpoints of services, in the order they happened
+type provisioner struct {
+	store    *Store
+	client   *http.Client
+	services []Service
+	jobs     chan provisioningJob
+	pending  sync.WaitGroup
+}
+
+type scimRemoteError struct {
+	status int
+	body   string
+}
+
+func (e *scimRemoteError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.status, e.body)
+}
+
+func newProvisioner(store *Store, services []Service) *provisioner {
+	p := &provisioner{
+		store:  store,
+		client: &http.Client{Timeout: provisioningTimeout},
+		jobs:   make(chan provisioningJob, provisioningQueueSize),
+	}
+
+	for _, service := range services {
+		if service.Scim != nil && service.Scim.BaseUrl != "" {
+			p.services = append(p.services, service)
+		}
+	}
+
+	go p.run()
+
+	return p
+}
+
+func (p *provisioner) UserSaved(user samlidp.User) {
+	for _, service := range p.services {
+		p.enqueue(provisioningJob{service: service, user: &user, name: user.Name})
+	}
+}
+
+func (p *provisioner) UserRenamed(name string, user samlidp.User) {
+	for _, service := range p.services {
+		p.enqueue(provisioningJob{service: service, user: &user, name: user.Name, previousName: name})
+	}
+}
+
+func (p *provisioner) UserDeleted(name string) {
+	for _, service := range p.services {
+		p.enqueue(provisioningJob{service: service, name: name})
+	}
+}
+
+func (p *provisioner) enqueue(job provisioningJob) {
+	p.pending.Add(1)
+	p.jobs <- job
+}
+
+// wait blocks until every queued change has been pushed
+func (p *provisioner) wait() {
+	p.pending.Wait()
+}
+
+func (p *provisioner) run() {
+	for job := range p.jobs {
+		p.process(job)
+		p.pending.Done()
+	}
+}
+
+func (p *provisioner) process(job provisioningJob) {
+	// Changes queued for a service that has since been removed are dropped
+	if _, err := p.store.GetServiceProvider(job.service.EntityId); errors.Is(err, samlidp.ErrNotFound) {
+		return
+	}
+
+	status := &SyncStatus{
+		Service:  job.service.EntityId,
+		Username: job.name,
+	}
+
+	// Renamed users keep their remote id, and are looked up by their previous name if it is not known
+	known := withDefault(job.previousName, job.name)
+	if previous, err := p.store.GetSyncStatus(job.service.EntityId, known); err == nil {
+		status.RemoteId = previous.RemoteId
+	}
+
+	var err error
+	if status.RemoteId == "" && job.previousName != "" {
+		status.RemoteId, err = p.findRemoteUser(job.service, job.previousName)
+	}
+
+	if err == nil && job.user != nil {
+		err = p.push(job.service, job.user, status)
+	} else if err == nil {
+		err = p.deprovision(job.service, status)
+	}
+
+	if err == nil && job.previousName != "" {
+		if err := p.store.DeleteSyncStatus(job.service.EntityId, job.previousName); err != nil {
+			log.Error().Err(err).Msg("error deleting SCIM provisioning status")
+		}
+	}
+
+	status.Success = err == nil
+	status.Time = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+		log.Warn().Err(err).Str("service", status.Service).Str("username", status.Username).Msg("SCIM provisioning failed")
+	}
+
+	if err = p.store.AddSyncStatus(status); err != nil {
+		log.Error().Err(err).Msg("error saving SCIM provisioning status")
+	}
+}
+
+func (p *provisioner) push(service Service, user *samlidp.User, status *SyncStatus) error {
+	body := outboundScimUser(user, service.Scim.AttributeMapping)
+
+	if status.RemoteId == "" {
+		remoteId, err := p.findRemoteUser(service, user.Name)
+		if err != nil {
+			return err
+		}
+		status.RemoteId = remoteId
+	}
+
+	if status.RemoteId != "" {
+		status.Operation = "update"
+
+		// Services whose ids are derived from the username may give a renamed user a new one
+		var updated scimUser
+		err := p.request(service, http.MethodPut, "/Users/"+url.PathEscape(status.RemoteId), body, &updated)
+		if err == nil && updated.Id != "" {
+			status.RemoteId = updated.Id
+		}
+		if remoteErr, ok := err.(*scimRemoteError); !ok || remoteErr.status != http.StatusNotFound {
+			return err
+		}
+
+		// The user was removed from the service behind our back, so it is recreated
+	}
+
+	status.Operation = "create"
+
+	var created scimUser
+	if err := p.request(service, http.MethodPost, "/Users", body, &created); err != nil {
+		return err
+	}
+	status.RemoteId = created.Id
+
+	return nil
+}
+
+func (p *provisioner) deprovision(service Service, status *SyncStatus) error {
+	if status.RemoteId == "" {
+		remoteId, err := p.findRemoteUser(service, status.Username)
+		if err != nil {
+			return err
+		}
+		status.RemoteId = remoteId
+	}
+
+	if service.Scim.Deprovision == deprovisionDeactivate {
+		status.Operation = "deactivate"
+
+		if status.RemoteId == "" {
+			return nil
+		}
+
+		return p.request(service, http.MethodPatch, "/Users/"+url.PathEscape(status.RemoteId), scimPatchRequest{
+			Schemas:    []string{scimPatchSchema},
+			Operations: []scimPatchOperation{{Op: "replace", Path: "active", Value: false}},
+		}, nil)
+	}
+
+	status.Operation = "delete"
+
+	if status.RemoteId == "" {
+		return nil
+	}
+
+	err := p.request(service, http.MethodDelete, "/Users/"+url.PathEscape(status.RemoteId), nil, nil)
+	if remoteErr, ok := err.(*scimRemoteError); ok && remoteErr.status == http.StatusNotFound {
+		err = nil
+	}
+
+	if err == nil {
+		status.RemoteId = ""
+	}
+
+	return err
+}
+
+// findRemoteUser looks up the id of a user that the service already knows about
+func (p *provisioner) findRemoteUser(service Service, username string) (string, error) {
+	var list struct {
+		Resources []scimUser `json:"Resources"`
+	}
+
+	filter := url.QueryEscape(fmt.Sprintf("userName eq %q", username))
+	if err := p.request(service, http.MethodGet, "/Users?filter="+filter, nil, &list); err != nil {
+		return "", err
+	}
+
+	if len(list.Resources) == 0 {
+		return "", nil
+	}
+
+	return list.Resources[0].Id, nil
+}
+
+func (p *provisioner) request(service Service, method, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(service.Scim.BaseUrl, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", scimContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", scimContentType)
+	}
+	if service.Scim.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+service.Scim.Token)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &scimRemoteError{status: res.StatusCode, body: strings.TrimSpace(string(buf))}
+	}
+
+	if result != nil && len(buf) > 0 {
+		return json.Unmarshal(buf, result)
+	}
+
+	return nil
+}
+
+// outboundScimUser builds the SCIM representation pushed to a service, applying its attribute mapping
+func outboundScimUser(user *samlidp.User, mapping map[string]string) map[string]any {
+	resource := map[string]any{
+		"schemas":    []any{scimUserSchema},
+		"externalId": user.Name,
+		"userName":   user.Name,
+		"active":     true,
+	}
+
+	defaults := map[string]string{
+		"name.givenName":  "first_name",
+		"name.familyName": "last_name",
+		"displayName":     "common_name",
+		"emails":          "email",
+	}
+
+	for path, field := range defaults {
+		if _, ok := mapping[path]; !ok {
+			setScimAttribute(resource, path, userField(user, field))
+		}
+	}
+
+	for path, field := range mapping {
+		setScimAttribute(resource, path, userField(user, field))
+	}
+
+	return resource
+}
+
+func userField(user *samlidp.User, field string) string {
+	switch field {
+	case "username":
+		return user.Name
+	case "email":
+		return user.Email
+	case "first_name":
+		return user.GivenName
+	case "last_name":
+		return user.Surname
+	case "common_name":
+		return user.CommonName
+	}
+
+	return ""
+}
+
+func setScimAttribute(resource map[string]any, path, value string) {
+	if value == "" {
+		return
+	}
+
+	attribute, sub, _ := strings.Cut(path, ".")
+
+	switch {
+	case attribute == "emails" || attribute == "phoneNumbers":
+		resource[attribute] = []any{map[string]any{"value": value, "type": "work", "primary": true}}
+	case sub != "":
+		object, ok := resource[attribute].(map[string]any)
+		if !ok {
+			object = map[string]any{}
+			resource[attribute] = object
+		}
+		object[sub] = value
+	default:
+		resource[attribute] = value
+	}
+}
+
+func (s *Server) serveProvisioningStatus(c *gin.Context) {
+	statuses, err := s.Store.GetSyncStatuses()
+	if err != nil {
+		statuses = []*SyncStatus{}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Username != statuses[j].Username {
+			return statuses[i].Username < statuses[j].Username
+		}
+		return statuses[i].Service < statuses[j].Service
+	})
+
+	switch c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		c.JSON(http.StatusOK, statuses)
+	default:
+		c.HTML(http.StatusOK, "provisioning.html", gin.H{
+			"Title":    "Provisioning",
+			"Statuses": statuses,
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package idp
+
+import (
+	"encoding/json"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newProvisionedServer returns a server that provisions into the SCIM endpoint of a second server
+func newProvisionedServer(t *testing.T, deprovision string) (*Server, *Server) {
+	remote := newTestServer(t)
+	remote.config.Scim.Token = "remote-token"
+
+	target := httptest.NewServer(remote.router)
+	t.Cleanup(target.Close)
+
+	server := newTestServer(t, func(config *Config) {
+		config.Services[0].Scim = &ScimTarget{
+			BaseUrl:          target.URL + scimRoute,
+			Token:            "remote-token",
+			AttributeMapping: map[string]string{"displayName": "email"},
+			Deprovision:      deprovision,
+		}
+	})
+	server.provisioner.wait()
+
+	return server, remote
+}
+
+func TestProvisioning_PushesUsers(t *testing.T) {
+	server, remote := newProvisionedServer(t, deprovisionDelete)
+
+	status, err := server.Store.GetSyncStatus(testEntityId, "test")
+	require.NoError(t, err)
+	assert.True(t, status.Success, status.Error)
+	assert.Equal(t, "update", status.Operation)
+	assert.Equal(t, "test", status.RemoteId)
+
+	require.NoError(t, server.Store.AddUser(&samlidp.User{Name: "new", Email: "new@test.com", GivenName: "New"}))
+	server.provisioner.wait()
+
+	user, err := remote.Store.GetUser("new")
+	require.NoError(t, err)
+	assert.Equal(t, "new@test.com", user.Email)
+	assert.Equal(t, "new@test.com", user.CommonName)
+	assert.Equal(t, "New", user.GivenName)
+
+	status, err = server.Store.GetSyncStatus(testEntityId, "new")
+	require.NoError(t, err)
+	assert.Equal(t, "create", status.Operation)
+
+	require.NoError(t, server.Store.DeleteUser("new"))
+	server.provisioner.wait()
+
+	_, err = remote.Store.GetUser("new")
+	require.Error(t, err)
+
+	status, err = server.Store.GetSyncStatus(testEntityId, "new")
+	require.NoError(t, err)
+	assert.Equal(t, "delete", status.Operation)
+	assert.True(t, status.Success)
+}
+
+func TestProvisioning_Rename(t *testing.T) {
+	server, remote := newProvisionedServer(t, deprovisionDelete)
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+
+	renamed := *user
+	renamed.Name = "renamed"
+	require.NoError(t, server.Store.UpdateUser("test", &renamed))
+	server.provisioner.wait()
+
+	// The service's user is updated rather than deleted and created again
+	status, err := server.Store.GetSyncStatus(testEntityId, "renamed")
+	require.NoError(t, err)
+	assert.True(t, status.Success, status.Error)
+	assert.Equal(t, "update", status.Operation)
+	assert.Equal(t, "renamed", status.RemoteId)
+
+	_, err = server.Store.GetSyncStatus(testEntityId, "test")
+	assert.Error(t, err)
+
+	_, err = remote.Store.GetUser("test")
+	assert.Error(t, err)
+
+	remoteUser, err := remote.Store.GetUser("renamed")
+	require.NoError(t, err)
+	assert.Equal(t, user.Email, remoteUser.Email)
+}
+
+func TestProvisioning_RecordsFailures(t *testing.T) {
+	server, remote := newProvisionedServer(t, deprovisionDelete)
+	remote.config.Scim.Token = "rotated"
+
+	require.NoError(t, server.Store.AddUser(&samlidp.User{Name: "new"}))
+	server.provisioner.wait()
+
+	status, err := server.Store.GetSyncStatus(testEntityId, "new")
+	require.NoError(t, err)
+	assert.False(t, status.Success)
+	assert.Contains(t, status.Error, "401")
+}
+
+func TestProvisioning_StatusView(t *testing.T) {
+	server, _ := newProvisionedServer(t, deprovisionDelete)
+
+	req := httptest.NewRequest(http.MethodGet, provisioningRoute, nil)
+	req.Header.Set("Accept", "application/json")
+	w := serve(server, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var statuses []SyncStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, testEntityId, statuses[0].Service)
+
+	w = serve(server, httptest.NewRequest(http.MethodGet, provisioningRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), testEntityId)
+}
+
+func Test_OutboundScimUser(t *testing.T) {
+	user := &samlidp.User{Name: "test", Email: "test@test.com", GivenName: "Test", Surname: "User"}
+
+	resource := outboundScimUser(user, map[string]string{"userName": "email", "name.familyName": "username"})
+	assert.Equal(t, "test@test.com", resource["userName"])
+	assert.Equal(t, "test", resource["externalId"])
+	assert.Equal(t, map[string]any{"givenName": "Test", "familyName": "test"}, resource["name"])
+	assert.Equal(t, "test@test.com", resource["emails"].([]any)[0].(map[string]any)["value"])
+}
+
+func TestProvisioning_Deactivate(t *testing.T) {
+	server, remote := newProvisionedServer(t, deprovisionDeactivate)
+
+	require.NoError(t, server.Store.DeleteUser("test"))
+	server.provisioner.wait()
+
+	status, err := server.Store.GetSyncStatus(testEntityId, "test")
+	require.NoError(t, err)
+	assert.True(t, status.Success, status.Error)
+	assert.Equal(t, "deactivate", status.Operation)
+
+	_, err = remote.Store.GetUser("test")
+	require.NoError(t, err)
+}
@@ -0,0 +1,108 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"time"
+)
+
+const (
+	storageRedis = "redis"
+
+	defaultRedisKeyPrefix = "test-saml-idp"
+)
+
+// redisStore is a samlidp.Store that keeps values as JSON in Redis, so that several instances can share them
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func openRedisStore(options StorageOptions) (*redisStore, error) {
+	if options.Url == "" {
+		return nil, fmt.Errorf("a url is required for %s storage", storageRedis)
+	}
+
+	redisOptions, err := redis.ParseURL(options.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(redisOptions)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &redisStore{
+		client: client,
+		prefix: withDefault(options.KeyPrefix, defaultRedisKeyPrefix),
+	}, nil
+}
+
+func (s *redisStore) Get(key string, value any) error {
+	buf, err := s.client.Get(context.Background(), s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return samlidp.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, value)
+}
+
+func (s *redisStore) Put(key string, value any) error {
+	return s.put(key, value, 0)
+}
+
+// PutWithExpiry stores the value with a TTL, so that Redis removes it once it has expired
+func (s *redisStore) PutWithExpiry(key string, value any, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return s.Delete(key)
+	}
+
+	return s.put(key, value, ttl)
+}
+
+func (s *redisStore) put(key string, value any, ttl time.Duration) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(context.Background(), s.prefix+key, buf, ttl).Err()
+}
+
+func (s *redisStore) Delete(key string) error {
+	return s.client.Del(context.Background(), s.prefix+key).Err()
+}
+
+func (s *redisStore) List(prefix string) ([]string, error) {
+	ctx := context.Background()
+	keys := []string{}
+
+	pattern := escapeRedisPattern(s.prefix+prefix) + "*"
+
+	iter := s.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), s.prefix+prefix))
+	}
+
+	return keys, iter.Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// escapeRedisPattern escapes the characters that SCAN treats as glob syntax
+func escapeRedisPattern(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(value)
+}
@@ -0,0 +1,121 @@
+package idp
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newRedisTestStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	redis := miniredis.RunT(t)
+
+	backend, err := openRedisStore(StorageOptions{Url: "redis://" + redis.Addr(), KeyPrefix: "idp:"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = backend.Close() })
+
+	return &Store{Backend: backend}, redis
+}
+
+func TestRedisStore(t *testing.T) {
+	store, redis := newRedisTestStore(t)
+
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "alice"}))
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "b*b"}))
+	require.NoError(t, store.AddGroup(&Group{Name: "admins"}))
+
+	assert.True(t, redis.Exists("idp:/users/alice"))
+
+	users, err := store.GetUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	require.NoError(t, store.DeleteUser("alice"))
+
+	_, err = store.GetUser("alice")
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+
+	keys, err := store.List("/users/b*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, keys)
+}
+
+func TestRedisStore_SessionExpiry(t *testing.T) {
+	store, redis := newRedisTestStore(t)
+
+	require.NoError(t, store.AddSession(&saml.Session{ID: "session", ExpireTime: time.Now().Add(time.Minute)}))
+	require.NoError(t, store.AddSession(&saml.Session{ID: "expired", ExpireTime: time.Now().Add(-time.Minute)}))
+
+	ttl := redis.TTL("idp:" + sessionsPrefix + "session")
+	assert.InDelta(t, time.Minute, ttl, float64(5*time.Second))
+	assert.False(t, redis.Exists("idp:"+sessionsPrefix+"expired"))
+
+	redis.FastForward(2 * time.Minute)
+
+	_, err := store.GetSession("session")
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+}
+
+// listHook runs a function after the backend lists keys, before any of them are read
+type listHook struct {
+	samlidp.Store
+	after func()
+}
+
+func (h listHook) List(prefix string) ([]string, error) {
+	keys, err := h.Store.List(prefix)
+	h.after()
+
+	return keys, err
+}
+
+func TestRedisStore_KeyExpiresWhileListing(t *testing.T) {
+	store, redis := newRedisTestStore(t)
+
+	require.NoError(t, store.AddSession(&saml.Session{ID: "short", UserName: "alice", ExpireTime: time.Now().Add(time.Minute)}))
+	require.NoError(t, store.AddSession(&saml.Session{ID: "long", UserName: "alice", ExpireTime: time.Now().Add(time.Hour)}))
+
+	listing := &Store{Backend: listHook{Store: store.Backend, after: func() { redis.FastForward(2 * time.Minute) }}}
+
+	sessions, err := listing.GetUserSessions("alice")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "long", sessions[0].ID)
+
+	require.NoError(t, listing.DeleteExpiredSessions())
+	require.NoError(t, listing.DeleteUserSessions("alice"))
+}
+
+func TestRedisStore_SharedBetweenReplicas(t *testing.T) {
+	redis := miniredis.RunT(t)
+	storage := func(config *Config) {
+		config.Storage = StorageOptions{Type: storageRedis, Url: "redis://" + redis.Addr()}
+	}
+
+	first := newTestServer(t, storage)
+	defer first.Close()
+	second := newTestServer(t, storage)
+	defer second.Close()
+
+	form := authorizeParams()
+	form.Set("username", "test")
+	form.Set("password", "test")
+	w := serve(first, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	cookie := w.Result().Cookies()[0]
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	_, err = second.Store.GetSession(cookie.Value)
+	require.NoError(t, err)
+
+	w = exchangeCode(second, location.Query().Get("code"), testVerifier)
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,112 @@
+package idp
+
+import (
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// userRepository holds the users and sessions, which are read on every login and so kept apart from the rest of
+// the Store's data
+type userRepository interface {
+	GetUser(name string) (*samlidp.User, error)
+	GetUsers() ([]*samlidp.User, error)
+	GetUsersByName(name string) ([]*samlidp.User, error)
+	GetUsersByEmail(email string) ([]*samlidp.User, error)
+	GetGroupMembers(group string) ([]*samlidp.User, error)
+	PutUser(user *samlidp.User) error
+	DeleteUser(name string) error
+
+	GetSession(id string) (*saml.Session, error)
+	GetSessions() ([]*saml.Session, error)
+	GetUserSessions(name string) ([]*saml.Session, error)
+	PutSession(session *saml.Session) error
+	DeleteSession(id string) error
+}
+
+// kvRepository keeps users and sessions in a key-value backend. It has no indexes, so lookups other than by
+// key scan every value
+type kvRepository struct {
+	backend samlidp.Store
+}
+
+func (r *kvRepository) GetUser(name string) (user *samlidp.User, err error) {
+	err = r.backend.Get(usersPrefix+name, &user)
+	return
+}
+
+func (r *kvRepository) GetUsers() ([]*samlidp.User, error) {
+	return getResources(r.backend, usersPrefix, r.GetUser)
+}
+
+func (r *kvRepository) GetUsersByName(name string) ([]*samlidp.User, error) {
+	return r.filterUsers(func(user *samlidp.User) bool {
+		return strings.EqualFold(user.Name, name)
+	})
+}
+
+func (r *kvRepository) GetUsersByEmail(email string) ([]*samlidp.User, error) {
+	return r.filterUsers(func(user *samlidp.User) bool {
+		return strings.EqualFold(user.Email, email)
+	})
+}
+
+func (r *kvRepository) GetGroupMembers(group string) ([]*samlidp.User, error) {
+	return r.filterUsers(func(user *samlidp.User) bool {
+		return slices.Contains(user.Groups, group)
+	})
+}
+
+func (r *kvRepository) filterUsers(match func(*samlidp.User) bool) ([]*samlidp.User, error) {
+	users, err := r.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(users, func(user *samlidp.User) bool { return !match(user) }), nil
+}
+
+func (r *kvRepository) PutUser(user *samlidp.User) error {
+	return r.backend.Put(usersPrefix+user.Name, user)
+}
+
+func (r *kvRepository) DeleteUser(name string) error {
+	return r.backend.Delete(usersPrefix + name)
+}
+
+func (r *kvRepository) GetSession(id string) (session *saml.Session, err error) {
+	err = r.backend.Get(sessionsPrefix+id, &session)
+	return
+}
+
+func (r *kvRepository) GetSessions() ([]*saml.Session, error) {
+	return getResources(r.backend, sessionsPrefix, r.GetSession)
+}
+
+func (r *kvRepository) GetUserSessions(name string) ([]*saml.Session, error) {
+	sessions, err := r.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(sessions, func(session *saml.Session) bool { return session.UserName != name }), nil
+}
+
+func (r *kvRepository) PutSession(session *saml.Session) error {
+	return putExpiring(r.backend, sessionsPrefix+session.ID, session, session.ExpireTime)
+}
+
+func (r *kvRepository) DeleteSession(id string) error {
+	return r.backend.Delete(sessionsPrefix + id)
+}
+
+// putExpiring stores a value that is no longer needed after it expires
+func putExpiring(backend samlidp.Store, key string, value any, expires time.Time) error {
+	if backend, ok := backend.(ExpiringBackend); ok {
+		return backend.PutWithExpiry(key, value, expires)
+	}
+
+	return backend.Put(key, value)
+}
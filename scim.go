@@ -0,0 +1,854 @@
+package idp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	scimRoute = "/scim/v2"
+
+	scimContentType = "application/scim+json"
+
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema         = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema       = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+
+	scimMaxResults = 1000
+)
+
+var errScimConflict = errors.New("a resource with that name already exists")
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUser struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id,omitempty"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        *scimName        `json:"name,omitempty"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []scimMultiValue `json:"emails,omitempty"`
+	Groups      []scimMultiValue `json:"groups,omitempty"`
+	Active      any              `json:"active,omitempty"`
+	Password    string           `json:"password,omitempty"`
+	Meta        *scimMeta        `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id,omitempty"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []scimMultiValue `json:"members,omitempty"`
+	Meta        *scimMeta        `json:"meta,omitempty"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func (s *Server) registerScimRoutes(group *gin.RouterGroup) {
+	scim := group.Group(scimRoute, s.authenticateScim)
+
+	scim.GET("/ServiceProviderConfig", s.serveScimServiceProviderConfig)
+	scim.GET("/ResourceTypes", s.serveScimResourceTypes)
+	scim.GET("/ResourceTypes/:id", s.serveScimResourceTypes)
+	scim.GET("/Schemas", s.serveScimSchemas)
+	scim.GET("/Schemas/:id", s.serveScimSchemas)
+
+	scim.GET("/Users", s.listScimUsers)
+	scim.POST("/Users", s.createScimUser)
+	scim.GET("/Users/:id", s.getScimUser)
+	scim.PUT("/Users/:id", s.replaceScimUser)
+	scim.PATCH("/Users/:id", s.patchScimUser)
+	scim.DELETE("/Users/:id", s.deleteScimUser)
+
+	scim.GET("/Groups", s.listScimGroups)
+	scim.POST("/Groups", s.createScimGroup)
+	scim.GET("/Groups/:id", s.getScimGroup)
+	scim.PUT("/Groups/:id", s.replaceScimGroup)
+	scim.PATCH("/Groups/:id", s.patchScimGroup)
+	scim.DELETE("/Groups/:id", s.deleteScimGroup)
+}
+
+func (s *Server) authenticateScim(c *gin.Context) {
+	token := s.config.Scim.Token
+	if token == "" {
+		return
+	}
+
+	presented, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		scimFail(c, http.StatusUnauthorized, "", "invalid bearer token")
+		c.Abort()
+	}
+}
+
+func (s *Server) listScimUsers(c *gin.Context) {
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	resources := make([]any, len(users))
+	for i, user := range users {
+		resources[i] = s.toScimUser(user)
+	}
+
+	scimList(c, resources)
+}
+
+func (s *Server) getScimUser(c *gin.Context) {
+	user, err := s.Store.GetUser(c.Param("id"))
+	if err != nil {
+		scimFail(c, http.StatusNotFound, "", "user not found")
+		return
+	}
+
+	scimJson(c, http.StatusOK, s.toScimUser(user))
+}
+
+func (s *Server) createScimUser(c *gin.Context) {
+	var resource scimUser
+	if err := json.NewDecoder(c.Request.Body).Decode(&resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	if resource.UserName == "" {
+		scimFail(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+
+	user := &samlidp.User{}
+	if err := s.fromScimUser(user, &resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err := s.Store.AddUser(user); err != nil {
+		scimStoreFail(c, err)
+		return
+	}
+
+	result := s.toScimUser(user)
+	c.Header("Location", result.Meta.Location)
+	scimJson(c, http.StatusCreated, result)
+}
+
+func (s *Server) replaceScimUser(c *gin.Context) {
+	user, err := s.Store.GetUser(c.Param("id"))
+	if err != nil {
+		scimFail(c, http.StatusNotFound, "", "user not found")
+		return
+	}
+
+	var resource scimUser
+	if err = json.NewDecoder(c.Request.Body).Decode(&resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	s.updateScimUser(c, user, &resource)
+}
+
+func (s *Server) patchScimUser(c *gin.Context) {
+	user, err := s.Store.GetUser(c.Param("id"))
+	if err != nil {
+		scimFail(c, http.StatusNotFound, "", "user not found")
+		return
+	}
+
+	var resource scimUser
+	if !patchScimResource(c, s.toScimUser(user), &resource) {
+		return
+	}
+
+	s.updateScimUser(c, user, &resource)
+}
+
+func (s *Server) updateScimUser(c *gin.Context, user *samlidp.User, resource *scimUser) {
+	previousName := user.Name
+
+	if resource.UserName == "" {
+		scimFail(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+
+	if err := s.fromScimUser(user, resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err := s.Store.UpdateUser(previousName, user); err != nil {
+		scimStoreFail(c, err)
+		return
+	}
+
+	scimJson(c, http.StatusOK, s.toScimUser(user))
+}
+
+func (s *Server) deleteScimUser(c *gin.Context) {
+	if _, err := s.Store.GetUser(c.Param("id")); err != nil {
+		scimFail(c, http.StatusNotFound, "", "user not found")
+		return
+	}
+
+	if err := s.Store.DeleteUser(c.Param("id")); err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) listScimGroups(c *gin.Context) {
+	names, err := s.groupNames()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	resources := make([]any, len(names))
+	for i, name := range names {
+		resources[i] = s.toScimGroup(name, users)
+	}
+
+	scimList(c, resources)
+}
+
+func (s *Server) getScimGroup(c *gin.Context) {
+	// Configured groups can list members of their own, so every user is needed to find the members
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if !s.groupExists(c.Param("id"), users) {
+		scimFail(c, http.StatusNotFound, "", "group not found")
+		return
+	}
+
+	scimJson(c, http.StatusOK, s.toScimGroup(c.Param("id"), users))
+}
+
+func (s *Server) createScimGroup(c *gin.Context) {
+	var resource scimGroup
+	if err := json.NewDecoder(c.Request.Body).Decode(&resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	if resource.DisplayName == "" {
+		scimFail(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if s.groupExists(resource.DisplayName, users) {
+		scimFail(c, http.StatusConflict, "uniqueness", errScimConflict.Error())
+		return
+	}
+
+	s.saveScimGroup(c, "", &resource, http.StatusCreated)
+}
+
+func (s *Server) replaceScimGroup(c *gin.Context) {
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if !s.groupExists(c.Param("id"), users) {
+		scimFail(c, http.StatusNotFound, "", "group not found")
+		return
+	}
+
+	var resource scimGroup
+	if err = json.NewDecoder(c.Request.Body).Decode(&resource); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	s.saveScimGroup(c, c.Param("id"), &resource, http.StatusOK)
+}
+
+func (s *Server) patchScimGroup(c *gin.Context) {
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if !s.groupExists(c.Param("id"), users) {
+		scimFail(c, http.StatusNotFound, "", "group not found")
+		return
+	}
+
+	var resource scimGroup
+	if !patchScimResource(c, s.toScimGroup(c.Param("id"), users), &resource) {
+		return
+	}
+
+	s.saveScimGroup(c, c.Param("id"), &resource, http.StatusOK)
+}
+
+// saveScimGroup creates or replaces a group, renaming it if the display name changed and
+// updating the group memberships of every affected user
+func (s *Server) saveScimGroup(c *gin.Context, previousName string, resource *scimGroup, status int) {
+	name := resource.DisplayName
+	if name == "" {
+		scimFail(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if previousName != "" && name != previousName && s.groupExists(name, users) {
+		scimFail(c, http.StatusConflict, "uniqueness", errScimConflict.Error())
+		return
+	}
+
+	members := make([]string, len(resource.Members))
+	for i, member := range resource.Members {
+		if _, err = s.Store.GetUser(member.Value); err != nil {
+			scimFail(c, http.StatusBadRequest, "invalidValue", "unknown member "+member.Value)
+			return
+		}
+		members[i] = member.Value
+	}
+
+	for _, user := range users {
+		groups := slices.DeleteFunc(slices.Clone(user.Groups), func(group string) bool {
+			return group == previousName || group == name
+		})
+		if slices.Contains(members, user.Name) {
+			groups = append(groups, name)
+		}
+
+		if !slices.Equal(groups, user.Groups) {
+			user.Groups = groups
+			if err = s.Store.UpdateUser(user.Name, user); err != nil {
+				scimFail(c, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+		}
+	}
+
+	// Members are now tracked on the users, but the rest of a configured group is kept
+	group, err := s.Store.GetGroup(withDefault(previousName, name))
+	if err != nil {
+		group = &Group{}
+	}
+	group.Name = name
+	group.ExternalId = resource.ExternalId
+	group.Members = nil
+
+	if previousName != "" && previousName != name {
+		_ = s.Store.DeleteGroup(previousName)
+	}
+
+	if err = s.Store.AddGroup(group); err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	users, err = s.Store.GetUsers()
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	result := s.toScimGroup(name, users)
+	if status == http.StatusCreated {
+		c.Header("Location", result.Meta.Location)
+	}
+	scimJson(c, status, result)
+}
+
+func (s *Server) deleteScimGroup(c *gin.Context) {
+	name := c.Param("id")
+
+	users, err := s.Store.GetGroupMembers(name)
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if !s.groupExists(name, users) {
+		scimFail(c, http.StatusNotFound, "", "group not found")
+		return
+	}
+
+	for _, user := range users {
+		if slices.Contains(user.Groups, name) {
+			user.Groups = slices.DeleteFunc(user.Groups, func(group string) bool { return group == name })
+			if err = s.Store.UpdateUser(user.Name, user); err != nil {
+				scimFail(c, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+		}
+	}
+
+	if err = s.Store.DeleteGroup(name); err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) serveScimServiceProviderConfig(c *gin.Context) {
+	scimJson(c, http.StatusOK, gin.H{
+		"schemas":          []string{scimConfigSchema},
+		"patch":            gin.H{"supported": true},
+		"bulk":             gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           gin.H{"supported": true, "maxResults": scimMaxResults},
+		"changePassword":   gin.H{"supported": true},
+		"sort":             gin.H{"supported": false},
+		"etag":             gin.H{"supported": false},
+		"documentationUri": "https://github.com/derekmckinnon/test-saml-idp",
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication using the token configured under scim.token",
+		}},
+		"meta": scimMeta{ResourceType: "ServiceProviderConfig", Location: s.endpointUrl(scimRoute + "/ServiceProviderConfig")},
+	})
+}
+
+func (s *Server) serveScimResourceTypes(c *gin.Context) {
+	resourceTypes := []any{
+		gin.H{
+			"schemas":  []string{scimResourceTypeSchema},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   scimUserSchema,
+			"meta":     scimMeta{ResourceType: "ResourceType", Location: s.endpointUrl(scimRoute + "/ResourceTypes/User")},
+		},
+		gin.H{
+			"schemas":  []string{scimResourceTypeSchema},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   scimGroupSchema,
+			"meta":     scimMeta{ResourceType: "ResourceType", Location: s.endpointUrl(scimRoute + "/ResourceTypes/Group")},
+		},
+	}
+
+	scimDiscovery(c, resourceTypes)
+}
+
+func (s *Server) serveScimSchemas(c *gin.Context) {
+	attribute := func(name, kind string, multiValued, required bool, mutability string, subAttributes ...gin.H) gin.H {
+		definition := gin.H{
+			"name":        name,
+			"type":        kind,
+			"multiValued": multiValued,
+			"required":    required,
+			"caseExact":   false,
+			"mutability":  mutability,
+			"returned":    "default",
+			"uniqueness":  "none",
+		}
+		if name == "password" {
+			definition["returned"] = "never"
+		}
+		if len(subAttributes) > 0 {
+			definition["subAttributes"] = subAttributes
+		}
+		return definition
+	}
+
+	multiValue := []gin.H{
+		attribute("value", "string", false, false, "readWrite"),
+		attribute("display", "string", false, false, "readOnly"),
+		attribute("type", "string", false, false, "readWrite"),
+		attribute("primary", "boolean", false, false, "readWrite"),
+	}
+
+	schemas := []any{
+		gin.H{
+			"schemas":     []string{scimSchemaSchema},
+			"id":          scimUserSchema,
+			"name":        "User",
+			"description": "User Account",
+			"attributes": []gin.H{
+				attribute("userName", "string", false, true, "readWrite"),
+				attribute("name", "complex", false, false, "readWrite",
+					attribute("formatted", "string", false, false, "readOnly"),
+					attribute("givenName", "string", false, false, "readWrite"),
+					attribute("familyName", "string", false, false, "readWrite"),
+				),
+				attribute("displayName", "string", false, false, "readWrite"),
+				attribute("emails", "complex", true, false, "readWrite", multiValue...),
+				attribute("groups", "complex", true, false, "readOnly", multiValue...),
+				attribute("active", "boolean", false, false, "readWrite"),
+				attribute("password", "string", false, false, "writeOnly"),
+			},
+			"meta": scimMeta{ResourceType: "Schema", Location: s.endpointUrl(scimRoute + "/Schemas/" + scimUserSchema)},
+		},
+		gin.H{
+			"schemas":     []string{scimSchemaSchema},
+			"id":          scimGroupSchema,
+			"name":        "Group",
+			"description": "Group",
+			"attributes": []gin.H{
+				attribute("displayName", "string", false, true, "readWrite"),
+				attribute("members", "complex", true, false, "readWrite", multiValue...),
+			},
+			"meta": scimMeta{ResourceType: "Schema", Location: s.endpointUrl(scimRoute + "/Schemas/" + scimGroupSchema)},
+		},
+	}
+
+	scimDiscovery(c, schemas)
+}
+
+func (s *Server) toScimUser(user *samlidp.User) *scimUser {
+	resource := &scimUser{
+		Schemas:     []string{scimUserSchema},
+		Id:          user.Name,
+		UserName:    user.Name,
+		DisplayName: user.CommonName,
+		Active:      true,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Location:     s.endpointUrl(scimRoute + "/Users/" + user.Name),
+		},
+	}
+
+	if user.GivenName != "" || user.Surname != "" {
+		resource.Name = &scimName{
+			Formatted:  strings.TrimSpace(user.GivenName + " " + user.Surname),
+			GivenName:  user.GivenName,
+			FamilyName: user.Surname,
+		}
+	}
+
+	if user.Email != "" {
+		resource.Emails = []scimMultiValue{{Value: user.Email, Type: "work", Primary: true}}
+	}
+
+	for _, group := range user.Groups {
+		resource.Groups = append(resource.Groups, scimMultiValue{
+			Value:   group,
+			Display: group,
+			Ref:     s.endpointUrl(scimRoute + "/Groups/" + group),
+		})
+	}
+
+	return resource
+}
+
+func (s *Server) toScimGroup(name string, users []*samlidp.User) *scimGroup {
+	resource := &scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		Id:          name,
+		DisplayName: name,
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Location:     s.endpointUrl(scimRoute + "/Groups/" + name),
+		},
+	}
+
+	group, err := s.Store.GetGroup(name)
+	if err == nil {
+		resource.ExternalId = group.ExternalId
+	} else {
+		group = &Group{}
+	}
+
+	for _, user := range users {
+		if slices.Contains(user.Groups, name) || slices.Contains(group.Members, user.Name) {
+			resource.Members = append(resource.Members, scimMultiValue{
+				Value:   user.Name,
+				Display: user.Name,
+				Ref:     s.endpointUrl(scimRoute + "/Users/" + user.Name),
+			})
+		}
+	}
+
+	return resource
+}
+
+// fromScimUser copies the writable attributes of a SCIM user onto a stored user. Group memberships
+// are read-only on users and must be managed through the Groups endpoint.
+func (s *Server) fromScimUser(user *samlidp.User, resource *scimUser) error {
+	user.Name = resource.UserName
+	user.CommonName = resource.DisplayName
+	user.GivenName = ""
+	user.Surname = ""
+	user.Email = ""
+
+	if resource.Name != nil {
+		user.GivenName = resource.Name.GivenName
+		user.Surname = resource.Name.FamilyName
+	}
+
+	for _, email := range resource.Emails {
+		if user.Email == "" || email.Primary {
+			user.Email = email.Value
+		}
+	}
+
+	if resource.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(resource.Password), s.config.BcryptCost)
+		if err != nil {
+			return err
+		}
+		user.HashedPassword = hashedPassword
+	}
+
+	return nil
+}
+
+// groupNames lists both explicitly created groups and those only referenced by users
+func (s *Server) groupNames() ([]string, error) {
+	groups, err := s.Store.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := s.Store.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	for _, user := range users {
+		names = append(names, user.Groups...)
+	}
+
+	slices.Sort(names)
+
+	return slices.Compact(names), nil
+}
+
+func (s *Server) groupExists(name string, users []*samlidp.User) bool {
+	if _, err := s.Store.GetGroup(name); err == nil {
+		return true
+	}
+
+	for _, user := range users {
+		if slices.Contains(user.Groups, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// patchScimResource applies the PATCH request in the body to the current representation of a
+// resource and unmarshals the outcome into result
+func patchScimResource(c *gin.Context, current any, result any) bool {
+	var request scimPatchRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return false
+	}
+
+	resource, err := toJsonMap(current)
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return false
+	}
+
+	for _, operation := range request.Operations {
+		if err = applyScimPatch(resource, operation); err != nil {
+			scimType := "invalidPath"
+			if errors.Is(err, errInvalidFilter) {
+				scimType = "invalidFilter"
+			}
+			scimFail(c, http.StatusBadRequest, scimType, err.Error())
+			return false
+		}
+	}
+
+	buf, err := json.Marshal(resource)
+	if err != nil {
+		scimFail(c, http.StatusInternalServerError, "", err.Error())
+		return false
+	}
+
+	if err = json.Unmarshal(buf, result); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// scimList filters and paginates resources according to the filter, startIndex and count parameters
+func scimList(c *gin.Context, resources []any) {
+	var filter scimFilter
+	if expression := c.Query("filter"); expression != "" {
+		var err error
+		if filter, err = parseScimFilter(expression); err != nil {
+			scimFail(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+	}
+
+	var matched []map[string]any
+	for _, resource := range resources {
+		object, err := toJsonMap(resource)
+		if err != nil {
+			scimFail(c, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+
+		if filter == nil || filter.matches(object) {
+			matched = append(matched, object)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i]["id"].(string) < matched[j]["id"].(string)
+	})
+
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(scimMaxResults)))
+	if err != nil || count < 0 {
+		count = 0
+	}
+	count = min(count, scimMaxResults)
+
+	page := []map[string]any{}
+	if startIndex <= len(matched) {
+		page = matched[startIndex-1 : min(startIndex-1+count, len(matched))]
+	}
+
+	scimJson(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(matched),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+// scimDiscovery serves either a list of discovery resources or the one matching the id parameter
+func scimDiscovery(c *gin.Context, resources []any) {
+	id := c.Param("id")
+	if id == "" {
+		scimJson(c, http.StatusOK, gin.H{
+			"schemas":      []string{scimListSchema},
+			"totalResults": len(resources),
+			"startIndex":   1,
+			"itemsPerPage": len(resources),
+			"Resources":    resources,
+		})
+		return
+	}
+
+	for _, resource := range resources {
+		if resource.(gin.H)["id"] == id {
+			scimJson(c, http.StatusOK, resource)
+			return
+		}
+	}
+
+	scimFail(c, http.StatusNotFound, "", "resource not found")
+}
+
+func scimJson(c *gin.Context, status int, body any) {
+	c.Header("Content-Type", scimContentType)
+	c.JSON(status, body)
+}
+
+// scimStoreFail responds to an error saving to the Store, which is a conflict if the resource is not unique
+func scimStoreFail(c *gin.Context, err error) {
+	if errors.Is(err, ErrAlreadyExists) {
+		scimFail(c, http.StatusConflict, "uniqueness", err.Error())
+		return
+	}
+
+	scimFail(c, http.StatusInternalServerError, "", err.Error())
+}
+
+func scimFail(c *gin.Context, status int, scimType, detail string) {
+	scimJson(c, status, scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func toJsonMap(value any) (map[string]any, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]any
+	err = json.Unmarshal(buf, &object)
+
+	return object, err
+}
@@ -0,0 +1,600 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	errInvalidFilter = errors.New("invalid filter")
+	errInvalidPath   = errors.New("invalid path")
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644 3.4.2.2) that is evaluated against
+// the JSON representation of a resource
+type scimFilter interface {
+	matches(resource map[string]any) bool
+}
+
+type logicalFilter struct {
+	operator    string
+	left, right scimFilter
+}
+
+type notFilter struct {
+	inner scimFilter
+}
+
+type compareFilter struct {
+	path     string
+	operator string
+	value    any
+}
+
+type valuePathFilter struct {
+	attribute string
+	inner     scimFilter
+}
+
+func (f logicalFilter) matches(resource map[string]any) bool {
+	if f.operator == "and" {
+		return f.left.matches(resource) && f.right.matches(resource)
+	}
+
+	return f.left.matches(resource) || f.right.matches(resource)
+}
+
+func (f notFilter) matches(resource map[string]any) bool {
+	return !f.inner.matches(resource)
+}
+
+func (f valuePathFilter) matches(resource map[string]any) bool {
+	for _, value := range resolveAttribute(resource, f.attribute) {
+		if element, ok := value.(map[string]any); ok && f.inner.matches(element) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f compareFilter) matches(resource map[string]any) bool {
+	values := resolveAttribute(resource, f.path)
+
+	switch f.operator {
+	case "pr":
+		for _, value := range values {
+			if value != nil && value != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !compareFilter{path: f.path, operator: "eq", value: f.value}.matches(resource)
+	}
+
+	for _, value := range values {
+		if compareValues(value, f.operator, f.value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compareValues(actual any, operator string, expected any) bool {
+	switch expected := expected.(type) {
+	case nil:
+		return actual == nil
+	case bool:
+		actual, ok := actual.(bool)
+		return ok && operator == "eq" && actual == expected
+	case float64:
+		actual, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "eq":
+			return actual == expected
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	case string:
+		actual, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		switch operator {
+		case "eq":
+			return actual == expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	}
+
+	return false
+}
+
+// resolveAttribute returns every value found at the attribute path, flattening multi-valued attributes
+func resolveAttribute(resource map[string]any, path string) []any {
+	values := []any{resource}
+
+	for _, name := range strings.Split(stripSchemaUrn(path), ".") {
+		var next []any
+
+		for _, value := range values {
+			object, ok := value.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			child, ok := object[findKey(object, name)]
+			if !ok {
+				continue
+			}
+
+			if array, ok := child.([]any); ok {
+				next = append(next, array...)
+			} else {
+				next = append(next, child)
+			}
+		}
+
+		values = next
+	}
+
+	return values
+}
+
+// stripSchemaUrn removes a fully qualified schema prefix, such as
+// urn:ietf:params:scim:schemas:core:2.0:User:userName
+func stripSchemaUrn(path string) string {
+	if !strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return path
+	}
+
+	return path[strings.LastIndex(path, ":")+1:]
+}
+
+// findKey looks up a key case-insensitively, as SCIM attribute names are case-insensitive
+func findKey(object map[string]any, name string) string {
+	if _, ok := object[name]; ok {
+		return name
+	}
+
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+
+	return name
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseScimFilter(filter string) (scimFilter, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos != len(parser.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", errInvalidFilter, parser.tokens[parser.pos])
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+
+	return token
+}
+
+func (p *filterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = logicalFilter{operator: "or", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		left = logicalFilter{operator: "and", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseTerm() (scimFilter, error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("%w: unexpected end of filter", errInvalidFilter)
+	case strings.EqualFold(token, "not"):
+		if p.next() != "(" {
+			return nil, fmt.Errorf("%w: expected ( after not", errInvalidFilter)
+		}
+		inner, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{inner: inner}, nil
+	case token == "(":
+		return p.parseGroup()
+	}
+
+	if p.peek() == "[" {
+		p.next()
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next() != "]" {
+			return nil, fmt.Errorf("%w: expected ]", errInvalidFilter)
+		}
+
+		return valuePathFilter{attribute: token, inner: inner}, nil
+	}
+
+	operator := strings.ToLower(p.next())
+	switch operator {
+	case "pr":
+		return compareFilter{path: token, operator: operator}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %q", errInvalidFilter, operator)
+	}
+
+	value, err := parseFilterValue(p.next())
+	if err != nil {
+		return nil, err
+	}
+
+	return compareFilter{path: token, operator: operator, value: value}, nil
+}
+
+func (p *filterParser) parseGroup() (scimFilter, error) {
+	inner, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.next() != ")" {
+		return nil, fmt.Errorf("%w: expected )", errInvalidFilter)
+	}
+
+	return inner, nil
+}
+
+func parseFilterValue(token string) (any, error) {
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("%w: missing comparison value", errInvalidFilter)
+	case strings.HasPrefix(token, `"`):
+		return strconv.Unquote(token)
+	case token == "true":
+		return true, nil
+	case token == "false":
+		return false, nil
+	case token == "null":
+		return nil, nil
+	}
+
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid value %q", errInvalidFilter, token)
+	}
+
+	return number, nil
+}
+
+func tokenizeFilter(filter string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(filter); {
+		char := rune(filter[i])
+
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case strings.ContainsRune("()[]", char):
+			tokens = append(tokens, string(char))
+			i++
+		case char == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("%w: unterminated string", errInvalidFilter)
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for ; end < len(filter) && !unicode.IsSpace(rune(filter[end])) && !strings.ContainsRune("()[]", rune(filter[end])); end++ {
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type scimPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// applyScimPatch applies a single PATCH operation (RFC 7644 3.5.2) to the JSON representation of a resource
+func applyScimPatch(resource map[string]any, operation scimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+
+	if operation.Path == "" {
+		if op == "remove" {
+			return fmt.Errorf("%w: remove requires a path", errInvalidPath)
+		}
+
+		values, ok := operation.Value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: value must be an object when no path is given", errInvalidPath)
+		}
+
+		for name, value := range values {
+			if err := applyScimPatch(resource, scimPatchOperation{Op: op, Path: name, Value: value}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	attribute, filter, subAttribute, err := parsePatchPath(operation.Path)
+	if err != nil {
+		return err
+	}
+
+	if filter != nil {
+		return patchFilteredValues(resource, op, attribute, filter, subAttribute, operation.Value)
+	}
+
+	target := resource
+	name := attribute
+	if parent, child, ok := strings.Cut(attribute, "."); ok {
+		key := findKey(resource, parent)
+		object, ok := resource[key].(map[string]any)
+		if !ok {
+			if op == "remove" {
+				return nil
+			}
+			object = map[string]any{}
+			resource[key] = object
+		}
+		target, name = object, child
+	}
+
+	key := findKey(target, name)
+
+	switch op {
+	case "add":
+		existing, isArray := target[key].([]any)
+		if values, ok := operation.Value.([]any); ok && (isArray || target[key] == nil) {
+			target[key] = appendUnique(existing, values)
+		} else {
+			target[key] = mergeValue(target[key], operation.Value)
+		}
+	case "replace":
+		target[key] = mergeValue(target[key], operation.Value)
+	case "remove":
+		existing, isArray := target[key].([]any)
+		values, hasValues := operation.Value.([]any)
+		if isArray && hasValues {
+			target[key] = removeMatching(existing, func(element any) bool {
+				return containsValue(values, element)
+			})
+		} else {
+			delete(target, key)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported op %q", errInvalidPath, operation.Op)
+	}
+
+	return nil
+}
+
+func patchFilteredValues(resource map[string]any, op, attribute string, filter scimFilter, subAttribute string, value any) error {
+	key := findKey(resource, attribute)
+	elements, _ := resource[key].([]any)
+
+	matched := false
+	var result []any
+
+	for _, element := range elements {
+		object, ok := element.(map[string]any)
+		if !ok || !filter.matches(object) {
+			result = append(result, element)
+			continue
+		}
+
+		matched = true
+
+		switch {
+		case op == "remove" && subAttribute == "":
+			continue
+		case op == "remove":
+			delete(object, findKey(object, subAttribute))
+		case subAttribute != "":
+			object[findKey(object, subAttribute)] = value
+		default:
+			element = mergeValue(object, value)
+		}
+
+		result = append(result, element)
+	}
+
+	if !matched && op != "remove" {
+		return fmt.Errorf("%w: no values matched %q", errInvalidPath, attribute)
+	}
+
+	resource[key] = result
+
+	return nil
+}
+
+// parsePatchPath splits a path such as emails[type eq "work"].value into its components
+func parsePatchPath(path string) (attribute string, filter scimFilter, subAttribute string, err error) {
+	path = stripSchemaUrn(path)
+
+	open := strings.Index(path, "[")
+	if open < 0 {
+		return path, nil, "", nil
+	}
+
+	end := strings.LastIndex(path, "]")
+	if end < open {
+		return "", nil, "", fmt.Errorf("%w: %s", errInvalidPath, path)
+	}
+
+	filter, err = parseScimFilter(path[open+1 : end])
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	return path[:open], filter, strings.TrimPrefix(path[end+1:], "."), nil
+}
+
+// mergeValue replaces a value, merging sub-attributes when both values are complex attributes
+func mergeValue(existing, value any) any {
+	existingObject, ok := existing.(map[string]any)
+	if !ok {
+		return value
+	}
+
+	valueObject, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+
+	for name, sub := range valueObject {
+		existingObject[findKey(existingObject, name)] = sub
+	}
+
+	return existingObject
+}
+
+func appendUnique(existing, values []any) []any {
+	for _, value := range values {
+		if !containsValue(existing, value) {
+			existing = append(existing, value)
+		}
+	}
+
+	return existing
+}
+
+func removeMatching(elements []any, match func(any) bool) []any {
+	var result []any
+
+	for _, element := range elements {
+		if !match(element) {
+			result = append(result, element)
+		}
+	}
+
+	return result
+}
+
+// containsValue compares multi-valued attributes by their "value" sub-attribute when present
+func containsValue(elements []any, target any) bool {
+	for _, element := range elements {
+		if multiValue(element) == multiValue(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func multiValue(element any) any {
+	if object, ok := element.(map[string]any); ok {
+		return object[findKey(object, "value")]
+	}
+
+	return element
+}
@@ -0,0 +1,89 @@
+package idp
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testScimResource() map[string]any {
+	return map[string]any{
+		"userName": "Test",
+		"active":   true,
+		"name":     map[string]any{"givenName": "Test", "familyName": "User"},
+		"emails": []any{
+			map[string]any{"value": "test@test.com", "type": "work", "primary": true},
+			map[string]any{"value": "test@home.com", "type": "home"},
+		},
+	}
+}
+
+func Test_ScimFilter(t *testing.T) {
+	testCases := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "test"`, true},
+		{`username eq "other"`, false},
+		{`userName ne "other"`, true},
+		{`userName sw "te"`, true},
+		{`userName ew "st"`, true},
+		{`name.familyName co "se"`, true},
+		{`emails.value eq "test@home.com"`, true},
+		{`emails[type eq "work" and value co "@test.com"]`, true},
+		{`emails[type eq "other"]`, false},
+		{`active eq true`, true},
+		{`title pr`, false},
+		{`userName eq "other" or active eq true`, true},
+		{`userName eq "test" and not (active eq true)`, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "test"`, true},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := parseScimFilter(testCase.filter)
+		require.NoError(t, err, testCase.filter)
+		require.Equal(t, testCase.matches, filter.matches(testScimResource()), testCase.filter)
+	}
+}
+
+func Test_ScimFilterInvalid(t *testing.T) {
+	for _, filter := range []string{``, `userName`, `userName xx "test"`, `userName eq`, `(userName eq "test"`, `userName eq "test`} {
+		_, err := parseScimFilter(filter)
+		require.ErrorIs(t, err, errInvalidFilter, filter)
+	}
+}
+
+func Test_ScimPatchReplace(t *testing.T) {
+	resource := testScimResource()
+
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "Replace", Path: "name.givenName", Value: "Changed"}))
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "replace", Value: map[string]any{"active": false}}))
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "replace", Path: `emails[type eq "work"].value`, Value: "new@test.com"}))
+
+	require.Equal(t, "Changed", resource["name"].(map[string]any)["givenName"])
+	require.Equal(t, "User", resource["name"].(map[string]any)["familyName"])
+	require.Equal(t, false, resource["active"])
+	require.Equal(t, "new@test.com", resource["emails"].([]any)[0].(map[string]any)["value"])
+}
+
+func Test_ScimPatchAddAndRemoveMembers(t *testing.T) {
+	resource := map[string]any{"displayName": "Group"}
+
+	members := []any{map[string]any{"value": "a"}, map[string]any{"value": "b"}}
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "add", Path: "members", Value: members}))
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "add", Path: "members", Value: []any{map[string]any{"value": "a"}}}))
+	require.Len(t, resource["members"], 2)
+
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "remove", Path: `members[value eq "a"]`}))
+	require.Len(t, resource["members"], 1)
+
+	require.NoError(t, applyScimPatch(resource, scimPatchOperation{Op: "remove", Path: "members", Value: []any{map[string]any{"value": "b"}}}))
+	require.Empty(t, resource["members"])
+}
+
+func Test_ScimPatchInvalid(t *testing.T) {
+	resource := testScimResource()
+
+	require.Error(t, applyScimPatch(resource, scimPatchOperation{Op: "remove"}))
+	require.Error(t, applyScimPatch(resource, scimPatchOperation{Op: "move", Path: "userName"}))
+	require.Error(t, applyScimPatch(resource, scimPatchOperation{Op: "replace", Path: `emails[type eq "other"].value`, Value: "x"}))
+}
@@ -0,0 +1,228 @@
+package idp
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func scimRequest(server *Server, method, path string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, scimRoute+path, &buf)
+	req.Header.Set("Content-Type", scimContentType)
+
+	return serve(server, req)
+}
+
+func decodeScim[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	var result T
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+func TestScim_CreatedUserCanLogIn(t *testing.T) {
+	server := newTestServer(t)
+
+	w := scimRequest(server, http.MethodPost, "/Users", map[string]any{
+		"schemas":  []string{scimUserSchema},
+		"userName": "scim",
+		"password": "secret",
+		"name":     map[string]any{"givenName": "Scim", "familyName": "User"},
+		"emails":   []any{map[string]any{"value": "scim@test.com", "primary": true}},
+	})
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, scimContentType, w.Header().Get("Content-Type"))
+
+	user := decodeScim[scimUser](t, w)
+	assert.Equal(t, "scim", user.Id)
+	assert.Empty(t, user.Password)
+
+	form := authorizeParams()
+	form.Set("username", "scim")
+	form.Set("password", "secret")
+	w = serve(server, postForm(authorizeRoute, form))
+	require.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestScim_CreateUserConflict(t *testing.T) {
+	server := newTestServer(t)
+
+	w := scimRequest(server, http.MethodPost, "/Users", map[string]any{"userName": "test"})
+	require.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "uniqueness", decodeScim[scimError](t, w).ScimType)
+}
+
+func TestScim_ListUsersWithFilterAndPagination(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.Equal(t, http.StatusCreated, scimRequest(server, http.MethodPost, "/Users", map[string]any{"userName": name}).Code)
+	}
+
+	w := scimRequest(server, http.MethodGet, "/Users?startIndex=2&count=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	list := decodeScim[map[string]any](t, w)
+	assert.Equal(t, float64(4), list["totalResults"])
+	assert.Equal(t, float64(2), list["itemsPerPage"])
+	assert.Equal(t, "b", list["Resources"].([]any)[0].(map[string]any)["id"])
+
+	w = scimRequest(server, http.MethodGet, "/Users?filter="+url.QueryEscape(`emails.value eq "test@test.com"`), nil)
+	list = decodeScim[map[string]any](t, w)
+	assert.Equal(t, float64(1), list["totalResults"])
+
+	w = scimRequest(server, http.MethodGet, "/Users?filter=bogus", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestScim_PatchAndReplaceUser(t *testing.T) {
+	server := newTestServer(t)
+
+	w := scimRequest(server, http.MethodPatch, "/Users/test", map[string]any{
+		"schemas":    []string{scimPatchSchema},
+		"Operations": []any{map[string]any{"op": "replace", "path": "name.givenName", "value": "Patched"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.Equal(t, "Patched", user.GivenName)
+	assert.Equal(t, "User", user.Surname)
+	assert.Equal(t, []string{"foobar"}, user.Groups)
+
+	w = scimRequest(server, http.MethodPut, "/Users/test", map[string]any{
+		"userName": "renamed",
+		"emails":   []any{map[string]any{"value": "renamed@test.com"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, err = server.Store.GetUser("test")
+	require.Error(t, err)
+
+	user, err = server.Store.GetUser("renamed")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed@test.com", user.Email)
+	assert.NotEmpty(t, user.HashedPassword)
+}
+
+func TestScim_DeleteUser(t *testing.T) {
+	server := newTestServer(t)
+
+	require.Equal(t, http.StatusNoContent, scimRequest(server, http.MethodDelete, "/Users/test", nil).Code)
+	require.Equal(t, http.StatusNotFound, scimRequest(server, http.MethodGet, "/Users/test", nil).Code)
+	require.Equal(t, http.StatusNotFound, scimRequest(server, http.MethodDelete, "/Users/test", nil).Code)
+}
+
+func TestScim_Groups(t *testing.T) {
+	server := newTestServer(t)
+
+	w := scimRequest(server, http.MethodGet, "/Groups/foobar", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeScim[scimGroup](t, w).Members, 1)
+
+	w = scimRequest(server, http.MethodPost, "/Groups", map[string]any{
+		"displayName": "admins",
+		"members":     []any{map[string]any{"value": "test"}},
+	})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"foobar", "admins"}, user.Groups)
+
+	w = scimRequest(server, http.MethodPatch, "/Groups/admins", map[string]any{
+		"Operations": []any{
+			map[string]any{"op": "replace", "path": "displayName", "value": "owners"},
+			map[string]any{"op": "remove", "path": `members[value eq "test"]`},
+		},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	user, err = server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foobar"}, user.Groups)
+	require.Equal(t, http.StatusNotFound, scimRequest(server, http.MethodGet, "/Groups/admins", nil).Code)
+	require.Equal(t, http.StatusOK, scimRequest(server, http.MethodGet, "/Groups/owners", nil).Code)
+
+	require.Equal(t, http.StatusNoContent, scimRequest(server, http.MethodDelete, "/Groups/foobar", nil).Code)
+	user, err = server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.Empty(t, user.Groups)
+}
+
+func TestScim_ConfiguredGroupMembers(t *testing.T) {
+	server := newTestServer(t, nestedGroups)
+
+	w := scimRequest(server, http.MethodGet, "/Groups/admins", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	members := decodeScim[scimGroup](t, w).Members
+	require.Len(t, members, 1)
+	assert.Equal(t, "test", members[0].Value)
+
+	// Changing something else about the group keeps its members
+	w = scimRequest(server, http.MethodPatch, "/Groups/admins", map[string]any{
+		"Operations": []any{
+			map[string]any{"op": "replace", "path": "externalId", "value": "ext-admins"},
+		},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	group := decodeScim[scimGroup](t, w)
+	assert.Equal(t, "ext-admins", group.ExternalId)
+	require.Len(t, group.Members, 1)
+	assert.Equal(t, "test", group.Members[0].Value)
+
+	w = scimRequest(server, http.MethodGet, "/Groups/admins", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeScim[scimGroup](t, w).Members, 1)
+
+	assert.Contains(t, attributeValues(assertionAttributes(t, server)["eduPersonAffiliation"]), "admins")
+}
+
+func TestScim_Discovery(t *testing.T) {
+	server := newTestServer(t)
+
+	require.Equal(t, http.StatusOK, scimRequest(server, http.MethodGet, "/ServiceProviderConfig", nil).Code)
+	require.Equal(t, http.StatusOK, scimRequest(server, http.MethodGet, "/ResourceTypes/User", nil).Code)
+	require.Equal(t, http.StatusOK, scimRequest(server, http.MethodGet, "/Schemas/"+scimGroupSchema, nil).Code)
+	require.Equal(t, http.StatusNotFound, scimRequest(server, http.MethodGet, "/Schemas/unknown", nil).Code)
+}
+
+func TestScim_BearerToken(t *testing.T) {
+	server := newTestServer(t)
+	server.config.Scim.Token = "token"
+
+	require.Equal(t, http.StatusUnauthorized, scimRequest(server, http.MethodGet, "/Users", nil).Code)
+
+	req := httptest.NewRequest(http.MethodGet, scimRoute+"/Users", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	require.Equal(t, http.StatusOK, serve(server, req).Code)
+}
+
+func TestScim_EmailConflict(t *testing.T) {
+	server := newTestServer(t)
+
+	w := scimRequest(server, http.MethodPost, "/Users", map[string]any{
+		"userName": "other",
+		"emails":   []any{map[string]any{"value": "test@test.com"}},
+	})
+	require.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "uniqueness", decodeScim[scimError](t, w).ScimType)
+
+	w = scimRequest(server, http.MethodPost, "/Users", map[string]any{"userName": "other"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = scimRequest(server, http.MethodPut, "/Users/other", map[string]any{
+		"userName": "other",
+		"emails":   []any{map[string]any{"value": "test@test.com"}},
+	})
+	require.Equal(t, http.StatusConflict, w.Code)
+}
@@ -1,14 +1,22 @@
 package idp
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlidp"
 	"github.com/gin-contrib/logger"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
+	"strings"
 )
 
 const (
@@ -20,10 +28,17 @@ const (
 )
 
 type Server struct {
-	config *Config
-	idp    *saml.IdentityProvider
-	router *gin.Engine
-	Store  *Store
+	config      *Config
+	host        url.URL
+	idp         *saml.IdentityProvider
+	router      *gin.Engine
+	provisioner *provisioner
+	ldap        *ldapDirectory
+	webhook     *authWebhook
+	attributes  *attributeProvider
+	webauthn    *webauthn.WebAuthn
+	tlsConfig   *tls.Config
+	Store       *Store
 }
 
 func New(options ServerOptions) *Server {
@@ -31,28 +46,162 @@ func New(options ServerOptions) *Server {
 	if config.SessionMaxAge == 0 {
 		config.SessionMaxAge = defaultSessionMaxAge
 	}
+	if config.BcryptCost == 0 {
+		config.BcryptCost = bcrypt.DefaultCost
+	}
+	if config.LoginPage.Identifier == "" {
+		config.LoginPage.Identifier = identifierUsername
+	}
+	if config.Lockout.Window == 0 {
+		config.Lockout.Window = defaultLockoutWindow
+	}
+	if config.Lockout.Cooldown == 0 {
+		config.Lockout.Cooldown = defaultLockoutCooldown
+	}
+	if config.PasswordPolicy.MinLength == 0 {
+		config.PasswordPolicy.MinLength = defaultPasswordMinLength
+	}
+	if config.Totp.Skew == 0 {
+		config.Totp.Skew = defaultTotpSkew
+	}
 
 	host, err := url.Parse(config.Host)
 	if err != nil {
 		log.Fatal().Err(err).Msg("cannot parse host URL")
 	}
 
+	if config.Totp.Issuer == "" {
+		config.Totp.Issuer = host.Hostname()
+	}
+	if config.GroupFormat == "" {
+		config.GroupFormat = groupFormatName
+	}
+	if config.GroupBaseDn == "" {
+		config.GroupBaseDn = defaultGroupBaseDn(host.Hostname())
+	}
+
+	for _, format := range append([]string{config.GroupFormat}, serviceGroupFormats(config.Services)...) {
+		if !slices.Contains(groupFormats, format) {
+			log.Fatal().Str("format", format).Msg("unknown group format")
+		}
+	}
+
 	idp := buildIdp(*host, options)
 
-	store := &Store{}
+	backend, err := openBackend(config.Storage)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot open storage")
+	}
+
+	store := &Store{Backend: backend, RevokeSessionsOnUpdate: config.RevokeSessionsOnUpdate}
+	if err = store.DeleteExpiredSessions(); err != nil {
+		log.Fatal().Err(err).Msg("cannot delete expired sessions")
+	}
+
+	provisioner := newProvisioner(store, config.Services)
+	store.Observe(provisioner)
 
-	router := buildRouter(*host, idp, store)
+	router := buildRouter(*host, idp, store, config.BcryptCost)
 
 	server := &Server{
-		config: config,
-		idp:    idp,
-		router: router,
-		Store:  store,
+		config:      config,
+		host:        *host,
+		idp:         idp,
+		router:      router,
+		provisioner: provisioner,
+		Store:       store,
+	}
+
+	if identifier := config.LoginPage.Identifier; !slices.Contains(loginIdentifiers, identifier) {
+		log.Fatal().Str("identifier", identifier).Msg("unknown login identifier")
+	}
+
+	if config.Ldap != nil {
+		server.ldap = newLdapDirectory(*config.Ldap)
+
+		if mode := server.ldap.options.Mode; mode != ldapModeFallback && mode != ldapModeReplace {
+			log.Fatal().Str("mode", mode).Msg("unknown LDAP mode")
+		}
+	}
+
+	if config.AuthWebhook != nil {
+		server.webhook = newAuthWebhook(*config.AuthWebhook)
+
+		if mode := server.webhook.options.Mode; !slices.Contains(webhookModes, mode) {
+			log.Fatal().Str("mode", mode).Msg("unknown auth webhook mode")
+		}
+	}
+
+	if options := config.AttributeProvider; options != nil {
+		if (options.Url == "") == (len(options.Command) == 0) {
+			log.Fatal().Msg("the attribute provider needs either a url or a command")
+		}
+
+		server.attributes = newAttributeProvider(*options)
+	}
+
+	if config.Passkeys != nil {
+		if config.Passkeys.UserVerification == "" {
+			config.Passkeys.UserVerification = string(protocol.VerificationPreferred)
+		}
+
+		if verification := config.Passkeys.UserVerification; !slices.Contains(userVerifications, verification) {
+			log.Fatal().Str("userVerification", verification).Msg("unknown passkey user verification requirement")
+		}
+
+		if server.webauthn, err = newWebAuthn(*host, *config.Passkeys); err != nil {
+			log.Fatal().Err(err).Msg("cannot configure passkeys")
+		}
+	}
+
+	if options := config.Tls; options != nil {
+		if options.ClientMapping == "" {
+			options.ClientMapping = clientMappingEmail
+		}
+		if options.ClientAttribute == "" {
+			options.ClientAttribute = defaultClientAttribute
+		}
+
+		if mapping := options.ClientMapping; !slices.Contains(clientMappings, mapping) {
+			log.Fatal().Str("mapping", mapping).Msg("unknown client certificate mapping")
+		}
+
+		if server.tlsConfig, err = newTlsConfig(*options); err != nil {
+			log.Fatal().Err(err).Msg("cannot configure TLS")
+		}
+	}
+
+	if options := config.EmailLogin; options != nil {
+		if options.CodeLength == 0 {
+			options.CodeLength = defaultEmailCodeLength
+		}
+		if options.Timeout == 0 {
+			options.Timeout = defaultEmailTimeout
+		}
+		if options.From == "" {
+			options.From = "noreply@" + host.Hostname()
+		}
+
+		if options.CodeLength < 4 || options.CodeLength > 10 {
+			log.Fatal().Int("codeLength", options.CodeLength).Msg("email login codes must have between 4 and 10 digits")
+		}
 	}
 
 	idp.ServiceProviderProvider = server
+	idp.AssertionMaker = assertionMaker{server: server}
 	idp.SessionProvider = server
 
+	group := router.Group(getBasePath(*host))
+	server.registerOidcRoutes(group)
+	server.registerWsFedRoutes(group)
+	server.registerScimRoutes(group)
+	server.registerManagementRoutes(group)
+	server.registerAccountRoutes(group)
+	server.registerPasskeyRoutes(group)
+	server.registerEmailRoutes(group)
+	group.GET(provisioningRoute, server.serveProvisioningStatus)
+	group.POST(importRoute, server.importUsers)
+
 	return server
 }
 
@@ -74,7 +223,7 @@ func buildIdp(host url.URL, options ServerOptions) *saml.IdentityProvider {
 	return idp
 }
 
-func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store) *gin.Engine {
+func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store, bcryptCost int) *gin.Engine {
 	basePath := getBasePath(host)
 
 	router := gin.New()
@@ -123,6 +272,7 @@ func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store) *gin.En
 		c.HTML(200, "create-user.html", gin.H{
 			"Title":   "Create User",
 			"Success": success,
+			"Profile": User{},
 		})
 	})
 
@@ -154,6 +304,16 @@ func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store) *gin.En
 			errors = append(errors, "Password is required")
 		}
 
+		// The profile fields are optional, and only the scoped affiliation has a format to check
+		profile := User{Username: username}
+		for _, field := range profileFields {
+			_ = setUserField(&profile, field, strings.TrimSpace(c.PostForm(field)))
+		}
+
+		if checkScopedAffiliation(profile.ScopedAffiliation) != nil {
+			errors = append(errors, "Scoped Affiliation must look like member@example.com")
+		}
+
 		if len(errors) > 0 {
 			c.HTML(200, "create-user.html", gin.H{
 				"Title":     "Create User",
@@ -162,22 +322,39 @@ func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store) *gin.En
 				"Email":     email,
 				"FirstName": firstName,
 				"LastName":  lastName,
+				"Profile":   profile,
 			})
 			return
 		}
 
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err == nil {
+			err = store.AddUser(&samlidp.User{
+				Name:              username,
+				Email:             email,
+				HashedPassword:    hashedPassword,
+				GivenName:         firstName,
+				Surname:           lastName,
+				CommonName:        profile.CommonName,
+				ScopedAffiliation: profile.ScopedAffiliation,
+			})
+		}
 
-		err := store.AddUser(&samlidp.User{
-			Name:           username,
-			Email:          email,
-			HashedPassword: hashedPassword,
-			GivenName:      firstName,
-			Surname:        lastName,
-		})
+		if extra := newProfile(profile); err == nil && !extra.isEmpty() {
+			err = store.AddProfile(extra)
+		}
 
 		if err != nil {
-			errors = append(errors, err.Error())
+			c.HTML(200, "create-user.html", gin.H{
+				"Title":     "Create User",
+				"Errors":    []string{err.Error()},
+				"Username":  username,
+				"Email":     email,
+				"FirstName": firstName,
+				"LastName":  lastName,
+				"Profile":   profile,
+			})
+			return
 		}
 
 		c.Redirect(http.StatusFound, basePath+"/users/create?success")
@@ -187,30 +364,134 @@ func buildRouter(host url.URL, idp *saml.IdentityProvider, store *Store) *gin.En
 }
 
 func (s *Server) LoadUsers(users []User) error {
-	for _, user := range users {
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-
-		err := s.Store.AddUser(&samlidp.User{
-			Name:           user.Username,
-			Email:          user.Email,
-			HashedPassword: hashedPassword,
-			GivenName:      user.FirstName,
-			Surname:        user.LastName,
-			Groups:         user.Groups,
-		})
+	users = mergeCredentials(users)
+
+	accounts := make([]*Account, len(users))
+	loaded := map[string]bool{}
+	emails := map[string]string{}
+
+	// Every user is checked before any are saved, so that a bad entry does not leave the others half loaded
+	for i, user := range users {
+		if loaded[user.Username] {
+			return fmt.Errorf("user %s is listed more than once: %w", user.Username, ErrAlreadyExists)
+		}
+		loaded[user.Username] = true
+
+		if user.Email != "" {
+			email := strings.ToLower(user.Email)
+			if other, ok := emails[email]; ok {
+				return fmt.Errorf("users %s and %s have the same email %s: %w", other, user.Username, user.Email, ErrAlreadyExists)
+			}
+			emails[email] = user.Username
+		}
+
+		if user.PasswordHash != "" {
+			if err := checkPasswordHash(user.PasswordHash); err != nil {
+				return fmt.Errorf("user %s: %w", user.Username, err)
+			}
+		}
+
+		if user.TotpSecret != "" {
+			if err := checkTotpSecret(user.TotpSecret); err != nil {
+				return fmt.Errorf("user %s: %w", user.Username, err)
+			}
+		}
+
+		if err := checkScopedAffiliation(user.ScopedAffiliation); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+
+		if err := checkOverrides(user.Overrides); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
 
+		account, err := newAccount(user)
 		if err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		accounts[i] = account
+	}
+
+	hashedPasswords, err := hashPasswords(users, s.config.BcryptCost)
+	if err != nil {
+		return err
+	}
+
+	for i, user := range users {
+		hashedPassword := hashedPasswords[i]
+
+		existing, err := s.Store.GetUser(user.Username)
+		if err != nil && !errors.Is(err, samlidp.ErrNotFound) {
 			return err
 		}
 
-		log.Info().Str("username", user.Username).Msg("initialized user")
+		// Credentials for a user that already exists only replace their password
+		if existing != nil && user.credentialsOnly {
+			existing.HashedPassword = hashedPassword
+
+			if err = s.Store.UpdateUser(existing.Name, existing); err != nil {
+				return err
+			}
+
+			log.Info().Str("username", user.Username).Msg("updated user password")
+			continue
+		}
+
+		loadedUser := &samlidp.User{
+			Name:              user.Username,
+			Email:             user.Email,
+			HashedPassword:    hashedPassword,
+			GivenName:         user.FirstName,
+			Surname:           user.LastName,
+			CommonName:        user.CommonName,
+			ScopedAffiliation: user.ScopedAffiliation,
+			Groups:            user.Groups,
+		}
+
+		// Users that already exist, such as those kept by persistent storage, are replaced
+		message := "initialized user"
+		if existing != nil {
+			message = "updated user"
+			err = s.Store.UpdateUser(user.Username, loadedUser)
+		} else {
+			err = s.Store.AddUser(loadedUser)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = s.loadAccount(accounts[i]); err != nil {
+			return err
+		}
+
+		if err = s.loadProfile(user); err != nil {
+			return err
+		}
+
+		if err = s.loadTotpDevice(user); err != nil {
+			return err
+		}
+
+		log.Info().Str("username", user.Username).Msg(message)
 	}
 
 	return nil
 }
 
 func (s *Server) LoadServices(services []Service) error {
+	loaded := map[string]bool{}
+
 	for _, service := range services {
+		if loaded[service.EntityId] {
+			return fmt.Errorf("service provider %s is listed more than once: %w", service.EntityId, ErrAlreadyExists)
+		}
+		loaded[service.EntityId] = true
+
+		if service.WsFedTokenType != "" && !slices.Contains(wsFedTokenTypes, service.WsFedTokenType) {
+			return fmt.Errorf("service provider %s: unknown wsfed_token_type %q", service.EntityId, service.WsFedTokenType)
+		}
+
 		acs := saml.IndexedEndpoint{
 			Binding:  saml.HTTPPostBinding,
 			Location: service.AssertionConsumerService,
@@ -220,13 +501,20 @@ func (s *Server) LoadServices(services []Service) error {
 			AssertionConsumerServices: []saml.IndexedEndpoint{acs},
 		}
 
-		err := s.Store.AddServiceProvider(&samlidp.Service{
+		serviceProvider := &samlidp.Service{
 			Name: service.EntityId,
 			Metadata: saml.EntityDescriptor{
 				EntityID:         service.EntityId,
 				SPSSODescriptors: []saml.SPSSODescriptor{descriptor},
 			},
-		})
+		}
+
+		err := s.Store.AddServiceProvider(serviceProvider)
+
+		// Service providers kept by persistent storage are replaced
+		if errors.Is(err, ErrAlreadyExists) {
+			err = s.Store.UpdateServiceProvider(serviceProvider)
+		}
 
 		if err != nil {
 			return err
@@ -238,6 +526,39 @@ func (s *Server) LoadServices(services []Service) error {
 	return nil
 }
 
+func (s *Server) LoadClients(clients []Client) error {
+	for _, client := range clients {
+		err := s.Store.AddClient(&client)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Str("clientId", client.ClientId).Msg("Initialized OIDC client")
+	}
+
+	return nil
+}
+
+// Run listens on the PORT environment variable, or 8080, as gin does. If TLS is configured, it listens with TLS.
 func (s *Server) Run() error {
-	return s.router.Run()
+	if s.tlsConfig == nil {
+		return s.router.Run()
+	}
+
+	server := &http.Server{
+		Addr:      ":" + withDefault(os.Getenv("PORT"), "8080"),
+		Handler:   s.router,
+		TLSConfig: s.tlsConfig,
+	}
+
+	log.Info().Str("address", server.Addr).Msg("listening with TLS")
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// Close waits for pending provisioning and releases the storage used by the server
+func (s *Server) Close() error {
+	s.provisioner.wait()
+
+	return s.Store.Close()
 }
@@ -0,0 +1,121 @@
+package idp
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testEntityId = "test-sp"
+	testAcs      = "http://localhost:9009/saml/acs"
+)
+
+func newTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	gin.SetMode(gin.TestMode)
+
+	cert, key, err := GenerateDevelopmentCertificateAndKey()
+	require.NoError(t, err)
+
+	config := &Config{
+		Host: "http://localhost:8080",
+		Users: []User{
+			{Username: "test", Email: "test@test.com", Password: "test", FirstName: "Test", LastName: "User", Groups: []string{"foobar"}},
+		},
+		Services: []Service{
+			{EntityId: testEntityId, AssertionConsumerService: testAcs},
+			{EntityId: testEntityId + "-saml11", AssertionConsumerService: testAcs, WsFedTokenType: wsFedTokenTypeSaml11},
+		},
+		Clients: []Client{
+			{ClientId: testClientId, RedirectUris: []string{testRedirectUri}, PostLogoutRedirectUris: []string{testRedirectUri}},
+		},
+	}
+
+	for _, fn := range configure {
+		fn(config)
+	}
+
+	server := New(ServerOptions{Config: config, Key: key, Certificate: cert})
+	require.NoError(t, server.LoadUsers(config.Users))
+	require.NoError(t, server.LoadGroups(config.Groups))
+	require.NoError(t, server.LoadServices(config.Services))
+	require.NoError(t, server.LoadClients(config.Clients))
+
+	return server
+}
+
+func serve(server *Server, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func postForm(target string, form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestLoadUsers_Duplicates(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadUsers([]User{{Username: "dupe", Password: "a"}, {Username: "dupe", Password: "b"}})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	err = server.LoadUsers([]User{{Username: "other", Email: "test@test.com", Password: "a"}})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	// Loading a user that is already stored replaces it
+	require.NoError(t, server.LoadUsers([]User{{Username: "test", Email: "test@test.com", Password: "new", FirstName: "Reloaded"}}))
+
+	user, err := server.Store.GetUser("test")
+	require.NoError(t, err)
+	assert.Equal(t, "Reloaded", user.GivenName)
+}
+
+func TestLoadServices_Duplicates(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadServices([]Service{{EntityId: "dupe"}, {EntityId: "dupe"}})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	require.NoError(t, server.LoadServices([]Service{{EntityId: testEntityId, AssertionConsumerService: testAcs}}))
+}
+
+func TestLoadServices_UnknownTokenType(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.LoadServices([]Service{{EntityId: "typo", AssertionConsumerService: testAcs, WsFedTokenType: "saml1"}})
+	require.ErrorContains(t, err, "unknown wsfed_token_type")
+
+	_, err = server.Store.GetServiceProvider("typo")
+	require.Error(t, err)
+}
+
+func TestCreateUserPage_Conflict(t *testing.T) {
+	server := newTestServer(t)
+
+	form := url.Values{
+		"username":   {"test"},
+		"email":      {"someone@test.com"},
+		"first_name": {"Some"},
+		"last_name":  {"One"},
+		"password":   {"secret"},
+	}
+
+	w := serve(server, postForm("/users/create", form))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "user test already exists")
+
+	form.Set("username", "someone")
+	w = serve(server, postForm("/users/create", form))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	_, err := server.Store.GetUser("someone")
+	require.NoError(t, err)
+}
@@ -5,80 +5,397 @@ import (
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlidp"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/rs/zerolog/log"
 	"net/http"
+	"slices"
 	"time"
 )
 
+const (
+	sessionCookie = "session"
+
+	// nameIdAttribute carries a NameID chosen by an authenticator to the session, rather than being asserted
+	nameIdAttribute = "urn:test-saml-idp:name-id"
+)
+
+const (
+	identifierUsername = "username"
+	identifierEmail    = "email"
+	identifierAny      = "any"
+)
+
+var loginIdentifiers = []string{identifierUsername, identifierEmail, identifierAny}
+
 func (s *Server) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	form := samlLoginForm(req)
+
+	if s.config.LoginPage.SamlErrorStatus {
+		form.reject = func(w http.ResponseWriter, err *accountError) error {
+			return s.writeSamlError(w, req, err.status, err.message)
+		}
+	}
+
+	return s.resolveSession(w, r, form)
+}
+
+// writeSamlError answers the AuthnRequest with a response that carries the status instead of an assertion
+func (s *Server) writeSamlError(w http.ResponseWriter, req *saml.IdpAuthnRequest, status, message string) error {
+	response := &saml.Response{
+		Destination:  req.ACSEndpoint.Location,
+		ID:           "id-" + uuid.NewString(),
+		InResponseTo: req.Request.ID,
+		IssueInstant: req.Now,
+		Version:      "2.0",
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.IDP.MetadataURL.String(),
+		},
+		Status: saml.Status{
+			StatusCode: saml.StatusCode{
+				Value:      saml.StatusResponder,
+				StatusCode: &saml.StatusCode{Value: status},
+			},
+			StatusMessage: &saml.StatusMessage{Value: message},
+		},
+	}
+
+	signingContext, err := s.xmlSigningContext("ID")
+	if err != nil {
+		return err
+	}
+
+	signed, err := signingContext.SignEnveloped(response.Element())
+	if err != nil {
+		return err
+	}
+
+	// The signature has to follow the issuer, rather than come last where it was added
+	response.Signature = signed.ChildElements()[len(signed.ChildElements())-1]
+	req.ResponseEl = response.Element()
+
+	return req.WriteResponse(w)
+}
+
+// resolveSession authenticates the submitted credentials or looks up the existing session cookie.
+// If neither yields a valid session, the login page is rendered and nil is returned.
+func (s *Server) resolveSession(w http.ResponseWriter, r *http.Request, form loginForm) *saml.Session {
+	if r.Method == http.MethodPost && r.PostForm.Get(passwordChangeField) != "" {
+		return s.resolvePasswordChange(w, r, form)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get(mfaField) != "" {
+		return s.resolveMfa(w, r, form)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get(passkeyField) != "" {
+		return s.resolvePasskeyLogin(w, r, form)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get(certificateField) != "" {
+		return s.resolveCertificateLogin(w, r, form)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get(emailTokenField) != "" {
+		return s.resolveEmailLogin(w, r, form)
+	}
+
+	if r.Method == http.MethodPost && r.PostForm.Get(emailField) != "" {
+		return s.startEmailLogin(w, r, form)
+	}
+
 	if r.Method == http.MethodPost && r.PostForm.Get("username") != "" {
-		user, err := s.Store.GetUser(r.PostForm.Get("username"))
+		user, attributes, err := s.authenticate(r.PostForm.Get("username"), r.PostForm.Get("password"), form.Service)
 		if err != nil {
-			s.serveLoginPage(w, r, req, "Invalid username or password")
+			s.failLogin(w, r, form, user, err)
 			return nil
 		}
 
-		if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(r.PostForm.Get("password"))) != nil {
-			s.serveLoginPage(w, r, req, "Invalid username or password")
-			return nil
+		return s.completeLogin(w, r, form, user, attributes)
+	}
+
+	session, err := s.cookieSession(r)
+	if err == nil {
+		return session
+	}
+
+	if !errors.Is(err, samlidp.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	s.serveLoginPage(w, r, form, "")
+	return nil
+}
+
+// failLogin shows why the user could not log in. If only their password needs changing, they are asked to change it.
+func (s *Server) failLogin(w http.ResponseWriter, r *http.Request, form loginForm, user *samlidp.User, err error) {
+	toast := "Invalid username or password"
+
+	var accountErr *accountError
+	switch {
+	case errors.As(err, &accountErr):
+		if accountErr.changePassword && user != nil {
+			s.startPasswordChange(w, form, user, accountErr.message)
+			return
 		}
 
-		now := saml.TimeNow()
-		expires := now.Add(time.Duration(s.config.SessionMaxAge) * time.Minute)
-
-		session := &saml.Session{
-			ID:                    uuid.NewString(),
-			NameID:                user.Email,
-			CreateTime:            now,
-			ExpireTime:            expires,
-			Index:                 uuid.NewString(),
-			UserName:              user.Name,
-			Groups:                user.Groups[:],
-			UserEmail:             user.Email,
-			UserCommonName:        user.CommonName,
-			UserSurname:           user.Surname,
-			UserGivenName:         user.GivenName,
-			UserScopedAffiliation: user.ScopedAffiliation,
+		toast = accountErr.message
+
+		if form.reject != nil {
+			if err = form.reject(w, accountErr); err == nil {
+				return
+			}
+			log.Error().Err(err).Msg("error rejecting login")
 		}
+	case errors.Is(err, errInvalidPasskey):
+		toast = "Your passkey was not recognised"
+	case errors.Is(err, errInvalidCertificate):
+		toast = "Your certificate was not recognised"
+	case !errors.Is(err, errInvalidCredentials):
+		log.Error().Err(err).Msg("error authenticating user")
+	}
 
-		if s.Store.AddSession(session) != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return nil
+	s.serveLoginPage(w, r, form, toast)
+}
+
+// cookieSession returns the session referenced by the session cookie. It fails with samlidp.ErrNotFound if there is
+// no such session or it can no longer be used.
+func (s *Server) cookieSession(r *http.Request) (*saml.Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, samlidp.ErrNotFound
+	}
+
+	session, err := s.Store.GetSession(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if saml.TimeNow().After(session.ExpireTime) {
+		return nil, samlidp.ErrNotFound
+	}
+
+	// The account may have been locked or reached its valid_until date since the session began
+	account, err := s.account(session.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.check(saml.TimeNow(), s.passwordMaxAge()) != nil {
+		return nil, samlidp.ErrNotFound
+	}
+
+	return session, nil
+}
+
+// startSession logs the user in, creating their session and setting the session cookie
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *samlidp.User, attributes []saml.Attribute) *saml.Session {
+	now := saml.TimeNow()
+	expires := now.Add(time.Duration(s.config.SessionMaxAge) * time.Minute)
+
+	profile, err := s.profile(user.Name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	groups, groupAttributes, err := s.resolveGroups(user, profile, attributes)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	nameId, attributes := takeNameId(user.Email, slices.Concat(profile.attributes(), groupAttributes, attributes))
+
+	session := &saml.Session{
+		ID:                    uuid.NewString(),
+		NameID:                nameId,
+		CreateTime:            now,
+		ExpireTime:            expires,
+		Index:                 uuid.NewString(),
+		UserName:              user.Name,
+		Groups:                groups,
+		UserEmail:             user.Email,
+		UserCommonName:        user.CommonName,
+		UserSurname:           user.Surname,
+		UserGivenName:         user.GivenName,
+		UserScopedAffiliation: user.ScopedAffiliation,
+		CustomAttributes:      attributes,
+	}
+
+	if s.Store.AddSession(session) != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.ID,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https",
+		Path:     "/",
+	})
+
+	return session
+}
+
+// serviceSession returns a copy of the session as it is asserted to the service, with groups in the format it expects
+// and the user's overrides for it applied
+func (s *Server) serviceSession(session *saml.Session, service string) (*saml.Session, error) {
+	asserted := *session
+
+	format := s.config.GroupFormat
+	if options, ok := s.serviceOptions(service); ok && options.GroupFormat != "" {
+		format = options.GroupFormat
+	}
+
+	groups, err := s.formatGroups(session.Groups, format)
+	if err != nil {
+		return nil, err
+	}
+	asserted.Groups = groups
+
+	override, err := s.serviceOverride(session.UserName, service)
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		override.apply(&asserted)
+	}
+
+	return &asserted, nil
+}
+
+// stringAttribute builds a custom attribute of the session, which is added to assertions as it is
+func stringAttribute(name string, values ...string) saml.Attribute {
+	attribute := saml.Attribute{
+		FriendlyName: name,
+		Name:         name,
+		NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+	}
+	for _, value := range values {
+		attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+	}
+
+	return attribute
+}
+
+// takeNameId returns the NameID chosen by whatever authenticated the user, if it did, and the attributes without it
+func takeNameId(nameId string, attributes []saml.Attribute) (string, []saml.Attribute) {
+	return nameId, slices.DeleteFunc(slices.Clone(attributes), func(attribute saml.Attribute) bool {
+		if attribute.Name != nameIdAttribute || len(attribute.Values) == 0 {
+			return false
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    session.ID,
-			Expires:  expires,
-			HttpOnly: true,
-			Secure:   r.URL.Scheme == "https",
-			Path:     "/",
-		})
+		nameId = attribute.Values[0].Value
+		return true
+	})
+}
 
-		return session
+// authenticate verifies the credentials of a user logging in to the service, which the webhook may need to know.
+// If the password is right but the account cannot be used, the user is returned along with an accountError.
+func (s *Server) authenticate(username, password, service string) (*samlidp.User, []saml.Attribute, error) {
+	if s.webhook != nil && s.webhook.options.Mode == webhookModeReplace {
+		return s.webhook.authenticate(username, password, service)
 	}
 
-	if cookie, err := r.Cookie("session"); err == nil {
-		session, err := s.Store.GetSession(cookie.Value)
+	user, attributes, err := s.authenticateDirectory(username, password)
+	if s.webhook != nil && errors.Is(err, errInvalidCredentials) {
+		return s.webhook.authenticate(username, password, service)
+	}
 
-		if err != nil {
-			if errors.Is(err, samlidp.ErrNotFound) {
-				s.serveLoginPage(w, r, req, "")
-				return nil
+	return user, attributes, err
+}
+
+// authenticateDirectory verifies the credentials against the configured users and, if enabled, the LDAP directory
+func (s *Server) authenticateDirectory(username, password string) (*samlidp.User, []saml.Attribute, error) {
+	if s.ldap == nil || s.ldap.options.Mode != ldapModeReplace {
+		user, err := s.findUser(username)
+		if err == nil {
+			err = s.checkCredentials(user, password)
+			if err == nil {
+				return user, nil, nil
 			}
 
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return nil
+			// Only a wrong password is worth trying against the directory
+			if !errors.Is(err, errInvalidCredentials) {
+				return user, nil, err
+			}
 		}
 
-		if saml.TimeNow().After(session.ExpireTime) {
-			s.serveLoginPage(w, r, req, "")
-			return nil
+		if s.ldap == nil {
+			return nil, nil, errInvalidCredentials
 		}
+	}
 
-		return session
+	return s.ldap.authenticate(username, password)
+}
+
+// findUser looks up the user that logs in with the identifier, which is their username, email address or either,
+// depending on the login page options
+func (s *Server) findUser(identifier string) (*samlidp.User, error) {
+	options := s.config.LoginPage
+
+	if options.Identifier != identifierEmail {
+		user, err := s.findUserByName(identifier)
+		if options.Identifier == identifierUsername || !errors.Is(err, samlidp.ErrNotFound) {
+			return user, err
+		}
 	}
 
-	s.serveLoginPage(w, r, req, "")
-	return nil
+	return s.findUserByEmail(identifier)
+}
+
+func (s *Server) findUserByName(name string) (*samlidp.User, error) {
+	user, err := s.Store.GetUser(name)
+	if !s.config.LoginPage.CaseInsensitive || !errors.Is(err, samlidp.ErrNotFound) {
+		return user, err
+	}
+
+	users, err := s.Store.GetUsersByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return singleUser(users)
+}
+
+// findUserByEmail looks up the only user with the email address, ignoring its case if the login page does
+func (s *Server) findUserByEmail(email string) (*samlidp.User, error) {
+	users, err := s.Store.GetUsersByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.config.LoginPage.CaseInsensitive {
+		users = slices.DeleteFunc(users, func(user *samlidp.User) bool { return user.Email != email })
+	}
+
+	return singleUser(users)
+}
+
+// singleUser returns the only user in users. An identifier shared by several users cannot tell them apart,
+// so it is treated as unknown.
+func singleUser(users []*samlidp.User) (*samlidp.User, error) {
+	if len(users) != 1 {
+		return nil, samlidp.ErrNotFound
+	}
+
+	return users[0], nil
+}
+
+// endSession removes the session referenced by the session cookie and clears the cookie
+func (s *Server) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		_ = s.Store.DeleteSession(cookie.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Path:     "/",
+	})
 }
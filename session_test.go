@@ -0,0 +1,84 @@
+package idp
+
+import (
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuthenticate_Identifiers(t *testing.T) {
+	tests := []struct {
+		identifier      string
+		caseInsensitive bool
+		login           string
+		valid           bool
+	}{
+		{identifierUsername, false, "test", true},
+		{identifierUsername, false, "TEST", false},
+		{identifierUsername, false, "test@test.com", false},
+		{identifierUsername, true, "TEST", true},
+		{identifierEmail, false, "test@test.com", true},
+		{identifierEmail, false, "Test@Test.com", false},
+		{identifierEmail, false, "test", false},
+		{identifierEmail, true, "Test@Test.com", true},
+		{identifierAny, false, "test", true},
+		{identifierAny, false, "test@test.com", true},
+		{identifierAny, true, "TEST@TEST.COM", true},
+	}
+
+	for _, test := range tests {
+		server := newTestServer(t, func(config *Config) {
+			config.LoginPage.Identifier = test.identifier
+			config.LoginPage.CaseInsensitive = test.caseInsensitive
+		})
+
+		user, _, err := server.authenticate(test.login, "test", "")
+		if !test.valid {
+			assert.ErrorIs(t, err, errInvalidCredentials, "%s %q", test.identifier, test.login)
+			continue
+		}
+
+		require.NoError(t, err, "%s %q", test.identifier, test.login)
+		assert.Equal(t, "test", user.Name)
+	}
+}
+
+func TestAuthenticate_AmbiguousIdentifier(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.LoginPage.CaseInsensitive = true
+		config.Users = append(config.Users, User{Username: "Test", Password: "test"})
+	})
+
+	_, _, err := server.authenticate("TEST", "test", "")
+	require.ErrorIs(t, err, errInvalidCredentials)
+
+	user, _, err := server.authenticate("Test", "test", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Test", user.Name)
+}
+
+func TestLoginPage_Hint(t *testing.T) {
+	server := newTestServer(t, func(config *Config) {
+		config.LoginPage.Identifier = identifierEmail
+	})
+
+	params := authorizeParams()
+	params.Set("login_hint", "test@test.com")
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, authorizeRoute+"?"+params.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `value="test@test.com"`)
+	assert.Contains(t, w.Body.String(), "Email:")
+
+	form := samlLoginForm(&saml.IdpAuthnRequest{
+		IDP: &saml.IdentityProvider{SSOURL: url.URL{Scheme: "http", Host: "localhost"}},
+		Request: saml.AuthnRequest{
+			Subject: &saml.Subject{NameID: &saml.NameID{Value: "test@test.com"}},
+		},
+	})
+	assert.Equal(t, "test@test.com", form.Hint)
+}
@@ -1,31 +1,546 @@
 package idp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlidp"
+	"io"
+	"slices"
+	"sync"
+	"time"
 )
 
 const (
 	usersPrefix    = "/users/"
+	groupsPrefix   = "/groups/"
 	servicesPrefix = "/services/"
 	sessionsPrefix = "/sessions/"
+	clientsPrefix  = "/clients/"
+	codesPrefix    = "/oidc/codes/"
+	refreshPrefix  = "/oidc/refresh_tokens/"
+	syncPrefix     = "/provisioning/"
+	accountsPrefix = "/accounts/"
+	passwordPrefix = "/password_changes/"
+	totpPrefix     = "/totp/"
+	mfaPrefix      = "/mfa_challenges/"
+	passkeysPrefix = "/passkeys/"
+	ceremonyPrefix = "/passkey_ceremonies/"
+	emailPrefix    = "/email_logins/"
+	mailboxPrefix  = "/mailbox/"
+	profilesPrefix = "/profiles/"
+
+	storageMemory = "memory"
 )
 
+// ErrAlreadyExists is returned when adding a user or service provider would replace an existing one,
+// or a user's email address is already used by another user
+var ErrAlreadyExists = errors.New("already exists")
+
+// Group is a group that exists independently of its members, such as one configured or provisioned via SCIM.
+// Membership is mostly tracked on each user, but configured groups can also list their members and subgroups.
+type Group struct {
+	Name       string `mapstructure:"name" json:"name"`
+	ExternalId string `mapstructure:"external_id" json:"external_id,omitempty"`
+
+	// Optional. Used when groups are asserted by id or DN. Defaults to a UUID derived from the name, and to the name
+	// beneath group_base_dn
+	Id string `mapstructure:"id" json:"id,omitempty"`
+	Dn string `mapstructure:"dn" json:"dn,omitempty"`
+
+	Description string `mapstructure:"description" json:"description,omitempty"`
+
+	// Optional. Usernames of members, in addition to the users that list the group themselves
+	Members []string `mapstructure:"members" json:"members,omitempty"`
+
+	// Optional. Names of groups whose members are also members of this group, however deeply they are nested
+	Subgroups []string `mapstructure:"subgroups" json:"subgroups,omitempty"`
+
+	// Optional. Attributes asserted for every member, such as a role granted to all of them
+	Attributes map[string][]string `mapstructure:"attributes" json:"attributes,omitempty"`
+
+	// Optional. Users that match any of these rules when they log in are also members
+	Rules []GroupRule `mapstructure:"rules" json:"rules,omitempty"`
+}
+
+// GroupRule matches the users for whom every condition that is set holds
+type GroupRule struct {
+	// Optional. The domain of the user's email address, such as "contractors.example.com", which is matched
+	// regardless of case
+	EmailDomain string `mapstructure:"email_domain" json:"email_domain,omitempty"`
+
+	// Optional. The name of a user field, such as "department", or of an attribute the user was authenticated with,
+	// which must have the value of Equals
+	Attribute string `mapstructure:"attribute" json:"attribute,omitempty"`
+	Equals    string `mapstructure:"equals" json:"equals,omitempty"`
+
+	// Optional. A regular expression that the username must match
+	UsernamePattern string `mapstructure:"username_pattern" json:"username_pattern,omitempty"`
+}
+
+// UserObserver is notified after a user has been saved to, renamed in or deleted from the Store. Observers are called
+// once the Store is no longer locked, so they may block without holding up other writes.
+type UserObserver interface {
+	UserSaved(user samlidp.User)
+
+	// UserRenamed is called instead of UserSaved and UserDeleted when a user is saved under a new name
+	UserRenamed(name string, user samlidp.User)
+
+	UserDeleted(name string)
+}
+
+// ExpiringBackend is implemented by backends that can remove values by themselves once they expire
+type ExpiringBackend interface {
+	PutWithExpiry(key string, value any, expires time.Time) error
+}
+
+// Store holds the IdP's users, services and sessions. Its zero value keeps everything in memory
 type Store struct {
-	samlidp.MemoryStore
+	// Optional. Persists the Store's data instead of keeping it in memory. It must be set before the Store is in use
+	Backend samlidp.Store
+
+	// Optional. If set, updating a user's attributes also deletes their sessions
+	RevokeSessionsOnUpdate bool
+
+	memory    samlidp.MemoryStore
+	users     userRepository
+	usersOnce sync.Once
+	observers []UserObserver
+
+	// writes serialises the checks made before users and service providers are saved with the saving itself, and the
+	// changes made to accounts
+	writes sync.Mutex
 }
 
-func (s *Store) GetUser(name string) (user *samlidp.User, err error) {
-	err = s.Get(usersPrefix+name, &user)
-	return
+func (s *Store) backend() samlidp.Store {
+	if s.Backend != nil {
+		return s.Backend
+	}
+
+	return &s.memory
+}
+
+func (s *Store) Get(key string, value any) error {
+	return s.backend().Get(key, value)
+}
+
+func (s *Store) Put(key string, value any) error {
+	return s.backend().Put(key, value)
+}
+
+func (s *Store) Delete(key string) error {
+	return s.backend().Delete(key)
+}
+
+func (s *Store) List(prefix string) ([]string, error) {
+	return s.backend().List(prefix)
+}
+
+// repository returns where users and sessions are kept. In memory, they are held as they are rather than as JSON
+func (s *Store) repository() userRepository {
+	s.usersOnce.Do(func() {
+		if s.Backend != nil {
+			s.users = &kvRepository{backend: s.Backend}
+		} else {
+			s.users = newMemoryRepository()
+		}
+	})
+
+	return s.users
+}
+
+// Close releases the backend, if it holds any resources such as an open file
+func (s *Store) Close() error {
+	if closer, ok := s.Backend.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Observe registers an observer for user changes. It must be called before the Store is in use.
+func (s *Store) Observe(observer UserObserver) {
+	s.observers = append(s.observers, observer)
+}
+
+func (s *Store) GetUser(name string) (*samlidp.User, error) {
+	return s.repository().GetUser(name)
 }
 
 func (s *Store) GetUsers() ([]*samlidp.User, error) {
-	return getResources[samlidp.User](s, usersPrefix, s.GetUser)
+	return s.repository().GetUsers()
+}
+
+// GetUsersByName returns the users with the given username, ignoring case
+func (s *Store) GetUsersByName(name string) ([]*samlidp.User, error) {
+	return s.repository().GetUsersByName(name)
 }
 
+// GetUsersByEmail returns the users with the given email address, ignoring case
+func (s *Store) GetUsersByEmail(email string) ([]*samlidp.User, error) {
+	return s.repository().GetUsersByEmail(email)
+}
+
+// GetGroupMembers returns the users that are members of the group
+func (s *Store) GetGroupMembers(group string) ([]*samlidp.User, error) {
+	return s.repository().GetGroupMembers(group)
+}
+
+// AddUser saves a new user. It fails with ErrAlreadyExists if the username or email address is taken.
 func (s *Store) AddUser(user *samlidp.User) error {
-	return s.Put(usersPrefix+user.Name, user)
+	if err := s.addUser(user); err != nil {
+		return err
+	}
+
+	for _, observer := range s.observers {
+		observer.UserSaved(snapshotUser(user))
+	}
+
+	return nil
+}
+
+func (s *Store) addUser(user *samlidp.User) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	if err := s.checkUsername(user.Name); err != nil {
+		return err
+	}
+
+	if err := s.checkEmail(user.Email, ""); err != nil {
+		return err
+	}
+
+	return s.repository().PutUser(user)
+}
+
+// UpdateUser replaces the user with the given name, which fails with samlidp.ErrNotFound if there is no such user.
+// The user may be renamed, in which case it fails with ErrAlreadyExists if the new username is taken, as it does
+// if the email address is used by another user. Renaming a user deletes the sessions of their previous name.
+func (s *Store) UpdateUser(name string, user *samlidp.User) error {
+	existing, err := s.updateUser(name, user)
+	if err != nil {
+		return err
+	}
+
+	for _, observer := range s.observers {
+		if user.Name != name {
+			observer.UserRenamed(name, snapshotUser(user))
+		} else {
+			observer.UserSaved(snapshotUser(user))
+		}
+	}
+
+	if user.Name == name && s.RevokeSessionsOnUpdate && !sameAttributes(existing, user) {
+		return s.DeleteUserSessions(name)
+	}
+
+	return nil
+}
+
+// updateUser saves the user, moving everything kept about them to their new name if they are renamed, and returns
+// the user as they were
+func (s *Store) updateUser(name string, user *samlidp.User) (*samlidp.User, error) {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	existing, err := s.GetUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Name != name {
+		if err := s.checkUsername(user.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkEmail(user.Email, name); err != nil {
+		return nil, err
+	}
+
+	if err := s.repository().PutUser(user); err != nil {
+		return nil, err
+	}
+
+	if user.Name == name {
+		return existing, nil
+	}
+
+	if err := s.renameAccount(name, user.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.renameProfile(name, user.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.renameTotpDevice(name, user.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.renamePasskeys(name, user.Name); err != nil {
+		return nil, err
+	}
+
+	return existing, s.deleteUser(name)
+}
+
+// sameAttributes reports whether two users would be asserted with the same attributes
+func sameAttributes(a, b *samlidp.User) bool {
+	return a.Email == b.Email &&
+		a.CommonName == b.CommonName &&
+		a.GivenName == b.GivenName &&
+		a.Surname == b.Surname &&
+		a.ScopedAffiliation == b.ScopedAffiliation &&
+		slices.Equal(a.Groups, b.Groups)
+}
+
+func (s *Store) checkUsername(name string) error {
+	_, err := s.GetUser(name)
+	if err == nil {
+		return fmt.Errorf("user %s %w", name, ErrAlreadyExists)
+	}
+	if !errors.Is(err, samlidp.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// checkEmail ensures that no user other than the one named owner has the email address
+func (s *Store) checkEmail(email, owner string) error {
+	if email == "" {
+		return nil
+	}
+
+	users, err := s.GetUsersByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.Name != owner {
+			return fmt.Errorf("user with email %s %w", email, ErrAlreadyExists)
+		}
+	}
+
+	return nil
+}
+
+// snapshotUser copies the user for observers, which may hold on to it after the caller has changed it
+func snapshotUser(user *samlidp.User) samlidp.User {
+	snapshot := *user
+	snapshot.Groups = slices.Clone(user.Groups)
+
+	return snapshot
+}
+
+// DeleteUser removes the user along with their account, profile, TOTP device, passkeys and sessions
+func (s *Store) DeleteUser(name string) error {
+	if err := s.deleteUser(name); err != nil {
+		return err
+	}
+
+	for _, observer := range s.observers {
+		observer.UserDeleted(name)
+	}
+
+	return nil
+}
+
+func (s *Store) deleteUser(name string) error {
+	if err := s.repository().DeleteUser(name); err != nil {
+		return err
+	}
+
+	if err := s.DeleteAccount(name); err != nil {
+		return err
+	}
+
+	if err := s.DeleteProfile(name); err != nil {
+		return err
+	}
+
+	if err := s.DeleteTotpDevice(name); err != nil {
+		return err
+	}
+
+	if err := s.DeletePasskeys(name); err != nil {
+		return err
+	}
+
+	return s.DeleteUserSessions(name)
+}
+
+func (s *Store) GetAccount(name string) (account *Account, err error) {
+	err = s.Get(accountsPrefix+name, &account)
+	return
+}
+
+func (s *Store) GetAccounts() ([]*Account, error) {
+	return getResources(s, accountsPrefix, s.GetAccount)
+}
+
+// AddAccount saves the state of a user's account. Disabling or locking it ends the user's sessions.
+func (s *Store) AddAccount(account *Account) error {
+	if err := s.Put(accountsPrefix+account.Username, account); err != nil {
+		return err
+	}
+
+	if account.Status == accountDisabled || account.Status == accountLocked {
+		return s.DeleteUserSessions(account.Username)
+	}
+
+	return nil
+}
+
+// UpdateAccount changes the named user's account, which is active if nothing has been recorded about it. No other
+// update to it can happen in between, so that concurrent changes, such as failed logins being counted, are not lost.
+func (s *Store) UpdateAccount(name string, update func(account *Account)) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	account, err := s.GetAccount(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		account, err = &Account{Username: name, Status: accountActive}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	update(account)
+
+	return s.AddAccount(account)
+}
+
+func (s *Store) DeleteAccount(name string) error {
+	return s.Delete(accountsPrefix + name)
+}
+
+func (s *Store) renameAccount(name, newName string) error {
+	account, err := s.GetAccount(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	account.Username = newName
+	return s.AddAccount(account)
+}
+
+func (s *Store) GetProfile(name string) (profile *Profile, err error) {
+	err = s.Get(profilesPrefix+name, &profile)
+	return
+}
+
+func (s *Store) AddProfile(profile *Profile) error {
+	return s.Put(profilesPrefix+profile.Username, profile)
+}
+
+func (s *Store) DeleteProfile(name string) error {
+	return s.Delete(profilesPrefix + name)
+}
+
+func (s *Store) renameProfile(name, newName string) error {
+	profile, err := s.GetProfile(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	profile.Username = newName
+	return s.AddProfile(profile)
+}
+
+func (s *Store) GetTotpDevice(name string) (device *totpDevice, err error) {
+	err = s.Get(totpPrefix+name, &device)
+	return
+}
+
+func (s *Store) AddTotpDevice(device *totpDevice) error {
+	return s.Put(totpPrefix+device.Username, device)
+}
+
+func (s *Store) DeleteTotpDevice(name string) error {
+	return s.Delete(totpPrefix + name)
+}
+
+func (s *Store) renameTotpDevice(name, newName string) error {
+	device, err := s.GetTotpDevice(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	device.Username = newName
+	return s.AddTotpDevice(device)
+}
+
+func (s *Store) GetPasskeys(name string) (passkeys *passkeyUser, err error) {
+	err = s.Get(passkeysPrefix+name, &passkeys)
+	return
+}
+
+// GetPasskeysByHandle returns the passkeys with the user handle that authenticators store alongside them
+func (s *Store) GetPasskeysByHandle(handle []byte) (*passkeyUser, error) {
+	all, err := getResources(s.backend(), passkeysPrefix, s.GetPasskeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, passkeys := range all {
+		if bytes.Equal(passkeys.Id, handle) {
+			return passkeys, nil
+		}
+	}
+
+	return nil, samlidp.ErrNotFound
+}
+
+func (s *Store) AddPasskeys(passkeys *passkeyUser) error {
+	return s.Put(passkeysPrefix+passkeys.Username, passkeys)
+}
+
+func (s *Store) DeletePasskeys(name string) error {
+	return s.Delete(passkeysPrefix + name)
+}
+
+func (s *Store) renamePasskeys(name, newName string) error {
+	passkeys, err := s.GetPasskeys(name)
+	if errors.Is(err, samlidp.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	passkeys.Username = newName
+	return s.AddPasskeys(passkeys)
+}
+
+func (s *Store) GetGroup(name string) (group *Group, err error) {
+	err = s.Get(groupsPrefix+name, &group)
+	return
+}
+
+func (s *Store) GetGroups() ([]*Group, error) {
+	return getResources(s, groupsPrefix, s.GetGroup)
+}
+
+func (s *Store) AddGroup(group *Group) error {
+	return s.Put(groupsPrefix+group.Name, group)
+}
+
+func (s *Store) DeleteGroup(name string) error {
+	return s.Delete(groupsPrefix + name)
 }
 
 func (s *Store) GetServiceProvider(id string) (service *samlidp.Service, err error) {
@@ -34,38 +549,299 @@ func (s *Store) GetServiceProvider(id string) (service *samlidp.Service, err err
 }
 
 func (s *Store) GetServiceProviders() ([]*samlidp.Service, error) {
-	return getResources[samlidp.Service](s, servicesPrefix, s.GetServiceProvider)
+	return getResources(s, servicesPrefix, s.GetServiceProvider)
 }
 
+// AddServiceProvider saves a new service provider. It fails with ErrAlreadyExists if the entity id is taken.
 func (s *Store) AddServiceProvider(service *samlidp.Service) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	_, err := s.GetServiceProvider(service.Metadata.EntityID)
+	if err == nil {
+		return fmt.Errorf("service provider %s %w", service.Metadata.EntityID, ErrAlreadyExists)
+	}
+	if !errors.Is(err, samlidp.ErrNotFound) {
+		return err
+	}
+
 	return s.Put(servicesPrefix+service.Metadata.EntityID, service)
 }
 
-func (s *Store) GetSession(id string) (session *saml.Session, err error) {
-	err = s.Get(sessionsPrefix+id, &session)
-	return
+// UpdateServiceProvider replaces an existing service provider, failing with samlidp.ErrNotFound if there is none
+func (s *Store) UpdateServiceProvider(service *samlidp.Service) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	if _, err := s.GetServiceProvider(service.Metadata.EntityID); err != nil {
+		return err
+	}
+
+	return s.Put(servicesPrefix+service.Metadata.EntityID, service)
+}
+
+// DeleteServiceProvider removes the service provider along with the status of users provisioned into it
+func (s *Store) DeleteServiceProvider(id string) error {
+	if err := s.Delete(servicesPrefix + id); err != nil {
+		return err
+	}
+
+	keys, err := s.List(syncPrefix + id + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		status, err := s.GetSyncStatus(id, key)
+		if err != nil {
+			return err
+		}
+
+		// Entity ids may contain slashes, so the keys can also belong to a service whose id starts with this one
+		if status.Service != id {
+			continue
+		}
+
+		if err = s.Delete(syncPrefix + id + "/" + key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) GetSession(id string) (*saml.Session, error) {
+	return s.repository().GetSession(id)
 }
 
 func (s *Store) GetSessions() ([]*saml.Session, error) {
-	return getResources[saml.Session](s, sessionsPrefix, s.GetSession)
+	return s.repository().GetSessions()
+}
+
+// GetUserSessions returns the sessions of the user with the given name
+func (s *Store) GetUserSessions(name string) ([]*saml.Session, error) {
+	return s.repository().GetUserSessions(name)
 }
 
 func (s *Store) AddSession(session *saml.Session) error {
-	return s.Put(sessionsPrefix+session.ID, session)
+	return s.repository().PutSession(session)
+}
+
+func (s *Store) DeleteSession(id string) error {
+	return s.repository().DeleteSession(id)
+}
+
+// DeleteUserSessions removes every session of the user with the given name, logging them out
+func (s *Store) DeleteUserSessions(name string) error {
+	sessions, err := s.GetUserSessions(name)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err = s.DeleteSession(session.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteExpiredSessions removes sessions that have expired, which would otherwise pile up in a persistent backend
+func (s *Store) DeleteExpiredSessions() error {
+	sessions, err := s.GetSessions()
+	if err != nil {
+		return err
+	}
+
+	now := saml.TimeNow()
+	for _, session := range sessions {
+		if now.After(session.ExpireTime) {
+			if err = s.DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) GetClient(id string) (client *Client, err error) {
+	err = s.Get(clientsPrefix+id, &client)
+	return
+}
+
+func (s *Store) GetClients() ([]*Client, error) {
+	return getResources(s, clientsPrefix, s.GetClient)
+}
+
+func (s *Store) AddClient(client *Client) error {
+	return s.Put(clientsPrefix+client.ClientId, client)
+}
+
+func (s *Store) DeleteClient(id string) error {
+	return s.Delete(clientsPrefix + id)
+}
+
+func (s *Store) GetAuthorizationCode(code string) (grant *authorizationGrant, err error) {
+	err = s.Get(codesPrefix+code, &grant)
+	return
+}
+
+func (s *Store) AddAuthorizationCode(code string, grant *authorizationGrant) error {
+	return putExpiring(s.backend(), codesPrefix+code, grant, grant.ExpireTime)
+}
+
+func (s *Store) DeleteAuthorizationCode(code string) error {
+	return s.Delete(codesPrefix + code)
+}
+
+func (s *Store) GetRefreshToken(token string) (grant *authorizationGrant, err error) {
+	err = s.Get(refreshPrefix+token, &grant)
+	return
+}
+
+func (s *Store) AddRefreshToken(token string, grant *authorizationGrant) error {
+	return putExpiring(s.backend(), refreshPrefix+token, grant, grant.ExpireTime)
 }
 
-func getResources[T any](store *Store, prefix string, getter func(string) (*T, error)) ([]*T, error) {
-	keys, _ := store.List(prefix)
+func (s *Store) DeleteRefreshToken(token string) error {
+	return s.Delete(refreshPrefix + token)
+}
 
-	resources := make([]*T, len(keys))
+func (s *Store) GetPasswordChange(token string) (change *passwordChange, err error) {
+	err = s.Get(passwordPrefix+token, &change)
+	return
+}
 
-	for i, key := range keys {
+func (s *Store) AddPasswordChange(token string, change *passwordChange) error {
+	return putExpiring(s.backend(), passwordPrefix+token, change, change.ExpireTime)
+}
+
+func (s *Store) DeletePasswordChange(token string) error {
+	return s.Delete(passwordPrefix + token)
+}
+
+func (s *Store) GetMfaChallenge(token string) (challenge *mfaChallenge, err error) {
+	err = s.Get(mfaPrefix+token, &challenge)
+	return
+}
+
+func (s *Store) AddMfaChallenge(token string, challenge *mfaChallenge) error {
+	return putExpiring(s.backend(), mfaPrefix+token, challenge, challenge.ExpireTime)
+}
+
+func (s *Store) DeleteMfaChallenge(token string) error {
+	return s.Delete(mfaPrefix + token)
+}
+
+func (s *Store) GetPasskeyCeremony(token string) (ceremony *passkeyCeremony, err error) {
+	err = s.Get(ceremonyPrefix+token, &ceremony)
+	return
+}
+
+func (s *Store) AddPasskeyCeremony(token string, ceremony *passkeyCeremony) error {
+	return putExpiring(s.backend(), ceremonyPrefix+token, ceremony, ceremony.ExpireTime)
+}
+
+func (s *Store) DeletePasskeyCeremony(token string) error {
+	return s.Delete(ceremonyPrefix + token)
+}
+
+func (s *Store) GetEmailLogin(token string) (login *emailLogin, err error) {
+	err = s.Get(emailPrefix+token, &login)
+	return
+}
+
+func (s *Store) AddEmailLogin(token string, login *emailLogin) error {
+	return putExpiring(s.backend(), emailPrefix+token, login, login.ExpireTime)
+}
+
+func (s *Store) DeleteEmailLogin(token string) error {
+	return s.Delete(emailPrefix + token)
+}
+
+func (s *Store) GetMail(id string) (mail *Mail, err error) {
+	err = s.Get(mailboxPrefix+id, &mail)
+	return
+}
+
+func (s *Store) GetMailbox() ([]*Mail, error) {
+	return getResources(s, mailboxPrefix, s.GetMail)
+}
+
+func (s *Store) AddMail(mail *Mail) error {
+	return s.Put(mailboxPrefix+mail.Id, mail)
+}
+
+// ClearMailbox deletes every message in the mailbox
+func (s *Store) ClearMailbox() error {
+	keys, err := s.List(mailboxPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = s.Delete(mailboxPrefix + key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) GetSyncStatus(entityId, username string) (status *SyncStatus, err error) {
+	err = s.Get(syncPrefix+entityId+"/"+username, &status)
+	return
+}
+
+func (s *Store) GetSyncStatuses() ([]*SyncStatus, error) {
+	return getResources(s, syncPrefix, func(key string) (*SyncStatus, error) {
+		var status *SyncStatus
+		err := s.Get(syncPrefix+key, &status)
+		return status, err
+	})
+}
+
+func (s *Store) AddSyncStatus(status *SyncStatus) error {
+	return s.Put(syncPrefix+status.Service+"/"+status.Username, status)
+}
+
+func (s *Store) DeleteSyncStatus(entityId, username string) error {
+	return s.Delete(syncPrefix + entityId + "/" + username)
+}
+
+// openBackend returns the backend selected by the storage options, or nil if data is kept in memory
+func openBackend(options StorageOptions) (samlidp.Store, error) {
+	switch options.Type {
+	case "", storageMemory:
+		return nil, nil
+	case storageBolt:
+		return openBoltStore(options.Path)
+	case storageRedis:
+		return openRedisStore(options)
+	}
+
+	return nil, fmt.Errorf("unknown storage type %q", options.Type)
+}
+
+func getResources[T any](backend samlidp.Store, prefix string, getter func(string) (*T, error)) ([]*T, error) {
+	keys, _ := backend.List(prefix)
+
+	resources := make([]*T, 0, len(keys))
+
+	for _, key := range keys {
 		resource, err := getter(key)
+
+		// Keys can expire, or be deleted by another replica, after they were listed
+		if errors.Is(err, samlidp.ErrNotFound) {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		resources[i] = resource
+		resources = append(resources, resource)
 	}
 
 	return resources, nil
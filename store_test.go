@@ -161,11 +161,92 @@ func Test_GetResourcesEmptyList(t *testing.T) {
 
 func Test_GetResourcesGetterError(t *testing.T) {
 	store := &Store{}
-	_ = store.AddUser(&samlidp.User{Name: "Test"})
+	_ = store.AddGroup(&Group{Name: "Test"})
 
-	users, err := getResources[samlidp.User](store, usersPrefix, func(string) (*samlidp.User, error) {
+	groups, err := getResources[Group](store, groupsPrefix, func(string) (*Group, error) {
 		return nil, errors.New("foobar")
 	})
-	require.Nil(t, users)
+	require.Nil(t, groups)
 	require.Error(t, err)
 }
+
+func TestOpenBackend_UnknownType(t *testing.T) {
+	_, err := openBackend(StorageOptions{Type: "floppy"})
+	require.Error(t, err)
+}
+
+func TestStore_AddUserConflict(t *testing.T) {
+	store := &Store{}
+
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "Test", Email: "test@test.com"}))
+
+	err := store.AddUser(&samlidp.User{Name: "Test"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	err = store.AddUser(&samlidp.User{Name: "Other", Email: "TEST@test.com"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "Other"}))
+}
+
+func TestStore_UpdateUser(t *testing.T) {
+	store := &Store{}
+
+	err := store.UpdateUser("Test", &samlidp.User{Name: "Test"})
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "Test", Email: "test@test.com"}))
+	require.NoError(t, store.AddUser(&samlidp.User{Name: "Other", Email: "other@test.com"}))
+
+	require.NoError(t, store.UpdateUser("Test", &samlidp.User{Name: "Test", Email: "test@test.com", GivenName: "Updated"}))
+
+	err = store.UpdateUser("Test", &samlidp.User{Name: "Test", Email: "other@test.com"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	err = store.UpdateUser("Test", &samlidp.User{Name: "Other", Email: "test@test.com"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	require.NoError(t, store.UpdateUser("Test", &samlidp.User{Name: "Renamed", Email: "test@test.com"}))
+
+	_, err = store.GetUser("Test")
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+
+	result, err := store.GetUser("Renamed")
+	require.NoError(t, err)
+	require.Equal(t, "test@test.com", result.Email)
+}
+
+func TestStore_AddServiceProviderConflict(t *testing.T) {
+	service := &samlidp.Service{Metadata: saml.EntityDescriptor{EntityID: "Test"}}
+	store := &Store{}
+
+	err := store.UpdateServiceProvider(service)
+	require.ErrorIs(t, err, samlidp.ErrNotFound)
+
+	require.NoError(t, store.AddServiceProvider(service))
+
+	err = store.AddServiceProvider(service)
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	require.NoError(t, store.UpdateServiceProvider(service))
+}
+
+func TestStore_RevokeSessionsOnUpdate(t *testing.T) {
+	for _, revoke := range []bool{false, true} {
+		store := &Store{RevokeSessionsOnUpdate: revoke}
+
+		require.NoError(t, store.AddUser(&samlidp.User{Name: "Test", GivenName: "Test"}))
+		require.NoError(t, store.AddSession(&saml.Session{ID: "1", UserName: "Test"}))
+
+		// A new password alone does not change what is asserted about the user
+		require.NoError(t, store.UpdateUser("Test", &samlidp.User{Name: "Test", GivenName: "Test", HashedPassword: []byte("x")}))
+
+		_, err := store.GetSession("1")
+		require.NoError(t, err)
+
+		require.NoError(t, store.UpdateUser("Test", &samlidp.User{Name: "Test", GivenName: "Changed"}))
+
+		_, err = store.GetSession("1")
+		require.Equal(t, revoke, errors.Is(err, samlidp.ErrNotFound))
+	}
+}
@@ -23,3 +23,11 @@ func renderMarkdown(md string) template.HTML {
 
 	return template.HTML(output)
 }
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
@@ -0,0 +1,482 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	dsig "github.com/russellhaering/goxmldsig"
+	"net/http"
+	"slices"
+)
+
+const (
+	wsFedRoute         = "/wsfed"
+	wsFedMetadataRoute = "/FederationMetadata/2007-06/FederationMetadata.xml"
+
+	wsFedSignIn         = "wsignin1.0"
+	wsFedSignOut        = "wsignout1.0"
+	wsFedSignOutCleanup = "wsignoutcleanup1.0"
+
+	wsFedTokenTypeSaml2  = "saml2"
+	wsFedTokenTypeSaml11 = "saml11"
+
+	saml2TokenType  = "urn:oasis:names:tc:SAML:2.0:assertion"
+	saml11TokenType = "urn:oasis:names:tc:SAML:1.0:assertion"
+
+	wsTrustNamespace     = "http://schemas.xmlsoap.org/ws/2005/02/trust"
+	wsUtilityNamespace   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	wsPolicyNamespace    = "http://schemas.xmlsoap.org/ws/2004/09/policy"
+	wsAddressingNs       = "http://www.w3.org/2005/08/addressing"
+	wsFedNamespace       = "http://docs.oasis-open.org/wsfed/federation/200706"
+	wsAuthNamespace      = "http://docs.oasis-open.org/wsfed/authorization/200706"
+	saml11Namespace      = "urn:oasis:names:tc:SAML:1.0:assertion"
+	claimsNamespace      = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims"
+	roleClaimNamespace   = "http://schemas.microsoft.com/ws/2008/06/identity/claims"
+	authnClaimNamespace  = "http://schemas.microsoft.com/claims"
+	wsFedTimestampFormat = "2006-01-02T15:04:05.000Z"
+
+	commonNameClaimNamespace = "http://schemas.xmlsoap.org/claims"
+)
+
+var wsFedTokenTypes = []string{wsFedTokenTypeSaml2, wsFedTokenTypeSaml11}
+
+var errUnknownRealm = errors.New("unknown wtrealm")
+
+// wsFedClaim is a claim released to WS-Federation relying parties, expressed the way WIF expects it
+type wsFedClaim struct {
+	Namespace   string
+	Name        string
+	DisplayName string
+	Values      []string
+}
+
+func (c wsFedClaim) Uri() string {
+	return c.Namespace + "/" + c.Name
+}
+
+type WsFedResponseData struct {
+	Url     string
+	Result  string
+	Context string
+}
+
+func (s *Server) registerWsFedRoutes(group *gin.RouterGroup) {
+	group.GET(wsFedRoute, s.serveWsFed)
+	group.POST(wsFedRoute, s.serveWsFed)
+	group.GET(wsFedMetadataRoute, s.serveWsFedMetadata)
+}
+
+func (s *Server) serveWsFed(c *gin.Context) {
+	r := c.Request
+	if err := r.ParseForm(); err != nil {
+		c.String(http.StatusBadRequest, "Malformed WS-Federation request")
+		return
+	}
+
+	switch action := r.Form.Get("wa"); action {
+	case wsFedSignIn:
+		s.serveWsFedSignIn(c)
+	case wsFedSignOut, wsFedSignOutCleanup:
+		s.serveWsFedSignOut(c)
+	default:
+		c.String(http.StatusBadRequest, "Unsupported wa: %s", action)
+	}
+}
+
+func (s *Server) serveWsFedSignIn(c *gin.Context) {
+	r := c.Request
+
+	realm := r.Form.Get("wtrealm")
+	service, err := s.Store.GetServiceProvider(realm)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s: %s", errUnknownRealm, realm)
+		return
+	}
+
+	reply, ok := wsFedReply(&service.Metadata, r.Form.Get("wreply"))
+	if !ok {
+		c.String(http.StatusBadRequest, "Unregistered wreply")
+		return
+	}
+
+	form := loginForm{
+		Url:     s.endpointUrl(wsFedRoute),
+		Fields:  map[string]string{},
+		Service: r.Form.Get("wtrealm"),
+	}
+	for _, name := range []string{"wa", "wtrealm", "wreply", "wctx"} {
+		if value := r.Form.Get(name); value != "" {
+			form.Fields[name] = value
+		}
+	}
+
+	session := s.resolveSession(c.Writer, r, form)
+	if session == nil {
+		return
+	}
+
+	tokenType := wsFedTokenTypeSaml2
+	if options, ok := s.serviceOptions(realm); ok && options.WsFedTokenType != "" {
+		tokenType = options.WsFedTokenType
+	}
+
+	var token *etree.Element
+	switch tokenType {
+	case wsFedTokenTypeSaml2:
+		token, err = s.makeSaml2Token(r, &service.Metadata, reply, session)
+	case wsFedTokenTypeSaml11:
+		token, err = s.makeSaml11Token(realm, session)
+	default:
+		err = fmt.Errorf("unsupported WS-Federation token type %q", tokenType)
+	}
+
+	if err != nil {
+		s.idp.Logger.Printf("failed to make WS-Federation token: %s", err)
+		c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(buildRequestSecurityTokenResponse(realm, tokenType, token))
+	result, err := doc.WriteToString()
+	if err != nil {
+		c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	c.HTML(http.StatusOK, "wsfed-response.html", WsFedResponseData{
+		Url:     reply,
+		Result:  result,
+		Context: r.Form.Get("wctx"),
+	})
+}
+
+func (s *Server) serveWsFedSignOut(c *gin.Context) {
+	r := c.Request
+
+	reply := r.Form.Get("wreply")
+	if reply != "" && !s.isRegisteredReply(reply) {
+		c.String(http.StatusBadRequest, "Unregistered wreply")
+		return
+	}
+
+	s.endSession(c.Writer, r)
+
+	if reply == "" {
+		c.String(http.StatusOK, "You have been logged out")
+		return
+	}
+
+	c.Redirect(http.StatusFound, reply)
+}
+
+func (s *Server) serveWsFedMetadata(c *gin.Context) {
+	entityId := s.idp.Metadata().EntityID
+
+	root := etree.NewElement("EntityDescriptor")
+	root.CreateAttr("xmlns", "urn:oasis:names:tc:SAML:2.0:metadata")
+	root.CreateAttr("ID", fmt.Sprintf("_%x", randomId()))
+	root.CreateAttr("entityID", entityId)
+
+	role := root.CreateElement("RoleDescriptor")
+	role.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+	role.CreateAttr("xmlns:fed", wsFedNamespace)
+	role.CreateAttr("xsi:type", "fed:SecurityTokenServiceType")
+	role.CreateAttr("protocolSupportEnumeration", wsFedNamespace)
+
+	keyInfo := role.CreateElement("KeyDescriptor")
+	keyInfo.CreateAttr("use", "signing")
+	x509Data := keyInfo.CreateElement("KeyInfo")
+	x509Data.CreateAttr("xmlns", "http://www.w3.org/2000/09/xmldsig#")
+	x509Data.CreateElement("X509Data").CreateElement("X509Certificate").SetText(base64.StdEncoding.EncodeToString(s.idp.Certificate.Raw))
+
+	tokenTypes := role.CreateElement("fed:TokenTypesOffered")
+	for _, tokenType := range []string{saml2TokenType, saml11TokenType} {
+		tokenTypes.CreateElement("fed:TokenType").CreateAttr("Uri", tokenType)
+	}
+
+	claimTypes := role.CreateElement("fed:ClaimTypesOffered")
+	for _, claim := range wsFedClaims(&saml.Session{}) {
+		claimType := claimTypes.CreateElement("auth:ClaimType")
+		claimType.CreateAttr("xmlns:auth", wsAuthNamespace)
+		claimType.CreateAttr("Uri", claim.Uri())
+		claimType.CreateAttr("Optional", "true")
+		claimType.CreateElement("auth:DisplayName").SetText(claim.DisplayName)
+	}
+
+	for _, name := range []string{"fed:SecurityTokenServiceEndpoint", "fed:PassiveRequestorEndpoint"} {
+		endpoint := role.CreateElement(name).CreateElement("wsa:EndpointReference")
+		endpoint.CreateAttr("xmlns:wsa", wsAddressingNs)
+		endpoint.CreateElement("wsa:Address").SetText(s.endpointUrl(wsFedRoute))
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(root)
+	metadata, err := doc.WriteToBytes()
+	if err != nil {
+		c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	c.Data(http.StatusOK, "application/xml", metadata)
+}
+
+// makeSaml2Token builds a signed SAML 2.0 assertion using the same assertion maker as the SAML endpoints
+func (s *Server) makeSaml2Token(r *http.Request, metadata *saml.EntityDescriptor, reply string, session *saml.Session) (*etree.Element, error) {
+	req := &saml.IdpAuthnRequest{
+		IDP:                     s.idp,
+		HTTPRequest:             r,
+		Now:                     saml.TimeNow(),
+		ServiceProviderMetadata: metadata,
+		SPSSODescriptor:         &metadata.SPSSODescriptors[0],
+		ACSEndpoint: &saml.IndexedEndpoint{
+			Binding:  saml.HTTPPostBinding,
+			Location: reply,
+		},
+	}
+	req.Request.IssueInstant = req.Now
+
+	assertionMaker := s.idp.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return nil, err
+	}
+
+	// The assertion maker only uses the service's view of the session for the assertion, so the claims need it too
+	session, err := s.serviceSession(session, metadata.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Assertion.AttributeStatements) > 0 {
+		statement := &req.Assertion.AttributeStatements[0]
+		for _, claim := range wsFedClaims(session) {
+			if len(claim.Values) == 0 {
+				continue
+			}
+
+			attribute := saml.Attribute{
+				Name:       claim.Uri(),
+				NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			}
+			for _, value := range claim.Values {
+				attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+			}
+			statement.Attributes = append(statement.Attributes, attribute)
+		}
+	}
+
+	if err := req.MakeAssertionEl(); err != nil {
+		return nil, err
+	}
+
+	return req.AssertionEl, nil
+}
+
+// makeSaml11Token builds a signed SAML 1.1 assertion, which crewjam/saml has no support for
+func (s *Server) makeSaml11Token(realm string, session *saml.Session) (*etree.Element, error) {
+	session, err := s.serviceSession(session, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := s.attributes.attributes(session, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	now := saml.TimeNow().UTC()
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", saml11Namespace)
+	assertion.CreateAttr("MajorVersion", "1")
+	assertion.CreateAttr("MinorVersion", "1")
+	assertion.CreateAttr("AssertionID", fmt.Sprintf("_%x", randomId()))
+	assertion.CreateAttr("Issuer", s.idp.Metadata().EntityID)
+	assertion.CreateAttr("IssueInstant", now.Format(wsFedTimestampFormat))
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", now.Add(-saml.MaxClockSkew).Format(wsFedTimestampFormat))
+	conditions.CreateAttr("NotOnOrAfter", now.Add(saml.MaxIssueDelay).Format(wsFedTimestampFormat))
+	conditions.CreateElement("saml:AudienceRestrictionCondition").CreateElement("saml:Audience").SetText(realm)
+
+	subject := etree.NewElement("saml:Subject")
+	nameId := subject.CreateElement("saml:NameIdentifier")
+	nameId.CreateAttr("Format", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified")
+	nameId.SetText(session.NameID)
+	subject.CreateElement("saml:SubjectConfirmation").CreateElement("saml:ConfirmationMethod").SetText("urn:oasis:names:tc:SAML:1.0:cm:bearer")
+
+	statement := assertion.CreateElement("saml:AttributeStatement")
+	statement.AddChild(subject.Copy())
+	for _, claim := range mergeClaims(wsFedClaims(session), attributes) {
+		if len(claim.Values) == 0 {
+			continue
+		}
+
+		attribute := statement.CreateElement("saml:Attribute")
+		attribute.CreateAttr("AttributeName", claim.Name)
+		attribute.CreateAttr("AttributeNamespace", claim.Namespace)
+		for _, value := range claim.Values {
+			attribute.CreateElement("saml:AttributeValue").SetText(value)
+		}
+	}
+
+	method := "urn:oasis:names:tc:SAML:1.0:am:password"
+	if slices.Contains(sessionMethods(session), amrSmartCard) {
+		method = tlsClientAuthnMethod
+	}
+
+	authentication := assertion.CreateElement("saml:AuthenticationStatement")
+	authentication.CreateAttr("AuthenticationMethod", method)
+	authentication.CreateAttr("AuthenticationInstant", session.CreateTime.UTC().Format(wsFedTimestampFormat))
+	authentication.AddChild(subject)
+
+	signingContext, err := s.xmlSigningContext("AssertionID")
+	if err != nil {
+		return nil, err
+	}
+
+	return signingContext.SignEnveloped(assertion)
+}
+
+// xmlSigningContext mirrors the signing context crewjam/saml uses for assertions
+func (s *Server) xmlSigningContext(idAttribute string) (*dsig.SigningContext, error) {
+	keyStore := dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{s.idp.Certificate.Raw},
+		PrivateKey:  s.idp.Key,
+		Leaf:        s.idp.Certificate,
+	})
+
+	signatureMethod := s.idp.SignatureMethod
+	if signatureMethod == "" {
+		signatureMethod = dsig.RSASHA1SignatureMethod
+	}
+
+	signingContext := dsig.NewDefaultSigningContext(keyStore)
+	signingContext.IdAttribute = idAttribute
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+		return nil, err
+	}
+
+	return signingContext, nil
+}
+
+// isRegisteredReply reports whether the URL is the assertion consumer service of any known service
+func (s *Server) isRegisteredReply(reply string) bool {
+	services, err := s.Store.GetServiceProviders()
+	if err != nil {
+		return false
+	}
+
+	for _, service := range services {
+		if _, ok := wsFedReply(&service.Metadata, reply); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serviceOptions finds the configuration of a service that is not captured by its metadata
+func (s *Server) serviceOptions(entityId string) (*Service, bool) {
+	for i := range s.config.Services {
+		if s.config.Services[i].EntityId == entityId {
+			return &s.config.Services[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// wsFedReply resolves where the token is posted to. An explicit wreply must match one of the
+// service's assertion consumer services, otherwise the first one is used.
+func wsFedReply(metadata *saml.EntityDescriptor, reply string) (string, bool) {
+	var locations []string
+	for _, descriptor := range metadata.SPSSODescriptors {
+		for _, acs := range descriptor.AssertionConsumerServices {
+			locations = append(locations, acs.Location)
+		}
+	}
+
+	if len(locations) == 0 {
+		return "", false
+	}
+
+	if reply == "" {
+		return locations[0], true
+	}
+
+	return reply, slices.Contains(locations, reply)
+}
+
+func wsFedClaims(session *saml.Session) []wsFedClaim {
+	claims := []wsFedClaim{
+		{Namespace: claimsNamespace, Name: "name", DisplayName: "Name", Values: nonEmpty(session.UserName)},
+		{Namespace: claimsNamespace, Name: "emailaddress", DisplayName: "E-Mail Address", Values: nonEmpty(session.UserEmail)},
+		{Namespace: claimsNamespace, Name: "givenname", DisplayName: "Given Name", Values: nonEmpty(session.UserGivenName)},
+		{Namespace: claimsNamespace, Name: "surname", DisplayName: "Surname", Values: nonEmpty(session.UserSurname)},
+		{Namespace: commonNameClaimNamespace, Name: "CommonName", DisplayName: "Common Name", Values: nonEmpty(session.UserCommonName)},
+		{Namespace: roleClaimNamespace, Name: "role", DisplayName: "Role", Values: session.Groups},
+		{Namespace: authnClaimNamespace, Name: "authnmethodsreferences", DisplayName: "Authentication Methods References", Values: sessionMethods(session)},
+	}
+
+	return append(claims, profileClaims(session)...)
+}
+
+func buildRequestSecurityTokenResponse(realm, tokenType string, token *etree.Element) *etree.Element {
+	now := saml.TimeNow().UTC()
+
+	rstr := etree.NewElement("t:RequestSecurityTokenResponse")
+	rstr.CreateAttr("xmlns:t", wsTrustNamespace)
+
+	lifetime := rstr.CreateElement("t:Lifetime")
+	created := lifetime.CreateElement("wsu:Created")
+	created.CreateAttr("xmlns:wsu", wsUtilityNamespace)
+	created.SetText(now.Format(wsFedTimestampFormat))
+	expires := lifetime.CreateElement("wsu:Expires")
+	expires.CreateAttr("xmlns:wsu", wsUtilityNamespace)
+	expires.SetText(now.Add(saml.MaxIssueDelay).Format(wsFedTimestampFormat))
+
+	appliesTo := rstr.CreateElement("wsp:AppliesTo")
+	appliesTo.CreateAttr("xmlns:wsp", wsPolicyNamespace)
+	endpoint := appliesTo.CreateElement("wsa:EndpointReference")
+	endpoint.CreateAttr("xmlns:wsa", wsAddressingNs)
+	endpoint.CreateElement("wsa:Address").SetText(realm)
+
+	rstr.CreateElement("t:RequestedSecurityToken").AddChild(token)
+
+	if tokenType == wsFedTokenTypeSaml11 {
+		rstr.CreateElement("t:TokenType").SetText(saml11TokenType)
+	} else {
+		rstr.CreateElement("t:TokenType").SetText(saml2TokenType)
+	}
+
+	rstr.CreateElement("t:RequestType").SetText(wsTrustNamespace + "/Issue")
+	rstr.CreateElement("t:KeyType").SetText("http://schemas.xmlsoap.org/ws/2005/05/identity/NoProofKey")
+
+	return rstr
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return []string{value}
+}
+
+func randomId() []byte {
+	buf := make([]byte, 20)
+	_, _ = rand.Read(buf)
+
+	return buf
+}
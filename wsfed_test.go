@@ -0,0 +1,116 @@
+package idp
+
+import (
+	"crypto/x509"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+var wresultPattern = regexp.MustCompile(`name="wresult" value="([^"]*)"`)
+
+func signInWsFed(t *testing.T, server *Server, realm string) *etree.Element {
+	w := serve(server, postForm(wsFedRoute, url.Values{
+		"wa":       {wsFedSignIn},
+		"wtrealm":  {realm},
+		"wctx":     {"context"},
+		"username": {"test"},
+		"password": {"test"},
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `action="`+testAcs+`"`)
+	assert.Contains(t, w.Body.String(), `name="wctx" value="context"`)
+
+	match := wresultPattern.FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromString(html.UnescapeString(match[1])))
+	require.Equal(t, "RequestSecurityTokenResponse", doc.Root().Tag)
+
+	return doc.Root()
+}
+
+func TestWsFed_SignInSaml2(t *testing.T) {
+	server := newTestServer(t)
+
+	rstr := signInWsFed(t, server, testEntityId)
+	assert.Equal(t, saml2TokenType, rstr.FindElement("./TokenType").Text())
+
+	assertion := rstr.FindElement("./RequestedSecurityToken/Assertion")
+	require.NotNil(t, assertion)
+	assert.NotNil(t, assertion.FindElement("./Signature"))
+	assert.Equal(t, testEntityId, assertion.FindElement(".//Audience").Text())
+	assert.NotNil(t, assertion.FindElement(`.//Attribute[@Name='`+claimsNamespace+`/emailaddress']`))
+}
+
+func TestWsFed_SignInSaml11(t *testing.T) {
+	server := newTestServer(t)
+
+	rstr := signInWsFed(t, server, testEntityId+"-saml11")
+	assert.Equal(t, saml11TokenType, rstr.FindElement("./TokenType").Text())
+
+	assertion := rstr.FindElement("./RequestedSecurityToken/Assertion")
+	require.NotNil(t, assertion)
+	assert.Equal(t, "1", assertion.SelectAttrValue("MajorVersion", ""))
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{server.idp.Certificate},
+	})
+	validator.IdAttribute = "AssertionID"
+	_, err := validator.Validate(assertion)
+	require.NoError(t, err)
+
+	assert.Equal(t, "test@test.com", assertion.FindElement(".//NameIdentifier").Text())
+	assert.NotNil(t, assertion.FindElement(`.//Attribute[@AttributeName='role']`))
+}
+
+func TestWsFed_SignInShowsLoginPage(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, wsFedRoute+"?wa=wsignin1.0&wtrealm="+testEntityId, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `name="wtrealm"`)
+}
+
+func TestWsFed_UnknownRealm(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, wsFedRoute+"?wa=wsignin1.0&wtrealm=unknown", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWsFed_UnregisteredReply(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, wsFedRoute+"?wa=wsignin1.0&wtrealm="+testEntityId+"&wreply="+url.QueryEscape("http://evil.test"), nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWsFed_SignOut(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, wsFedRoute+"?wa=wsignout1.0&wreply="+url.QueryEscape(testAcs), nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, testAcs, w.Header().Get("Location"))
+}
+
+func TestWsFed_Metadata(t *testing.T) {
+	server := newTestServer(t)
+
+	w := serve(server, httptest.NewRequest(http.MethodGet, wsFedMetadataRoute, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromBytes(w.Body.Bytes()))
+	address := doc.FindElement("//PassiveRequestorEndpoint//Address")
+	require.NotNil(t, address)
+	assert.Equal(t, "http://localhost:8080/wsfed", address.Text())
+}